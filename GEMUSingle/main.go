@@ -4,26 +4,54 @@ import (
 	"flag"
 	"fmt"
 	"image"
-	"image/color"
+	"image/draw"
+	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/techcompliant/GEMU"
 	"github.com/andyleap/tinyfb"
+	"github.com/techcompliant/GEMU"
+	"github.com/techcompliant/GEMU/rfb"
+	"github.com/techcompliant/GEMU/web"
 )
 
-func GetColor(c uint16) color.Color {
-	return color.RGBA{
-		R: uint8((c >> 8 & 0x0f) << 4),
-		G: uint8((c >> 4 & 0x0f) << 4),
-		B: uint8((c >> 0 & 0x0f) << 4),
-	}
-}
-
 var RomImage = flag.String("rom", "internal/bbos.bin", "Filename of rom image to use (internal bbos by default)")
-var RomFlip = flag.Bool("noromflip", false, "Don't endian flip the rom")
+var RomSize = flag.Int("romsize", 0, "Size of the rom in words (the size of the image by default)")
+var RomWrite = flag.Bool("romwrite", false, "Save roms the guest flashes back to the image")
+var RomOrder = flag.String("romorder", "auto", "Byte order of a rom image without a header: big, little or auto to guess")
+var NoRomFlip = flag.Bool("noromflip", false, "Deprecated: same as -romorder=little")
+var FloppyOrder = flag.String("floppyorder", "auto", "Byte order of floppy images without a header: big, little or auto to guess")
+var Script = flag.String("script", "", "Automation script to run after boot")
+var Headless = flag.Bool("headless", false, "Run without opening a window")
+var Term = flag.Bool("term", false, "Render the LEM to the terminal instead of opening a window")
+var TermColor = flag.String("termcolor", "256", "Terminal colour mode, 256 or truecolor")
+var HTTPAddr = flag.String("http", "", "Serve the display to web browsers on this address (eg localhost:8080)")
+var HTTPReadOnly = flag.Bool("httpreadonly", false, "Only allow spectators on the web frontend")
+var HTTPDelete = flag.Bool("httpdelete", false, "Allow deleting disk images through the web frontend's /disks API")
+var Layout = flag.String("layout", "us", "Host keyboard layout (us, uk or de)")
+var RepeatDelay = flag.Duration("repeatdelay", 0, "Delay before held keys repeat (0 leaves repeat to the host)")
+var RepeatRate = flag.Duration("repeatrate", 30*time.Millisecond, "Interval between repeated keys")
+var PasteFile = flag.String("pastefile", "", "Text file to type into the keyboard after boot")
+var VNCAddr = flag.String("vnc", "", "Serve the display to VNC viewers on this address (eg localhost:5900)")
+var RecordFile = flag.String("record", "", "Record all input to this file for replay")
+var ReplayFile = flag.String("replay", "", "Replay input recorded with -record, run with the same rom and floppies")
+var TimeMode = flag.String("time", "real", "Clock time source: real, cycle (follows emulated time) or fixed")
+var Epoch = flag.String("epoch", "2600-01-01T00:00:00Z", "Time the clock starts at, in RFC 3339 format")
+var Drives = flag.Int("drives", 0, "Number of floppy drives, there is always one for each -floppy")
+var HDDImage = flag.String("hdd", "", "Hard disk image to attach as an HMD2043")
+var HDDGeometry = flag.String("hddgeometry", "80x2x9", "Hard disk geometry as cylinders x heads x sectors per track, 512 word sectors")
+var HDDOrder = flag.String("hddorder", "auto", "Byte order of a hard disk image without a header: big, little or auto to guess")
+var EEPROMFile = flag.String("eeprom", "", "File to keep an attached EEPROM in")
+var EEPROMSize = flag.Int("eepromsize", 1024, "Size of the EEPROM in words")
+var RTCFile = flag.String("rtc", "", "File to keep the time set by the guest in across runs")
+var Jail = flag.Bool("jail", false, "Refuse image and other file names that reach outside the current directory")
+var Quota = flag.Int64("quota", 0, "With -jail, the most bytes each directory of images may hold")
+var Bundle = flag.String("bundle", "", "Zip or tar archive to run, with a manifest.json naming its rom and floppies")
+var HostFSDir = flag.String("hostfs", "", "Directory the guest can read and write files in through the host filesystem device")
+var OverlayDir = flag.String("overlay", "", "Keep changes to images in this directory, leaving the originals untouched")
 
 type FloppyImages []string
 
@@ -42,186 +70,354 @@ func main() {
 
 	flag.Parse()
 
-	t := tinyfb.New("DCPU", (128+12)*4, (96+12)*4)
-	go func() {
-		t.Run()
-		os.Exit(0)
-	}()
-
-	gemu.SetStorage(gemu.NewMultiStorage(AssetStorage{Root: "internal/"}, gemu.NewDiskStorage(".")))
+	// images holds the -eeprom, -record, -replay and -rtc files too, so
+	// -jail covers them as well.
+	images := gemu.NewDiskStorage(".")
+	if *Jail {
+		jail, err := gemu.NewJailStorage(".", gemu.JailOptions{Quota: *Quota})
+		if err != nil {
+			fatal(err)
+		}
+		images = jail
+	}
+	storage := gemu.NewMultiStorage(AssetStorage{Root: "internal/"}, images)
+	if *Bundle != "" {
+		bundle, err := gemu.NewArchiveStorage(*Bundle)
+		if err != nil {
+			fatal(err)
+		}
+		manifest, err := bundle.Manifest()
+		if err != nil {
+			fatal(err)
+		}
+		useBundle(manifest, fis)
+		// Changed floppies are copied out of the bundle into the current
+		// directory.
+		storage = gemu.NewMultiStorage(AssetStorage{Root: "internal/"}, bundle, images)
+	}
+	if *OverlayDir != "" {
+		changes := gemu.NewDiskStorage(*OverlayDir)
+		if *Jail {
+			jail, err := gemu.NewJailStorage(*OverlayDir, gemu.JailOptions{Quota: *Quota})
+			if err != nil {
+				fatal(err)
+			}
+			changes = jail
+		}
+		storage = gemu.NewOverlayStorage(storage, changes)
+	}
+	gemu.SetStorage(storage)
 
 	cpu := gemu.NewDCPU(0)
+	machine := gemu.NewMachine(cpu)
 
-	rom := gemu.NewRom(*RomImage, !*RomFlip)
-	cpu.Attach(rom)
-	rom.SetUp(cpu)
+	rom, err := gemu.NewRomWith(*RomImage, gemu.RomOptions{
+		Size:        *RomSize,
+		WriteEnable: *RomWrite,
+		Order:       romOrder(),
+	})
+	if err != nil {
+		fatal(err)
+	}
+	machine.Attach(rom)
 
-	clock := gemu.NewClock()
-	cpu.Attach(clock)
-	clock.SetUp(cpu)
+	clockOpts, err := clockOptions(images)
+	if err != nil {
+		fatal(err)
+	}
+	clock := gemu.NewClockWith(clockOpts)
+	machine.Attach(clock)
 
 	lem := gemu.NewLem1802()
-	cpu.Attach(lem)
-	lem.SetUp(cpu)
+	machine.Attach(lem)
 
 	keyboard := gemu.NewKeyboard()
-	cpu.Attach(keyboard)
-	keyboard.SetUp(cpu)
+	machine.Attach(keyboard)
+
+	layout, err := gemu.LookupKeyLayout(*Layout)
+	if err != nil {
+		fatal(err)
+	}
+	input := machine.KeyInput(keyboard)
+	keys := gemu.NewHostKeyboard(input, layout)
+	keys.RepeatDelay = durationTicks(*RepeatDelay)
+	keys.RepeatRate = durationTicks(*RepeatRate)
+	machine.AddTicker(keys)
+
+	floppyOrder := imageOrder("-floppyorder", *FloppyOrder)
+	for i := 0; i < len(*fis) || i < *Drives; i++ {
+		floppy := gemu.NewM35FD()
+		floppy.SetImageOrder(floppyOrder)
+		machine.Attach(floppy)
+		if i < len(*fis) {
+			floppy.ChangeDisk((*fis)[i])
+		}
+	}
+	changer := gemu.NewDiskChanger(machine)
+
+	if *EEPROMFile != "" {
+		if *EEPROMSize <= 0 || *EEPROMSize > 0x10000 {
+			fatalf("bad -eepromsize %d", *EEPROMSize)
+		}
+		eeprom, err := gemu.NewEEPROM(*EEPROMSize, images, *EEPROMFile)
+		if err != nil {
+			fatal(err)
+		}
+		machine.Attach(eeprom)
+	}
 
-	floppies := []*gemu.M35FD{}
+	if *HostFSDir != "" {
+		jail, err := gemu.NewJailStorage(*HostFSDir, gemu.JailOptions{Quota: *Quota})
+		if err != nil {
+			fatal(err)
+		}
+		machine.Attach(gemu.NewHostFS(jail))
+	}
 
-	for _, fi := range *fis {
-		floppy := gemu.NewM35FD(true)
-		cpu.Attach(floppy)
-		floppy.SetUp(cpu)
-		floppy.ChangeDisk(fi)
-		floppies = append(floppies, floppy)
+	if *HDDImage != "" {
+		geometry := gemu.DiskGeometry{SectorWords: 512}
+		_, err := fmt.Sscanf(*HDDGeometry, "%dx%dx%d", &geometry.Cylinders, &geometry.Heads, &geometry.SectorsPerTrack)
+		if err != nil || geometry.Sectors() <= 0 {
+			fatalf("bad -hddgeometry %q", *HDDGeometry)
+		}
+		hdd := gemu.NewHMD2043(geometry)
+		hdd.SetImageOrder(imageOrder("-hddorder", *HDDOrder))
+		machine.Attach(hdd)
+		hdd.ChangeDisk(*HDDImage)
 	}
 
-	cpu.Start()
+	if *ReplayFile != "" {
+		inputLog, err := gemu.LoadInputLog(images, *ReplayFile)
+		if err != nil {
+			fatal(err)
+		}
+		if err := machine.Replay(inputLog); err != nil {
+			fatal(err)
+		}
+	}
 
-	lemImageBig := image.NewRGBA(image.Rect(0, 0, (128+12)*4, (96+12)*4))
+	var recorder *gemu.InputRecorder
+	if *RecordFile != "" {
+		recorder, err = gemu.NewInputRecorder(images, *RecordFile)
+		if err != nil {
+			fatal(err)
+		}
+		machine.Record(recorder)
+		cleanups = append(cleanups, func() {
+			if err := recorder.Err(); err != nil {
+				log.Print(err)
+			}
+		})
+	}
 
-	t.Char(func(char string, mods int) {
-		switch char {
-		case "BackSpace", "\x08":
-			char = "\x10"
-		case "Return", "\x0d":
-			char = "\x11"
-		case "Insert":
-			char = "\x12"
-		case "Delete":
-			char = "\x13"
-		case "Up":
-			char = "\x80"
-		case "Down":
-			char = "\x81"
-		case "Left":
-			char = "\x82"
-		case "Right":
-			char = "\x83"
+	machine.Start()
+
+	if *PasteFile != "" {
+		text, err := ioutil.ReadFile(*PasteFile)
+		if err != nil {
+			fatal(err)
+		}
+		input.Paste(string(text))
+	}
+
+	if *Term {
+		runTerm(lem, input, keys)
+	} else if !*Headless {
+		runWindow(lem, input, keys, newDiskMenu(changer))
+	}
+
+	if *HTTPAddr != "" {
+		server := web.NewServer(input, lem)
+		server.Layout = layout
+		server.ReadOnly = *HTTPReadOnly
+		server.Disks = changer
+		server.AllowDelete = *HTTPDelete
+		go func() {
+			fatal(server.ListenAndServe(*HTTPAddr))
+		}()
+	}
+
+	if *VNCAddr != "" {
+		go func() {
+			server := rfb.NewServer(lem, input)
+			server.Layout = layout
+			fatal(server.ListenAndServe(*VNCAddr))
+		}()
+	}
+
+	if *Script != "" {
+		file, err := os.Open(*Script)
+		if err != nil {
+			fatal(err)
 		}
+		err = gemu.NewAutomation(machine, keyboard, lem).RunScript(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, lem.Screen())
+			fatal(err)
+		}
+		if *Headless {
+			exit(0)
+		}
+	}
+
+	for ticks := 1; ; ticks++ {
+		machine.Tick(1)
+		if recorder != nil && ticks%gemu.TicksPerSecond == 0 {
+			if recorder.Err() != nil {
+				exit(1)
+			}
+		}
+	}
+}
+
+// cleanups are run however the emulator exits, to put the host terminal
+// back the way it was.
+var cleanups []func()
+
+func exit(code int) {
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	os.Exit(code)
+}
+
+func fatal(v ...interface{}) {
+	log.Print(v...)
+	exit(1)
+}
+
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	exit(1)
+}
+
+func clockOptions(files gemu.Storage) (gemu.ClockOptions, error) {
+	opts := gemu.ClockOptions{}
+	epoch, err := time.Parse(time.RFC3339, *Epoch)
+	if err != nil {
+		return opts, fmt.Errorf("bad -epoch: %v", err)
+	}
+	opts.Epoch = epoch
+	if *RTCFile != "" {
+		opts.Storage, opts.Item = files, *RTCFile
+	}
+	switch *TimeMode {
+	case "real":
+		opts.Time = gemu.RealTime{}
+	case "cycle":
+		opts.Time = gemu.NewCycleTime(time.Unix(0, 0))
+	case "fixed":
+		opts.Time = gemu.NewManualTime(time.Unix(0, 0))
+	default:
+		return opts, fmt.Errorf("unknown -time %q", *TimeMode)
+	}
+	return opts, nil
+}
+
+func durationTicks(d time.Duration) int {
+	return int(d * gemu.TicksPerSecond / time.Second)
+}
+
+// romOrder reads -romorder, or the -noromflip it replaced.
+func romOrder() gemu.ImageOrder {
+	if *NoRomFlip {
+		log.Println("-noromflip is deprecated, use -romorder=little")
+		return gemu.ImageOrderLittle
+	}
+	return imageOrder("-romorder", *RomOrder)
+}
+
+func imageOrder(flagName, value string) gemu.ImageOrder {
+	order, err := gemu.ParseImageOrder(value)
+	if err != nil {
+		fatalf("bad %s %q", flagName, value)
+	}
+	return order
+}
+
+func runWindow(lem *gemu.Lem1802, paster gemu.Paster, keys *gemu.HostKeyboard, menu *diskMenu) {
+	t := tinyfb.New("DCPU", (128+12)*4, (96+12)*4)
+	go func() {
+		t.Run()
+		exit(0)
+	}()
+
+	lemImageBig := image.NewRGBA(image.Rect(0, 0, (128+12)*4, (96+12)*4))
 
-		if len(char) == 1 {
-			keyboard.ParsedKey(uint16(char[0]))
-		} else {
-			//log.Println("Got: ", char)
+	t.Char(func(char string, mods int) {
+		if menu.Open() {
+			menu.Char(char)
+			return
 		}
+		keys.Char(char)
 	})
 
 	t.Key(func(key string, mods int, press bool) {
-		switch key {
-		case "BackSpace", "\x08":
-			key = "\x10"
-		case "Return", "\x0d":
-			key = "\x11"
-		case "Insert":
-			key = "\x12"
-		case "Delete":
-			key = "\x13"
+		if key == "F12" {
+			if press {
+				menu.Toggle()
+			}
+			return
+		}
+		if menu.Open() {
+			if press {
+				menu.Key(key)
+			}
+			return
+		}
+		if key == "Insert" && keys.Shift() {
+			if press {
+				text, err := clipboardText()
+				if err != nil {
+					log.Println("Paste failed:", err)
+					return
+				}
+				paster.Paste(text)
+			}
+			return
 		}
-		keyboard.RawKey(uint16(key[0]), press)
+		keys.Key(key, press)
 	})
 
 	go func() {
 		for {
 			time.Sleep(20 * time.Millisecond)
 
-			if lem.DspMem == 0 {
+			if lem.DspMem == 0 && !menu.Open() {
 				continue
 			}
-			dspRam := lem.GetMem().GetRaw()[lem.DspMem:]
-			fontRam := gemu.LemDefFont
-			if lem.FontMem != 0 {
-				fontRam = lem.GetMem().GetRaw()[lem.FontMem:]
+			border := &image.Uniform{lem.BorderColor()}
+			draw.Draw(lemImageBig, lemImageBig.Bounds(), border, image.ZP, draw.Src)
+			lemImage := lem.Render()
+			if menu.Open() {
+				menu.Draw(lemImage)
 			}
-			palRam := gemu.LemDefPal
-			if lem.PalMem != 0 {
-				palRam = lem.GetMem().GetRaw()[lem.PalMem:]
-			}
-			cl := GetColor(palRam[lem.Border&0xf])
-			for x := 0; x < (128+12)*4; x++ {
-				for y := 0; y < 6*4; y++ {
-					lemImageBig.Set(x, y, cl)
-					lemImageBig.Set(x, ((96+12)*4)-y, cl)
-				}
-			}
-			for x := 0; x < (6)*4; x++ {
-				for y := 0; y < (96+12)*4; y++ {
-					lemImageBig.Set(x, y, cl)
-					lemImageBig.Set((128+12)*4-x, y, cl)
-				}
-			}
-
-			for ty := 0; ty < 12; ty++ {
-				vtb := uint16(0x0100)
-				vta := uint16(0x0001)
-				for y := 0; y < 8; y++ {
-					for x := 0; x < 32; x++ {
-						vtw := dspRam[x+ty*32]
-						clb := palRam[(vtw>>8)&0x0f]
-						clf := palRam[(vtw>>12)&0x0f]
-						vtw &= 0x7f
-						vtw <<= 1
-						f := fontRam[vtw]
-						cl := clf
-						if f&vtb == 0 {
-							cl = clb
-						}
-						for sx := 0; sx < 4; sx++ {
-							for sy := 0; sy < 4; sy++ {
-								lemImageBig.Set(((x*4)+0)*4+sx+6*4, (ty*8+y)*4+sy+6*4, GetColor(cl))
-							}
-						}
-
-						f = fontRam[vtw]
-						cl = clf
-						if f&vta == 0 {
-							cl = clb
-						}
-						for sx := 0; sx < 4; sx++ {
-							for sy := 0; sy < 4; sy++ {
-								lemImageBig.Set(((x*4)+1)*4+sx+6*4, (ty*8+y)*4+sy+6*4, GetColor(cl))
-							}
-						}
-
-						f = fontRam[vtw+1]
-						cl = clf
-						if f&vtb == 0 {
-							cl = clb
-						}
-						for sx := 0; sx < 4; sx++ {
-							for sy := 0; sy < 4; sy++ {
-								lemImageBig.Set(((x*4)+2)*4+sx+6*4, (ty*8+y)*4+sy+6*4, GetColor(cl))
-							}
-						}
-
-						f = fontRam[vtw+1]
-						cl = clf
-						if f&vta == 0 {
-							cl = clb
-						}
-						for sx := 0; sx < 4; sx++ {
-							for sy := 0; sy < 4; sy++ {
-								lemImageBig.Set(((x*4)+3)*4+sx+6*4, (ty*8+y)*4+sy+6*4, GetColor(cl))
-							}
-						}
-
-					}
-					vtb <<= 1
-					vta <<= 1
+			for y := 0; y < gemu.DisplayHeight*4; y++ {
+				for x := 0; x < gemu.DisplayWidth*4; x++ {
+					lemImageBig.SetRGBA(x+6*4, y+6*4, lemImage.RGBAAt(x/4, y/4))
 				}
 			}
 			t.Update(lemImageBig)
 		}
 	}()
+}
 
-	for {
-		cpu.Tick(1)
-		clock.Tick(1)
-		for _, fd := range floppies {
-			fd.Tick(1)
-		}
+// useBundle runs the rom and floppies of a bundle, unless others were given
+// on the command line.
+func useBundle(manifest *gemu.BundleManifest, fis *FloppyImages) {
+	romSet := false
+	flag.Visit(func(f *flag.Flag) {
+		romSet = romSet || f.Name == "rom"
+	})
+	if manifest.Rom != "" && !romSet {
+		*RomImage = manifest.Rom
+	}
+	if len(*fis) == 0 {
+		*fis = append(*fis, manifest.Floppies...)
+	}
+	if manifest.Name != "" {
+		log.Println("Running", manifest.Name)
 	}
 }
 
@@ -265,6 +461,12 @@ func (a AssetStorage) Read(Item string, offset int, data []byte) {
 	}
 	copy(data, asset[offset:])
 }
+
+// ReadOnly is true even for items that are not assets, so new items go to
+// the storages after it.
+func (a AssetStorage) ReadOnly(Item string) bool {
+	return true
+}
 func (a AssetStorage) Write(Item string, offset int, data []byte) {
 	if strings.HasPrefix(Item, a.Root) {
 
@@ -273,3 +475,26 @@ func (a AssetStorage) Write(Item string, offset int, data []byte) {
 	}
 	log.Println("Writing to internal assets is not supported!")
 }
+func (a AssetStorage) List(prefix string) ([]gemu.ItemInfo, error) {
+	items := []gemu.ItemInfo{}
+	for _, name := range AssetNames() {
+		if !strings.HasPrefix(a.Root+name, prefix) {
+			continue
+		}
+		if item, err := a.Stat(a.Root + name); err == nil {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+func (a AssetStorage) Stat(Item string) (gemu.ItemInfo, error) {
+	if !strings.HasPrefix(Item, a.Root) {
+		return gemu.ItemInfo{}, &os.PathError{Op: "stat", Path: Item, Err: os.ErrNotExist}
+	}
+	asset, err := AssetInfo(strings.TrimPrefix(Item, a.Root))
+	if err != nil {
+		return gemu.ItemInfo{}, &os.PathError{Op: "stat", Path: Item, Err: os.ErrNotExist}
+	}
+	return gemu.ItemInfo{Name: Item, Size: asset.Size(), ModTime: asset.ModTime()}, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"sync"
+
+	"github.com/techcompliant/GEMU"
+)
+
+// diskMenu is the F12 overlay for changing floppies while the machine runs.
+//
+//	Up/Down  select a drive
+//	E        eject
+//	I        insert an image, asking for its name
+//	N        create a blank image and insert it
+//	S        swap disks with the next drive
+//	W        toggle write protection
+type diskMenu struct {
+	changer *gemu.DiskChanger
+
+	mu      sync.Mutex
+	open    bool
+	drive   int
+	action  string
+	input   string
+	message string
+}
+
+var (
+	menuFg = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	menuBg = color.RGBA{0x00, 0x00, 0xaa, 0xff}
+	menuHi = color.RGBA{0x00, 0xaa, 0xaa, 0xff}
+)
+
+func newDiskMenu(changer *gemu.DiskChanger) *diskMenu {
+	return &diskMenu{changer: changer}
+}
+
+func (m *diskMenu) Toggle() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.open = !m.open
+	m.action, m.input, m.message = "", "", ""
+}
+
+func (m *diskMenu) Open() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.open
+}
+
+// Key handles a key press while the menu is open.
+func (m *diskMenu) Key(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.action != "" {
+		switch name {
+		case "Return", "KP_Enter":
+			m.finish()
+		case "BackSpace":
+			if m.input != "" {
+				m.input = m.input[:len(m.input)-1]
+			}
+		case "Escape":
+			m.action, m.input = "", ""
+		}
+		return
+	}
+	switch name {
+	case "Up":
+		if m.drive > 0 {
+			m.drive--
+		}
+	case "Down":
+		if m.drive < len(m.changer.Drives)-1 {
+			m.drive++
+		}
+	case "Escape":
+		m.open = false
+	}
+}
+
+// Char handles typed text while the menu is open.
+func (m *diskMenu) Char(char string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.action != "" {
+		if len(char) == 1 && char[0] >= 0x20 && char[0] < 0x7f {
+			m.input += char
+		}
+		return
+	}
+	if len(m.changer.Drives) == 0 {
+		return
+	}
+	var err error
+	switch strings.ToLower(char) {
+	case "e":
+		err = m.changer.Eject(m.drive)
+		m.message = "EJECTED"
+	case "i":
+		m.action = "INSERT"
+	case "n":
+		m.action = "NEW DISK"
+	case "s":
+		err = m.changer.Swap(m.drive, (m.drive+1)%len(m.changer.Drives))
+		m.message = "SWAPPED"
+	case "w":
+		protect := !m.changer.Drives[m.drive].Status().WriteProtected
+		err = m.changer.SetWriteProtect(m.drive, protect)
+		m.message = "WRITE PROTECT OFF"
+		if protect {
+			m.message = "WRITE PROTECT ON"
+		}
+	}
+	if err != nil {
+		m.message = err.Error()
+	}
+}
+
+func (m *diskMenu) finish() {
+	action, image := m.action, m.input
+	m.action, m.input = "", ""
+	if image == "" {
+		return
+	}
+	if action == "NEW DISK" {
+		if err := m.changer.CreateBlank(image); err != nil {
+			m.message = err.Error()
+			return
+		}
+	}
+	if err := m.changer.Insert(m.drive, image); err != nil {
+		m.message = err.Error()
+		return
+	}
+	m.message = "INSERTED"
+}
+
+func (m *diskMenu) lines() []string {
+	lines := []string{"FLOPPY DRIVES      F12 TO CLOSE", ""}
+	if len(m.changer.Drives) == 0 {
+		lines = append(lines, "NO DRIVES")
+	}
+	for _, status := range m.changer.Status() {
+		disk := status.Disk
+		if disk == "" {
+			disk = "(EMPTY)"
+		}
+		if len(disk) > 24 {
+			disk = "..." + disk[len(disk)-21:]
+		}
+		wp := ""
+		if status.WriteProtected {
+			wp = "WP"
+		}
+		lines = append(lines, fmt.Sprintf("%d %-24s %s", status.Drive, disk, wp))
+	}
+	for len(lines) < 8 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, "E EJECT I INSERT N NEW", "S SWAP  W PROTECT", "")
+	if m.action != "" {
+		input := m.action + ": " + m.input + "_"
+		if len(input) > gemu.LemWidth {
+			input = input[len(input)-gemu.LemWidth:]
+		}
+		lines = append(lines, input)
+	} else {
+		lines = append(lines, strings.ToUpper(m.message))
+	}
+	return lines
+}
+
+// Draw draws the menu over a display image.
+func (m *diskMenu) Draw(img *image.RGBA) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for y, line := range m.lines() {
+		if y >= gemu.LemHeight {
+			break
+		}
+		bg := menuBg
+		if y == m.drive+2 && len(m.changer.Drives) > 0 {
+			bg = menuHi
+		}
+		if len(line) > gemu.LemWidth {
+			line = line[:gemu.LemWidth]
+		}
+		line += strings.Repeat(" ", gemu.LemWidth-len(line))
+		gemu.DrawText(img, 0, y*8, line, menuFg, bg)
+	}
+}
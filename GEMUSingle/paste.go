@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var clipboardCommands = [][]string{
+	{"xclip", "-o", "-selection", "clipboard"},
+	{"xsel", "--clipboard", "--output"},
+	{"wl-paste", "--no-newline"},
+	{"pbpaste"},
+}
+
+// clipboardText reads the host clipboard through whichever clipboard tool is
+// installed.
+func clipboardText() (string, error) {
+	for _, args := range clipboardCommands {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(args[0], args[1:]...).Output()
+		if err != nil {
+			return "", err
+		}
+		return string(out), nil
+	}
+	return "", errors.New("no clipboard tool found (install xclip or xsel)")
+}
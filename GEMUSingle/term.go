@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/techcompliant/GEMU"
+)
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func termColor(c uint16, background bool, truecolor bool) string {
+	r, g, b := int(c>>8&0x0f), int(c>>4&0x0f), int(c&0x0f)
+	layer := 38
+	if background {
+		layer = 48
+	}
+	if truecolor {
+		return fmt.Sprintf("\x1b[%d;2;%d;%d;%dm", layer, r*17, g*17, b*17)
+	}
+	cube := func(v int) int { return (v*5 + 7) / 15 }
+	return fmt.Sprintf("\x1b[%d;5;%dm", layer, 16+36*cube(r)+6*cube(g)+cube(b))
+}
+
+func renderTerm(screen *gemu.LemScreen, truecolor bool) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("\x1b[H")
+	border := termColor(screen.Palette[screen.Border], true, truecolor)
+	borderRow := border + strings.Repeat(" ", gemu.LemWidth+4) + "\x1b[0m\r\n"
+	buf.WriteString(borderRow)
+	lines := screen.Lines()
+	for y, row := range screen.Cells {
+		buf.WriteString(border + "  ")
+		for x, cell := range row {
+			buf.WriteString(termColor(screen.Palette[cell.Fg], false, truecolor))
+			buf.WriteString(termColor(screen.Palette[cell.Bg], true, truecolor))
+			if cell.Blink {
+				buf.WriteString("\x1b[5m")
+			}
+			buf.WriteByte(lines[y][x])
+			if cell.Blink {
+				buf.WriteString("\x1b[25m")
+			}
+		}
+		buf.WriteString(border + "  \x1b[0m\r\n")
+	}
+	buf.WriteString(borderRow)
+	return buf.Bytes()
+}
+
+// escTimeout is how long to wait after an ESC for the rest of an escape
+// sequence, before taking it as the ESC key on its own.
+const escTimeout = 50 * time.Millisecond
+
+// termInput reads the terminal a byte at a time on its own goroutine, so a
+// bare ESC can be told apart from the start of an escape sequence by how
+// soon the next byte arrives.
+type termInput struct {
+	bytes   chan byte
+	pending []byte
+}
+
+func newTermInput(r io.Reader) *termInput {
+	T := &termInput{bytes: make(chan byte, 256)}
+	go func() {
+		in := bufio.NewReader(r)
+		for {
+			c, err := in.ReadByte()
+			if err != nil {
+				close(T.bytes)
+				return
+			}
+			T.bytes <- c
+		}
+	}()
+	return T
+}
+
+// next returns the next byte, waiting for at most timeout if it is positive.
+// ok is false on a timeout or once the terminal is closed.
+func (T *termInput) next(timeout time.Duration) (c byte, ok bool) {
+	if len(T.pending) > 0 {
+		c, T.pending = T.pending[0], T.pending[1:]
+		return c, true
+	}
+	if timeout <= 0 {
+		c, ok = <-T.bytes
+		return c, ok
+	}
+	select {
+	case c, ok = <-T.bytes:
+		return c, ok
+	case <-time.After(timeout):
+		return 0, false
+	}
+}
+
+func (T *termInput) unread(c byte) {
+	T.pending = append(T.pending, c)
+}
+
+// readTermKeys decodes the byte stream of a raw mode terminal, including the
+// VT100 escape sequences for the arrow, insert and delete keys.  Text pasted
+// into the terminal arrives as a bracketed paste and goes to the keyboard's
+// paste queue.  Ctrl-] restores the terminal and exits.
+func readTermKeys(paster gemu.Paster, keys *gemu.HostKeyboard) {
+	in := newTermInput(os.Stdin)
+	for {
+		c, ok := in.next(0)
+		if !ok {
+			return
+		}
+		switch {
+		case c == 0x1d:
+			exit(0)
+		case c == 0x1b:
+			next, ok := in.next(escTimeout)
+			if !ok {
+				continue
+			}
+			if next != '[' && next != 'O' {
+				in.unread(next)
+				continue
+			}
+			seq := []byte{}
+			for {
+				if c, ok = in.next(0); !ok {
+					return
+				}
+				seq = append(seq, c)
+				if c >= 0x40 && c <= 0x7e {
+					break
+				}
+			}
+			switch string(seq) {
+			case "A":
+				keys.PressKey(gemu.KEY_UP)
+			case "B":
+				keys.PressKey(gemu.KEY_DOWN)
+			case "D":
+				keys.PressKey(gemu.KEY_LEFT)
+			case "C":
+				keys.PressKey(gemu.KEY_RIGHT)
+			case "2~":
+				keys.PressKey(gemu.KEY_INSERT)
+			case "3~":
+				keys.PressKey(gemu.KEY_DELETE)
+			case "200~":
+				text := []byte{}
+				for !bytes.HasSuffix(text, []byte("\x1b[201~")) {
+					if c, ok = in.next(0); !ok {
+						break
+					}
+					text = append(text, c)
+				}
+				paster.Paste(strings.TrimSuffix(string(text), "\x1b[201~"))
+			}
+		case c == 0x7f || c == 0x08:
+			keys.PressKey(gemu.KEY_BACKSPACE)
+		case c == '\r' || c == '\n':
+			keys.PressKey(gemu.KEY_RETURN)
+		case c >= 0x20 && c < 0x7f:
+			keys.TypeRune(rune(c))
+		}
+	}
+}
+
+func runTerm(lem *gemu.Lem1802, paster gemu.Paster, keys *gemu.HostKeyboard) {
+	truecolor := *TermColor == "truecolor"
+	state, err := stty("-g")
+	if err != nil {
+		fatal("Unable to read terminal state: ", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		fatal("Unable to put terminal in raw mode: ", err)
+	}
+	cleanups = append(cleanups, func() {
+		os.Stdout.WriteString("\x1b[0m\x1b[?25h\x1b[?2004l\r\n")
+		stty(state)
+	})
+	os.Stdout.WriteString("\x1b[2J\x1b[?25l\x1b[?2004h")
+
+	go readTermKeys(paster, keys)
+
+	go func() {
+		last := []byte{}
+		for {
+			time.Sleep(50 * time.Millisecond)
+			frame := renderTerm(lem.Screen(), truecolor)
+			if !bytes.Equal(frame, last) {
+				os.Stdout.Write(frame)
+				last = frame
+			}
+		}
+	}()
+}
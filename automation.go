@@ -0,0 +1,222 @@
+package gemu
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrTimeout = errors.New("timed out")
+
+// Automation drives a Machine the way a user at the keyboard would: it waits
+// for text on the LEM screen and types in response.  All waits are measured
+// in machine ticks, so runs are independent of host speed.  Keys go through
+// the machine's input queue, so automated sessions can be recorded too.
+type Automation struct {
+	Machine  *Machine
+	Keyboard *Keyboard
+	Keys     KeyInput
+	Lem      *Lem1802
+
+	// KeyDelay is the number of ticks to run after each key press.
+	KeyDelay int
+	// KeyTimeout is the number of ticks to wait for the guest to make room
+	// in the key buffer before giving up.
+	KeyTimeout int
+	// PollInterval is the number of ticks between screen checks.
+	PollInterval int
+}
+
+func NewAutomation(machine *Machine, keyboard *Keyboard, lem *Lem1802) *Automation {
+	return &Automation{
+		Machine:      machine,
+		Keyboard:     keyboard,
+		Keys:         machine.KeyInput(keyboard),
+		Lem:          lem,
+		KeyDelay:     2000,
+		KeyTimeout:   1000000,
+		PollInterval: 100,
+	}
+}
+
+func (A *Automation) Run(cycles int) {
+	A.Machine.Tick(cycles)
+}
+
+func (A *Automation) Screen() string {
+	return A.Lem.Screen().String()
+}
+
+// WaitForText runs the machine until the screen matches pattern, or until
+// timeout ticks have passed.
+func (A *Automation) WaitForText(pattern string, timeout int) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	for waited := 0; ; waited += A.PollInterval {
+		if re.MatchString(A.Screen()) {
+			return nil
+		}
+		if waited >= timeout {
+			return fmt.Errorf("waiting for %q: %v", pattern, ErrTimeout)
+		}
+		A.Run(A.PollInterval)
+	}
+}
+
+func (A *Automation) AssertText(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	if !re.MatchString(A.Screen()) {
+		return fmt.Errorf("screen does not match %q", pattern)
+	}
+	return nil
+}
+
+func (A *Automation) RefuteText(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	if re.MatchString(A.Screen()) {
+		return fmt.Errorf("screen matches %q", pattern)
+	}
+	return nil
+}
+
+// PressKey presses and releases a single key.  A press and release can take
+// up two entries of the key buffer, so it waits until the guest has consumed
+// enough keys for both to fit.
+func (A *Automation) PressKey(key uint16) error {
+	for waited := 0; A.Keyboard.Pending() > KeyBufferSize-2; waited += A.PollInterval {
+		if waited >= A.KeyTimeout {
+			return fmt.Errorf("key buffer full: %v", ErrTimeout)
+		}
+		A.Run(A.PollInterval)
+	}
+	A.Keys.RawKey(key, true)
+	if key < KEY_UP {
+		A.Keys.ParsedKey(key)
+	}
+	A.Run(A.KeyDelay / 2)
+	A.Keys.RawKey(key, false)
+	A.Run(A.KeyDelay - A.KeyDelay/2)
+	return nil
+}
+
+// Type presses the keys for each character of text.  Newlines are sent as
+// Return and backspaces as Backspace.
+func (A *Automation) Type(text string) error {
+	for _, r := range text {
+		key, ok := RuneCode(r)
+		if !ok {
+			return fmt.Errorf("cannot type %q", r)
+		}
+		if err := A.PressKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var automationKeys = map[string]uint16{
+	"backspace": KEY_BACKSPACE,
+	"return":    KEY_RETURN,
+	"enter":     KEY_RETURN,
+	"insert":    KEY_INSERT,
+	"delete":    KEY_DELETE,
+	"up":        KEY_UP,
+	"down":      KEY_DOWN,
+	"left":      KEY_LEFT,
+	"right":     KEY_RIGHT,
+	"shift":     KEY_SHIFT,
+	"control":   KEY_CONTROL,
+}
+
+func parseScriptText(arg string) (string, error) {
+	if strings.HasPrefix(arg, "\"") {
+		return strconv.Unquote(arg)
+	}
+	return arg, nil
+}
+
+// RunScript executes an automation script.  Each line holds one command:
+//
+//	wait <ticks> <regexp>   run until the screen matches
+//	type <text>             type text, Go quoted strings allow escapes
+//	press <key>             press a key by name or code
+//	assert <regexp>         fail unless the screen matches
+//	refute <regexp>         fail if the screen matches
+//	run <ticks>             run the machine
+//
+// Blank lines and lines starting with # are ignored.
+func (A *Automation) RunScript(script io.Reader) error {
+	scanner := bufio.NewScanner(script)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := A.runCommand(text); err != nil {
+			return fmt.Errorf("script line %d: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (A *Automation) runCommand(text string) error {
+	cmd, arg := text, ""
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		cmd, arg = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	switch cmd {
+	case "wait":
+		// Only the ticks are split off, so the regexp keeps its spaces.
+		fields := strings.Fields(arg)
+		if len(fields) < 2 {
+			return errors.New("usage: wait <ticks> <regexp>")
+		}
+		timeout, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return err
+		}
+		return A.WaitForText(strings.TrimSpace(strings.TrimPrefix(arg, fields[0])), timeout)
+	case "type":
+		text, err := parseScriptText(arg)
+		if err != nil {
+			return err
+		}
+		return A.Type(text)
+	case "press":
+		key, ok := automationKeys[strings.ToLower(arg)]
+		if !ok {
+			code, err := strconv.ParseUint(arg, 0, 16)
+			if err != nil {
+				return fmt.Errorf("unknown key %q", arg)
+			}
+			key = uint16(code)
+		}
+		return A.PressKey(key)
+	case "assert":
+		return A.AssertText(arg)
+	case "refute":
+		return A.RefuteText(arg)
+	case "run":
+		cycles, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		A.Run(cycles)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
@@ -0,0 +1,501 @@
+// Package bbfs reads and writes BBFS volumes, the filesystem DC-DOS keeps on
+// M35FD floppies.
+//
+// A volume is 1440 sectors of 512 words.  Sector 0 holds the boot loader,
+// and sectors 1 to 3 the filesystem header:
+//
+//	0     version, 0xBF56
+//	1-5   reserved
+//	6     free mask, 90 words with a bit set for each free sector, the
+//	      lowest bit of the first word for sector 0
+//	96    FAT, 1440 words
+//
+// The FAT entry of a sector is the next sector of its file, or 0x8000 plus
+// the number of words used in it for the last sector.  Free sectors have
+// 0xFFFF.
+//
+// Directories are files holding a version word, 0xBF56, and an entry count,
+// followed by the entries.  Each entry is 10 words: its type, 1 for a
+// directory or 2 for a file, its first sector, and a name of up to 16
+// characters packed two to a word, high byte first, padded with zeros.  The
+// root directory starts at sector 4.
+package bbfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/techcompliant/GEMU"
+)
+
+const (
+	Version       = 0xBF56
+	Sectors       = gemu.FloppySectors
+	SectorWords   = gemu.FloppySectorWords
+	RootSector    = 4
+	HeaderSectors = 3
+	MaxName       = 16
+)
+
+const (
+	TypeDirectory uint16 = 1
+	TypeFile             = 2
+)
+
+const (
+	fatFree = 0xFFFF
+	fatLast = 0x8000
+
+	headerWords   = HeaderSectors * SectorWords
+	freeMaskStart = 6
+	fatStart      = freeMaskStart + Sectors/16
+	entryWords    = 10
+)
+
+var (
+	ErrNotBBFS  = errors.New("not a BBFS volume")
+	ErrFull     = errors.New("volume is full")
+	ErrBadName  = errors.New("bad file name")
+	ErrNotDir   = errors.New("not a directory")
+	ErrIsDir    = errors.New("is a directory")
+	ErrNotEmpty = errors.New("directory is not empty")
+)
+
+// Volume is a BBFS volume in a floppy image.  Changes are written to the
+// image as they are made.
+type Volume struct {
+	storage *gemu.ImageStorage
+	image   string
+	header  []uint16
+	// swapped is set when the byte order of a raw image was guessed wrong.
+	swapped bool
+}
+
+type Entry struct {
+	Name   string
+	Type   uint16
+	Sector uint16
+	// Size is in words.
+	Size int
+}
+
+func (E Entry) IsDir() bool {
+	return E.Type == TypeDirectory
+}
+
+// Open opens the volume in image.  Images can be stored in either byte order,
+// raw images being told apart by the version word.
+func Open(storage gemu.Storage, image string) (*Volume, error) {
+	V := &Volume{storage: gemu.NewImageStorage(storage), image: image}
+	if !V.storage.Exists(image) {
+		return nil, &os.PathError{Op: "open", Path: image, Err: os.ErrNotExist}
+	}
+	if V.storage.Length(image) < Sectors*SectorWords*2 {
+		return nil, ErrNotBBFS
+	}
+	header, err := V.readWords(SectorWords, headerWords)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] == Version>>8|Version&0xFF<<8 {
+		V.swapped = true
+		header, err = V.readWords(SectorWords, headerWords)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if header[0] != Version {
+		return nil, ErrNotBBFS
+	}
+	V.header = header
+	return V, nil
+}
+
+// Detect reports whether image holds a BBFS volume.
+func Detect(storage gemu.Storage, image string) bool {
+	_, err := Open(storage, image)
+	return err == nil
+}
+
+// Format writes an empty volume to image, creating it if needed.  The boot
+// sector is left as it is.
+func Format(storage gemu.Storage, image string) (*Volume, error) {
+	V := &Volume{storage: gemu.NewImageStorage(storage), image: image}
+	if length := V.storage.Length(image); length < Sectors*SectorWords*2 {
+		if err := V.writeWords(length/2, make([]uint16, Sectors*SectorWords-length/2)); err != nil {
+			return nil, err
+		}
+	}
+	V.header = make([]uint16, headerWords)
+	V.header[0] = Version
+	for sector := 0; sector < Sectors; sector++ {
+		V.header[fatStart+sector] = fatFree
+		if sector > RootSector {
+			V.setFree(uint16(sector), true)
+		}
+	}
+	for sector := uint16(0); sector < RootSector; sector++ {
+		V.header[fatStart+int(sector)] = fatLast | SectorWords
+	}
+	V.header[fatStart+RootSector] = fatLast
+	if err := V.writeChain(RootSector, []uint16{Version, 0}); err != nil {
+		return nil, err
+	}
+	return V, nil
+}
+
+func (V *Volume) order() binary.ByteOrder {
+	if V.swapped {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func (V *Volume) readWords(offset, count int) ([]uint16, error) {
+	data := make([]byte, count*2)
+	if _, err := V.storage.ReadAt(context.Background(), V.image, data, int64(offset*2)); err != nil {
+		return nil, err
+	}
+	words := make([]uint16, count)
+	for i := range words {
+		words[i] = V.order().Uint16(data[i*2:])
+	}
+	return words, nil
+}
+
+func (V *Volume) writeWords(offset int, words []uint16) error {
+	data := make([]byte, len(words)*2)
+	for i, word := range words {
+		V.order().PutUint16(data[i*2:], word)
+	}
+	_, err := V.storage.WriteAt(context.Background(), V.image, data, int64(offset*2))
+	return err
+}
+
+func (V *Volume) fat(sector uint16) uint16 {
+	return V.header[fatStart+int(sector)]
+}
+
+func (V *Volume) free(sector uint16) bool {
+	return V.header[freeMaskStart+int(sector)/16]&(1<<(sector%16)) != 0
+}
+
+func (V *Volume) setFree(sector uint16, free bool) {
+	if free {
+		V.header[freeMaskStart+int(sector)/16] |= 1 << (sector % 16)
+		V.header[fatStart+int(sector)] = fatFree
+	} else {
+		V.header[freeMaskStart+int(sector)/16] &^= 1 << (sector % 16)
+	}
+}
+
+// Free returns the number of free sectors.
+func (V *Volume) Free() int {
+	free := 0
+	for sector := uint16(0); sector < Sectors; sector++ {
+		if V.free(sector) {
+			free++
+		}
+	}
+	return free
+}
+
+func (V *Volume) allocate() (uint16, error) {
+	for sector := uint16(0); sector < Sectors; sector++ {
+		if V.free(sector) {
+			V.setFree(sector, false)
+			return sector, nil
+		}
+	}
+	return 0, ErrFull
+}
+
+// readChain reads the file starting at sector.
+func (V *Volume) readChain(sector uint16) ([]uint16, error) {
+	var data []uint16
+	for visited := 0; visited < Sectors; visited++ {
+		next := V.fat(sector)
+		count := SectorWords
+		if next&fatLast != 0 {
+			count = int(next &^ fatLast)
+			if count > SectorWords {
+				return nil, fmt.Errorf("bad FAT entry %04x for sector %d", next, sector)
+			}
+		} else if next >= Sectors {
+			return nil, fmt.Errorf("bad FAT entry %04x for sector %d", next, sector)
+		}
+		words, err := V.readWords(int(sector)*SectorWords, count)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, words...)
+		if next&fatLast != 0 {
+			return data, nil
+		}
+		sector = next
+	}
+	return nil, errors.New("FAT chain loops")
+}
+
+// writeChain writes data as the file starting at sector, reusing the
+// sectors it already has and freeing those it no longer needs.
+func (V *Volume) writeChain(sector uint16, data []uint16) error {
+	for {
+		count := len(data)
+		if count > SectorWords {
+			count = SectorWords
+		}
+		if err := V.writeWords(int(sector)*SectorWords, data[:count]); err != nil {
+			return err
+		}
+		data = data[count:]
+		next := V.fat(sector)
+		if len(data) == 0 {
+			if next&fatLast == 0 && next < Sectors {
+				V.freeChain(next)
+			}
+			V.header[fatStart+int(sector)] = fatLast | uint16(count)
+			return V.writeHeader()
+		}
+		if next&fatLast != 0 || next >= Sectors {
+			var err error
+			if next, err = V.allocate(); err != nil {
+				V.header[fatStart+int(sector)] = fatLast | uint16(count)
+				V.writeHeader()
+				return err
+			}
+		}
+		V.header[fatStart+int(sector)] = next
+		sector = next
+	}
+}
+
+func (V *Volume) freeChain(sector uint16) {
+	for visited := 0; visited < Sectors && sector < Sectors && !V.free(sector); visited++ {
+		next := V.fat(sector)
+		V.setFree(sector, true)
+		if next&fatLast != 0 {
+			return
+		}
+		sector = next
+	}
+}
+
+func (V *Volume) writeHeader() error {
+	return V.writeWords(SectorWords, V.header)
+}
+
+func packName(name string) []uint16 {
+	words := make([]uint16, MaxName/2)
+	for i := 0; i < len(name); i++ {
+		words[i/2] |= uint16(name[i]) << (8 * uint(1-i%2))
+	}
+	return words
+}
+
+func unpackName(words []uint16) string {
+	name := []byte{}
+	for _, word := range words {
+		for _, c := range []byte{byte(word >> 8), byte(word)} {
+			if c == 0 {
+				return string(name)
+			}
+			name = append(name, c)
+		}
+	}
+	return string(name)
+}
+
+func checkName(name string) error {
+	if name == "" || len(name) > MaxName || strings.ContainsAny(name, "/\x00") {
+		return ErrBadName
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 0x20 || name[i] > 0x7e {
+			return ErrBadName
+		}
+	}
+	return nil
+}
+
+type directory struct {
+	sector  uint16
+	entries []Entry
+}
+
+func (V *Volume) readDir(sector uint16) (*directory, error) {
+	data, err := V.readChain(sector)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || data[0] != Version {
+		return nil, ErrNotDir
+	}
+	dir := &directory{sector: sector}
+	count := int(data[1])
+	for i := 0; i < count && 2+(i+1)*entryWords <= len(data); i++ {
+		raw := data[2+i*entryWords : 2+(i+1)*entryWords]
+		dir.entries = append(dir.entries, Entry{Type: raw[0], Sector: raw[1], Name: unpackName(raw[2:])})
+	}
+	return dir, nil
+}
+
+func (V *Volume) writeDir(dir *directory) error {
+	data := []uint16{Version, uint16(len(dir.entries))}
+	for _, entry := range dir.entries {
+		data = append(data, entry.Type, entry.Sector)
+		data = append(data, packName(entry.Name)...)
+	}
+	return V.writeChain(dir.sector, data)
+}
+
+func (D *directory) find(name string) int {
+	for i, entry := range D.entries {
+		if entry.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookup finds the directory holding path, and the last element of path.
+// Paths are separated by slashes and relative to the root.
+func (V *Volume) lookup(path string) (*directory, string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	dir, err := V.readDir(RootSector)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, part := range parts[:len(parts)-1] {
+		i := dir.find(part)
+		if i < 0 {
+			return nil, "", &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		if !dir.entries[i].IsDir() {
+			return nil, "", &os.PathError{Op: "open", Path: path, Err: ErrNotDir}
+		}
+		if dir, err = V.readDir(dir.entries[i].Sector); err != nil {
+			return nil, "", err
+		}
+	}
+	return dir, parts[len(parts)-1], nil
+}
+
+// List returns the entries of the directory at path, "" for the root.
+func (V *Volume) List(path string) ([]Entry, error) {
+	dir, err := V.readDir(RootSector)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Trim(path, "/") != "" {
+		parent, name, err := V.lookup(path)
+		if err != nil {
+			return nil, err
+		}
+		i := parent.find(name)
+		if i < 0 {
+			return nil, &os.PathError{Op: "list", Path: path, Err: os.ErrNotExist}
+		}
+		if !parent.entries[i].IsDir() {
+			return nil, &os.PathError{Op: "list", Path: path, Err: ErrNotDir}
+		}
+		if dir, err = V.readDir(parent.entries[i].Sector); err != nil {
+			return nil, err
+		}
+	}
+	for i := range dir.entries {
+		data, err := V.readChain(dir.entries[i].Sector)
+		if err != nil {
+			return nil, err
+		}
+		dir.entries[i].Size = len(data)
+	}
+	return dir.entries, nil
+}
+
+// Get returns the contents of the file at path.
+func (V *Volume) Get(path string) ([]uint16, error) {
+	dir, name, err := V.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	i := dir.find(name)
+	if i < 0 {
+		return nil, &os.PathError{Op: "get", Path: path, Err: os.ErrNotExist}
+	}
+	if dir.entries[i].IsDir() {
+		return nil, &os.PathError{Op: "get", Path: path, Err: ErrIsDir}
+	}
+	return V.readChain(dir.entries[i].Sector)
+}
+
+// Put writes data to the file at path, replacing it if it exists.
+func (V *Volume) Put(path string, data []uint16) error {
+	return V.create(path, TypeFile, data)
+}
+
+// Mkdir creates an empty directory at path.
+func (V *Volume) Mkdir(path string) error {
+	return V.create(path, TypeDirectory, []uint16{Version, 0})
+}
+
+func (V *Volume) create(path string, kind uint16, data []uint16) error {
+	dir, name, err := V.lookup(path)
+	if err != nil {
+		return err
+	}
+	if err := checkName(name); err != nil {
+		return &os.PathError{Op: "put", Path: path, Err: err}
+	}
+	i := dir.find(name)
+	if i >= 0 {
+		if kind == TypeDirectory || dir.entries[i].IsDir() {
+			return &os.PathError{Op: "put", Path: path, Err: os.ErrExist}
+		}
+		return V.writeChain(dir.entries[i].Sector, data)
+	}
+	sector, err := V.allocate()
+	if err != nil {
+		return err
+	}
+	V.header[fatStart+int(sector)] = fatLast
+	if err := V.writeChain(sector, data); err != nil {
+		V.freeChain(sector)
+		V.writeHeader()
+		return err
+	}
+	dir.entries = append(dir.entries, Entry{Name: name, Type: kind, Sector: sector})
+	return V.writeDir(dir)
+}
+
+// Delete removes the file or empty directory at path.
+func (V *Volume) Delete(path string) error {
+	dir, name, err := V.lookup(path)
+	if err != nil {
+		return err
+	}
+	i := dir.find(name)
+	if i < 0 {
+		return &os.PathError{Op: "delete", Path: path, Err: os.ErrNotExist}
+	}
+	entry := dir.entries[i]
+	if entry.IsDir() {
+		sub, err := V.readDir(entry.Sector)
+		if err != nil {
+			return err
+		}
+		if len(sub.entries) > 0 {
+			return &os.PathError{Op: "delete", Path: path, Err: ErrNotEmpty}
+		}
+	}
+	dir.entries = append(dir.entries[:i], dir.entries[i+1:]...)
+	if err := V.writeDir(dir); err != nil {
+		return err
+	}
+	V.freeChain(entry.Sector)
+	return V.writeHeader()
+}
@@ -0,0 +1,171 @@
+package bbfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/techcompliant/GEMU"
+)
+
+func newTestVolume(t *testing.T) (*gemu.MemStorage, *Volume) {
+	storage := gemu.NewMemStorage()
+	volume, err := Format(storage, "disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, volume
+}
+
+func words(n int) []uint16 {
+	data := make([]uint16, n)
+	for i := range data {
+		data[i] = uint16(i * 7)
+	}
+	return data
+}
+
+func equalWords(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFormat(t *testing.T) {
+	storage, volume := newTestVolume(t)
+	if length := storage.Length("disk.img"); length != Sectors*SectorWords*2 {
+		t.Errorf("image is %d bytes, want a whole floppy", length)
+	}
+	if !Detect(storage, "disk.img") || Detect(storage, "missing.img") {
+		t.Error("Detect does not tell formatted images from missing ones")
+	}
+	// The boot sector, header and root directory are in use.
+	if free := volume.Free(); free != Sectors-RootSector-1 {
+		t.Errorf("%d sectors free, want %d", free, Sectors-RootSector-1)
+	}
+	if entries, err := volume.List(""); err != nil || len(entries) != 0 {
+		t.Errorf("List of a new volume = %v, %v", entries, err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	storage, volume := newTestVolume(t)
+	files := map[string][]uint16{
+		"empty":    {},
+		"one":      {0x1234},
+		"sector":   words(SectorWords),
+		"big.bin":  words(3*SectorWords + 5),
+		"dir/file": words(20),
+	}
+	if err := volume.Mkdir("dir"); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := volume.Put(name, data); err != nil {
+			t.Fatalf("Put(%q): %v", name, err)
+		}
+	}
+
+	reopened, err := Open(storage, "disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		got, err := reopened.Get(name)
+		if err != nil || !equalWords(got, data) {
+			t.Errorf("Get(%q) = %d words, %v, want %d words", name, len(got), err, len(data))
+		}
+	}
+	entries, err := reopened.List("dir")
+	if err != nil || len(entries) != 1 || entries[0].Name != "file" || entries[0].Size != 20 {
+		t.Errorf("List(dir) = %v, %v", entries, err)
+	}
+}
+
+func TestStoredBigEndian(t *testing.T) {
+	storage, volume := newTestVolume(t)
+	if err := volume.Put("x", []uint16{0x1234}); err != nil {
+		t.Fatal(err)
+	}
+	raw := make([]byte, 2)
+	storage.Read("disk.img", SectorWords*2, raw)
+	if raw[0] != Version>>8 || raw[1] != Version&0xFF {
+		t.Errorf("header starts % x, want a big endian version", raw)
+	}
+	reopened, err := Open(storage, "disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reopened.Get("x"); err != nil || len(got) != 1 || got[0] != 0x1234 {
+		t.Errorf("Get(x) = %x, %v", got, err)
+	}
+}
+
+func TestReplaceAndDelete(t *testing.T) {
+	_, volume := newTestVolume(t)
+	free := volume.Free()
+	if err := volume.Put("a", words(4*SectorWords)); err != nil {
+		t.Fatal(err)
+	}
+	if err := volume.Put("a", []uint16{9}); err != nil {
+		t.Fatal(err)
+	}
+	if got := volume.Free(); got != free-1 {
+		t.Errorf("%d sectors free after shrinking a file, want %d", got, free-1)
+	}
+	if got, _ := volume.Get("a"); !equalWords(got, []uint16{9}) {
+		t.Errorf("Get(a) = %v after replacing it", got)
+	}
+
+	volume.Mkdir("d")
+	volume.Put("d/x", []uint16{1})
+	if err := volume.Delete("d"); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("deleting a full directory: %v, want ErrNotEmpty", err)
+	}
+	for _, name := range []string{"d/x", "d", "a"} {
+		if err := volume.Delete(name); err != nil {
+			t.Fatalf("Delete(%q): %v", name, err)
+		}
+	}
+	if got := volume.Free(); got != free {
+		t.Errorf("%d sectors free after deleting everything, want %d", got, free)
+	}
+	if _, err := volume.Get("a"); !os.IsNotExist(err) {
+		t.Errorf("Get of a deleted file: %v", err)
+	}
+}
+
+func TestDirectoryGrows(t *testing.T) {
+	storage, volume := newTestVolume(t)
+	// More entries than fit in one sector.
+	count := SectorWords/entryWords + 10
+	for i := 0; i < count; i++ {
+		if err := volume.Put(fmt.Sprintf("file%d", i), []uint16{uint16(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopened, _ := Open(storage, "disk.img")
+	entries, err := reopened.List("")
+	if err != nil || len(entries) != count {
+		t.Fatalf("listed %d entries, %v, want %d", len(entries), err, count)
+	}
+	if got, _ := reopened.Get(fmt.Sprintf("file%d", count-1)); !equalWords(got, []uint16{uint16(count - 1)}) {
+		t.Errorf("last file reads %v", got)
+	}
+}
+
+func TestBadNames(t *testing.T) {
+	_, volume := newTestVolume(t)
+	for _, name := range []string{"", "seventeen-chars-x", "missing/file"} {
+		if err := volume.Put(name, []uint16{1}); err == nil {
+			t.Errorf("Put(%q) succeeded", name)
+		}
+	}
+}
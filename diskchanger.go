@@ -0,0 +1,174 @@
+package gemu
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DiskDrive is a device with removable media.
+type DiskDrive interface {
+	IHardware
+	ChangeDisk(disk string)
+	SetWriteProtect(protect bool)
+	// CurrentDisk returns the disk in the drive, or "" if it is empty.  It
+	// is safe to call from any goroutine.
+	CurrentDisk() string
+}
+
+// DiskChanger swaps the disks in a machine's M35FD drives while it runs.
+// Changes go through the machine's input queue, so they are recorded and
+// raise the drives' state change interrupts from the tick loop.
+type DiskChanger struct {
+	Machine *Machine
+	Drives  []*M35FD
+	Storage Storage
+}
+
+// DriveStatus describes one drive for frontends.
+type DriveStatus struct {
+	Drive          int    `json:"drive"`
+	Disk           string `json:"disk"`
+	WriteProtected bool   `json:"writeProtected"`
+	State          uint16 `json:"state"`
+}
+
+// NewDiskChanger finds the drives attached to machine.  Blank disks are
+// created in the default storage.
+func NewDiskChanger(machine *Machine) *DiskChanger {
+	changer := &DiskChanger{Machine: machine, Storage: defaultStorage}
+	for _, dev := range machine.CPU.Down {
+		if fd, ok := dev.(*M35FD); ok {
+			changer.Drives = append(changer.Drives, fd)
+		}
+	}
+	return changer
+}
+
+func (C *DiskChanger) drive(drive int) (*M35FD, error) {
+	if drive < 0 || drive >= len(C.Drives) {
+		return nil, fmt.Errorf("no drive %d", drive)
+	}
+	return C.Drives[drive], nil
+}
+
+// Status describes every drive.  It is safe to call while the machine runs.
+func (C *DiskChanger) Status() []DriveStatus {
+	status := make([]DriveStatus, len(C.Drives))
+	for i, fd := range C.Drives {
+		status[i] = fd.Status()
+		status[i].Drive = i
+	}
+	return status
+}
+
+func (C *DiskChanger) Eject(drive int) error {
+	fd, err := C.drive(drive)
+	if err != nil {
+		return err
+	}
+	C.Machine.ChangeDisk(fd, "")
+	return nil
+}
+
+// Insert puts image into drive, ejecting the disk already in it first.
+func (C *DiskChanger) Insert(drive int, image string) error {
+	fd, err := C.drive(drive)
+	if err != nil {
+		return err
+	}
+	if !C.Storage.Exists(image) {
+		return fmt.Errorf("disk image %s does not exist", image)
+	}
+	C.Machine.ChangeDisk(fd, image)
+	return nil
+}
+
+// Swap exchanges the disks in two drives.
+func (C *DiskChanger) Swap(a, b int) error {
+	fda, err := C.drive(a)
+	if err != nil {
+		return err
+	}
+	fdb, err := C.drive(b)
+	if err != nil {
+		return err
+	}
+	C.Machine.SwapDisks(fda, fdb)
+	return nil
+}
+
+func (C *DiskChanger) SetWriteProtect(drive int, protect bool) error {
+	fd, err := C.drive(drive)
+	if err != nil {
+		return err
+	}
+	C.Machine.WriteProtect(fd, protect)
+	return nil
+}
+
+// CreateBlank creates a formatted disk image of zeroed sectors.  It will not
+// overwrite an existing image.
+func (C *DiskChanger) CreateBlank(image string) error {
+	if C.Storage.Exists(image) {
+		return fmt.Errorf("disk image %s already exists", image)
+	}
+	_, err := AsStorageV2(C.Storage).WriteAt(context.Background(), image, make([]byte, FloppySectors*FloppySectorBytes), 0)
+	if err != nil {
+		return fmt.Errorf("creating disk image %s: %v", image, err)
+	}
+	return nil
+}
+
+// DiskImageExtensions are the names Images takes to be disk images, along
+// with anything that has an image header.
+var DiskImageExtensions = []string{".img", ".dsk", ".bin"}
+
+// isImage reports whether item looks like a disk image rather than some other
+// file that happens to be in the storage.
+func (C *DiskChanger) isImage(item string) bool {
+	ext := strings.ToLower(path.Ext(item))
+	for _, known := range DiskImageExtensions {
+		if ext == known {
+			return true
+		}
+	}
+	_, err := ReadImageHeader(C.Storage, item)
+	return err == nil
+}
+
+// Images lists the disk images in the storage whose names start with prefix.
+func (C *DiskChanger) Images(prefix string) ([]ItemInfo, error) {
+	items, err := ListItems(C.Storage, prefix)
+	if err != nil {
+		return nil, err
+	}
+	images := []ItemInfo{}
+	for _, item := range items {
+		if C.isImage(item.Name) {
+			images = append(images, item)
+		}
+	}
+	return images, nil
+}
+
+// Delete removes an image, refusing while it is in a drive.  Only items that
+// Images lists can be deleted.
+func (C *DiskChanger) Delete(image string) error {
+	if _, err := StatItem(C.Storage, image); err != nil || !C.isImage(image) {
+		return fmt.Errorf("disk image %s does not exist", image)
+	}
+	for i, fd := range C.Drives {
+		if fd.CurrentDisk() == image {
+			return fmt.Errorf("disk image %s is in drive %d", image, i)
+		}
+	}
+	if err := DeleteItem(C.Storage, image); err != nil {
+		return err
+	}
+	if C.Storage.Exists(image + ImageOrderSuffix) {
+		DeleteItem(C.Storage, image+ImageOrderSuffix)
+	}
+	return nil
+}
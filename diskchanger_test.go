@@ -0,0 +1,135 @@
+package gemu
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newTestChanger() (*Machine, *DiskChanger) {
+	storage := NewMemStorageFrom(map[string][]byte{"a.img": {}, "b.img": {}})
+	machine := NewMachine(NewDCPU(0))
+	for i := 0; i < 2; i++ {
+		fd := NewM35FD()
+		fd.storage = NewImageStorage(storage)
+		machine.Attach(fd)
+	}
+	changer := NewDiskChanger(machine)
+	changer.Storage = storage
+	return machine, changer
+}
+
+func TestDiskChangerStatus(t *testing.T) {
+	machine, changer := newTestChanger()
+	changer.Insert(0, "a.img")
+	changer.Insert(1, "b.img")
+	changer.SetWriteProtect(1, true)
+	changer.Swap(0, 1)
+	machine.Tick(1)
+	want := []DriveStatus{
+		{Drive: 0, Disk: "b.img", State: FD_STATE_READY},
+		{Drive: 1, Disk: "a.img", State: FD_STATE_READY},
+	}
+	for i, status := range changer.Status() {
+		if status != want[i] {
+			t.Errorf("drive %d: %+v, want %+v", i, status, want[i])
+		}
+	}
+	changer.SetWriteProtect(0, true)
+	changer.Eject(1)
+	machine.Tick(1)
+	want = []DriveStatus{
+		{Drive: 0, Disk: "b.img", WriteProtected: true, State: FD_STATE_READY_WP},
+		{Drive: 1, State: FD_STATE_NO_MEDIA},
+	}
+	for i, status := range changer.Status() {
+		if status != want[i] {
+			t.Errorf("drive %d: %+v, want %+v", i, status, want[i])
+		}
+	}
+	if err := changer.Insert(2, "a.img"); err == nil {
+		t.Error("inserted into a missing drive")
+	}
+	if err := changer.Insert(0, "missing.img"); err == nil {
+		t.Error("inserted a missing image")
+	}
+}
+
+// TestDiskChangerConcurrent is meant for go test -race.
+func TestDiskChangerConcurrent(t *testing.T) {
+	machine, changer := newTestChanger()
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				machine.Tick(100)
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		switch i % 4 {
+		case 0:
+			changer.Insert(0, "a.img")
+		case 1:
+			changer.Swap(0, 1)
+		case 2:
+			changer.SetWriteProtect(1, i%8 == 2)
+		case 3:
+			changer.Eject(i % 2)
+		}
+		for _, status := range changer.Status() {
+			if status.Disk == "" && status.State != FD_STATE_NO_MEDIA {
+				t.Fatalf("%+v is empty but has media", status)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestDiskChangerImages(t *testing.T) {
+	machine, changer := newTestChanger()
+	storage := changer.Storage.(*MemStorage)
+	WriteImage(storage, "headed", ImageHeader{Media: ImageMediaFloppy}, false, make([]byte, 4))
+	for _, item := range []string{"c.DSK", "notes.txt", "c.DSK.cow", "ee.wear"} {
+		storage.Load(item, []byte{1, 2})
+	}
+	images, err := changer.Images("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, image := range images {
+		names = append(names, image.Name)
+	}
+	if want := "[a.img b.img c.DSK headed]"; fmt.Sprint(names) != want {
+		t.Errorf("listed %v, want %s", names, want)
+	}
+
+	changer.Insert(0, "a.img")
+	machine.Tick(1)
+	for _, test := range []struct {
+		image string
+		ok    bool
+	}{
+		{"notes.txt", false},
+		{"c.DSK.cow", false},
+		{"missing.img", false},
+		{"a.img", false},
+		{"b.img", true},
+		{"headed", true},
+	} {
+		if err := changer.Delete(test.image); (err == nil) != test.ok {
+			t.Errorf("deleting %s: %v", test.image, err)
+		}
+	}
+	if !storage.Exists("notes.txt") || storage.Exists("b.img") {
+		t.Error("deleted the wrong items")
+	}
+}
@@ -0,0 +1,128 @@
+package gemu
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	DisplayWidth  = 128
+	DisplayHeight = 96
+)
+
+// Display is implemented by the screen devices so frontends can draw them
+// without knowing how their memory is laid out.
+type Display interface {
+	Render() *image.RGBA
+	BorderColor() color.RGBA
+}
+
+func LemColor(c uint16) color.RGBA {
+	return color.RGBA{
+		R: uint8((c >> 8 & 0x0f) * 0x11),
+		G: uint8((c >> 4 & 0x0f) * 0x11),
+		B: uint8((c >> 0 & 0x0f) * 0x11),
+		A: 0xff,
+	}
+}
+
+func displayPalette(mem IMem, palMem uint16) [16]color.RGBA {
+	pal := [16]color.RGBA{}
+	for i := range pal {
+		c := LemDefPal[i]
+		if mem != nil && palMem != 0 {
+			c = mem.GetRaw()[(int(palMem)+i)&0xFFFF]
+		}
+		pal[i] = LemColor(c)
+	}
+	return pal
+}
+
+func renderText(img *image.RGBA, mem IMem, dspMem uint16, fontMem uint16, pal [16]color.RGBA) {
+	if mem == nil || dspMem == 0 {
+		return
+	}
+	ram := mem.GetRaw()
+	font := func(i int) uint16 {
+		if fontMem == 0 {
+			return LemDefFont[i]
+		}
+		return ram[(int(fontMem)+i)&0xFFFF]
+	}
+	for i := 0; i < LemWidth*LemHeight; i++ {
+		vtw := ram[(int(dspMem)+i)&0xFFFF]
+		fg, bg := pal[(vtw>>12)&0x0f], pal[(vtw>>8)&0x0f]
+		glyph := [2]uint16{font(int(vtw&0x7f) * 2), font(int(vtw&0x7f)*2 + 1)}
+		drawGlyph(img, (i%LemWidth)*4, (i/LemWidth)*8, glyph, fg, bg)
+	}
+}
+
+func drawGlyph(img *image.RGBA, cx, cy int, glyph [2]uint16, fg, bg color.RGBA) {
+	for x := 0; x < 4; x++ {
+		column := glyph[x/2] >> 8
+		if x%2 == 1 {
+			column = glyph[x/2] & 0xff
+		}
+		for y := 0; y < 8; y++ {
+			if column&(1<<uint(y)) != 0 {
+				img.SetRGBA(cx+x, cy+y, fg)
+			} else {
+				img.SetRGBA(cx+x, cy+y, bg)
+			}
+		}
+	}
+}
+
+// DrawText draws text in the default LEM font with its top left corner at
+// x, y, for frontends that overlay their own messages.
+func DrawText(img *image.RGBA, x, y int, text string, fg, bg color.RGBA) {
+	for i := 0; i < len(text); i++ {
+		c := int(text[i])
+		if c >= 0x80 {
+			c = LemUnknownChar
+		}
+		drawGlyph(img, x+i*4, y, [2]uint16{LemDefFont[c*2], LemDefFont[c*2+1]}, fg, bg)
+	}
+}
+
+func (L *Lem1802) Render() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, DisplayWidth, DisplayHeight))
+	renderText(img, L.GetMem(), L.DspMem, L.FontMem, displayPalette(L.GetMem(), L.PalMem))
+	return img
+}
+
+func (L *Lem1802) BorderColor() color.RGBA {
+	return displayPalette(L.GetMem(), L.PalMem)[L.Border&0xf]
+}
+
+// Render draws the PIXIE display.  Mode 0 is LEM compatible text, modes 1 to
+// 4 are 128x96 bitmaps with that many bits per pixel, packed row by row as a
+// continuous bit stream starting at the least significant bit of each word.
+func (P *PIXIE) Render() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, DisplayWidth, DisplayHeight))
+	mem := P.GetMem()
+	pal := displayPalette(mem, P.PalMem)
+	if P.Mode < 1 || P.Mode > 4 {
+		renderText(img, mem, P.DspMem, P.FontMem, pal)
+		return img
+	}
+	if mem == nil || P.DspMem == 0 {
+		return img
+	}
+	ram := mem.GetRaw()
+	bpp := int(P.Mode)
+	for y := 0; y < DisplayHeight; y++ {
+		for x := 0; x < DisplayWidth; x++ {
+			bit := (y*DisplayWidth + x) * bpp
+			addr := int(P.DspMem) + bit/16
+			bits := uint32(ram[addr&0xFFFF]) | uint32(ram[(addr+1)&0xFFFF])<<16
+			index := bits >> uint(bit%16) & (1<<uint(bpp) - 1)
+			img.SetRGBA(x, y, pal[index])
+		}
+	}
+	return img
+}
+
+func (P *PIXIE) BorderColor() color.RGBA {
+	return displayPalette(P.GetMem(), P.PalMem)[P.Border&0xf]
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/techcompliant/GEMU/bbfs"
+)
+
+var transferText *bool
+
+func transferFlags(flags *flag.FlagSet) {
+	transferText = flags.Bool("text", false, "Store one character per word instead of packing two bytes to a word")
+}
+
+func openVolume(image string) *bbfs.Volume {
+	volume, err := bbfs.Open(storage, image)
+	if err != nil {
+		log.Fatalf("%s: %v", image, err)
+	}
+	return volume
+}
+
+func bbfsFormat(flags *flag.FlagSet, args []string) {
+	if _, err := bbfs.Format(storage, args[0]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func bbfsList(flags *flag.FlagSet, args []string) {
+	volume := openVolume(args[0])
+	dir := ""
+	if len(args) > 1 {
+		dir = args[1]
+	}
+	entries, err := volume.List(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			fmt.Printf("%-16s  <dir>\n", entry.Name)
+		} else {
+			fmt.Printf("%-16s  %6d words\n", entry.Name, entry.Size)
+		}
+	}
+	fmt.Printf("%d sectors free\n", volume.Free())
+}
+
+// Host files are packed two bytes to a word, big endian, with a zero byte
+// added to odd lengths, or with -text one byte to a word.
+func toWords(data []byte) []uint16 {
+	if *transferText {
+		words := make([]uint16, len(data))
+		for i, b := range data {
+			words[i] = uint16(b)
+		}
+		return words
+	}
+	words := make([]uint16, (len(data)+1)/2)
+	for i, b := range data {
+		words[i/2] |= uint16(b) << (8 * uint(1-i%2))
+	}
+	return words
+}
+
+func fromWords(words []uint16) []byte {
+	if *transferText {
+		data := make([]byte, len(words))
+		for i, word := range words {
+			data[i] = byte(word)
+		}
+		return data
+	}
+	data := make([]byte, len(words)*2)
+	for i, word := range words {
+		data[i*2], data[i*2+1] = byte(word>>8), byte(word)
+	}
+	return data
+}
+
+func bbfsPut(flags *flag.FlagSet, args []string) {
+	volume := openVolume(args[0])
+	name := filepath.Base(args[1])
+	if len(args) > 2 {
+		name = args[2]
+	}
+	data, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := volume.Put(name, toWords(data)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func bbfsGet(flags *flag.FlagSet, args []string) {
+	volume := openVolume(args[0])
+	file := filepath.Base(args[1])
+	if len(args) > 2 {
+		file = args[2]
+	}
+	words, err := volume.Get(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, fromWords(words), 0666); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func bbfsDelete(flags *flag.FlagSet, args []string) {
+	if err := openVolume(args[0]).Delete(args[1]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func bbfsMkdir(flags *flag.FlagSet, args []string) {
+	if err := openVolume(args[0]).Mkdir(args[1]); err != nil {
+		log.Fatal(err)
+	}
+}
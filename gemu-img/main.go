@@ -0,0 +1,350 @@
+// gemu-img creates, converts and inspects GEMU disk and ROM images.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/techcompliant/GEMU"
+	"github.com/techcompliant/GEMU/bbfs"
+)
+
+type command struct {
+	name  string
+	args  string
+	desc  string
+	run   func(flags *flag.FlagSet, args []string)
+	flags func(flags *flag.FlagSet)
+}
+
+var commands []*command
+
+// nargs counts the arguments cmd takes, those in brackets being optional.
+func (cmd *command) nargs() (min, max int) {
+	for _, arg := range strings.Fields(cmd.args) {
+		if !strings.HasPrefix(arg, "[") {
+			min++
+		}
+		max++
+	}
+	return min, max
+}
+
+func init() {
+	commands = []*command{
+		{name: "create", args: "image", desc: "create a blank image", run: create, flags: createFlags},
+		{name: "convert", args: "src dst", desc: "convert an image to another byte order or form", run: convert, flags: convertFlags},
+		{name: "info", args: "image", desc: "describe an image", run: info},
+		{name: "checksum", args: "image", desc: "print the CRC-32 of an image's contents", run: checksum},
+		{name: "diff", args: "a b", desc: "list the sectors that differ between two images", run: diff, flags: diffFlags},
+		{name: "format", args: "image", desc: "write an empty BBFS filesystem to a floppy image", run: bbfsFormat},
+		{name: "ls", args: "image [dir]", desc: "list a directory on a BBFS floppy", run: bbfsList},
+		{name: "put", args: "image file [name]", desc: "copy a file onto a BBFS floppy", run: bbfsPut, flags: transferFlags},
+		{name: "get", args: "image name [file]", desc: "copy a file off a BBFS floppy", run: bbfsGet, flags: transferFlags},
+		{name: "rm", args: "image name", desc: "delete a file or empty directory from a BBFS floppy", run: bbfsDelete},
+		{name: "mkdir", args: "image dir", desc: "make a directory on a BBFS floppy", run: bbfsMkdir},
+	}
+}
+
+// Images are named as paths, relative to the current directory or absolute.
+var storage = gemu.NewDiskStorage("")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gemu-img command [options] args")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %-18s %s\n", cmd.name, cmd.args, cmd.desc)
+	}
+	fmt.Fprintln(os.Stderr, "Run gemu-img command -h for its options.")
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("gemu-img: ")
+	if len(os.Args) < 2 || !run(os.Args[1], os.Args[2:]) {
+		usage()
+	}
+}
+
+// run runs the command called name with args, reporting whether there is
+// such a command.
+func run(name string, args []string) bool {
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		flags := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+		flags.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: gemu-img %s [options] %s\n", cmd.name, cmd.args)
+			flags.PrintDefaults()
+		}
+		if cmd.flags != nil {
+			cmd.flags(flags)
+		}
+		flags.Parse(args)
+		if min, max := cmd.nargs(); flags.NArg() < min || flags.NArg() > max {
+			flags.Usage()
+			os.Exit(2)
+		}
+		cmd.run(flags, flags.Args())
+		return true
+	}
+	return false
+}
+
+var (
+	createMedia    *string
+	createGeometry *string
+	createForm     *imageForm
+	convertForm    *imageForm
+	diffSector     *int
+)
+
+// imageForm holds the options for how an image is written.
+type imageForm struct {
+	raw            *bool
+	little         *bool
+	writeProtected *bool
+}
+
+func formFlags(flags *flag.FlagSet) *imageForm {
+	return &imageForm{
+		raw:            flags.Bool("raw", false, "Write just the data, without a header"),
+		little:         flags.Bool("little", false, "Store words little endian instead of big endian"),
+		writeProtected: flags.Bool("wp", false, "Mark the image write protected in its header"),
+	}
+}
+
+func createFlags(flags *flag.FlagSet) {
+	createMedia = flags.String("media", "floppy", "Media to create, floppy or harddisk")
+	createGeometry = flags.String("geometry", "80x2x9", "Hard disk geometry as cylinders x heads x sectors per track")
+	createForm = formFlags(flags)
+}
+
+func convertFlags(flags *flag.FlagSet) {
+	convertForm = formFlags(flags)
+}
+
+func diffFlags(flags *flag.FlagSet) {
+	diffSector = flags.Int("sector", 0, "Sector size in words (from the header, or 512)")
+}
+
+func parseGeometry(text string) (gemu.DiskGeometry, error) {
+	geometry := gemu.DiskGeometry{SectorWords: 512}
+	_, err := fmt.Sscanf(text, "%dx%dx%d", &geometry.Cylinders, &geometry.Heads, &geometry.SectorsPerTrack)
+	if err != nil || geometry.Cylinders*geometry.Heads*geometry.SectorsPerTrack <= 0 {
+		return geometry, fmt.Errorf("bad geometry %s", text)
+	}
+	return geometry, nil
+}
+
+func create(flags *flag.FlagSet, args []string) {
+	if storage.Exists(args[0]) {
+		log.Fatalf("%s already exists", args[0])
+	}
+	header := gemu.ImageHeader{
+		LittleEndian:   *createForm.little,
+		WriteProtected: *createForm.writeProtected,
+	}
+	switch *createMedia {
+	case "floppy":
+		header.Media = gemu.ImageMediaFloppy
+		header.Geometry = gemu.DiskGeometry{
+			Cylinders:       gemu.FloppyTracks,
+			Heads:           1,
+			SectorsPerTrack: gemu.FloppySectorsPerTrack,
+			SectorWords:     gemu.FloppySectorWords,
+		}
+	case "harddisk":
+		geometry, err := parseGeometry(*createGeometry)
+		if err != nil {
+			log.Fatal(err)
+		}
+		header.Media = gemu.ImageMediaHardDisk
+		header.Geometry = geometry
+	default:
+		log.Fatalf("unknown media %s", *createMedia)
+	}
+	data := make([]byte, header.Geometry.Sectors()*header.Geometry.SectorBytes())
+	if err := gemu.WriteImage(storage, args[0], header, *createForm.raw, data); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func convert(flags *flag.FlagSet, args []string) {
+	header := gemu.ImageHeader{
+		LittleEndian:   *convertForm.little,
+		WriteProtected: *convertForm.writeProtected,
+	}
+	// Keep what the source's header says about the media.
+	if old := gemu.NewImageStorage(storage).Header(args[0]); old != nil {
+		header.Media, header.Geometry = old.Media, old.Geometry
+	}
+	if err := gemu.ConvertImage(storage, args[0], storage, args[1], header, *convertForm.raw); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// load returns the contents of an image as words, along with what is known
+// about how it is stored.
+func load(item string) ([]uint16, *gemu.ImageStorage) {
+	images := gemu.NewImageStorage(storage)
+	if !images.Exists(item) {
+		log.Fatalf("%s does not exist", item)
+	}
+	data := make([]byte, images.Length(item))
+	if err := images.Load(item, data); err != nil {
+		log.Fatal(err)
+	}
+	words := make([]uint16, len(data)/2)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	return words, images
+}
+
+// sectorWords is the sector size of an image, from its header or by default
+// the 512 words of floppies and the HMU1440.
+func sectorWords(images *gemu.ImageStorage, item string) int {
+	if header := images.Header(item); header != nil && header.Geometry.SectorWords > 0 {
+		return header.Geometry.SectorWords
+	}
+	return gemu.FloppySectorWords
+}
+
+func sectorUsed(sector []uint16) bool {
+	for _, word := range sector {
+		if word != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func sectors(words []uint16, size int) [][]uint16 {
+	var sectors [][]uint16
+	for start := 0; start < len(words); start += size {
+		end := start + size
+		if end > len(words) {
+			end = len(words)
+		}
+		sectors = append(sectors, words[start:end])
+	}
+	return sectors
+}
+
+// wordsChecksum is the CRC-32 of words stored big endian, as ROM checksums
+// are, so it does not depend on how the image is stored.
+func wordsChecksum(words []uint16) uint32 {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, words)
+	return crc32.ChecksumIEEE(buf.Bytes())
+}
+
+// filesystem names the filesystem on an image, if it can tell.
+func filesystem(item string, words []uint16) string {
+	if bbfs.Detect(storage, item) {
+		return "BBFS"
+	}
+	for _, word := range words {
+		if word != 0 {
+			return "unknown"
+		}
+	}
+	return "none (blank)"
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func info(flags *flag.FlagSet, args []string) {
+	words, images := load(args[0])
+	header := images.Header(args[0])
+	order := "big endian"
+	if !images.BigEndian(args[0]) {
+		order = "little endian"
+	}
+	fmt.Printf("image:           %s\n", args[0])
+	if header == nil {
+		fmt.Printf("format:          raw\n")
+		fmt.Printf("byte order:      %s (guessed)\n", order)
+		if len(words) == gemu.FloppySectors*gemu.FloppySectorWords {
+			fmt.Printf("media:           floppy (by size)\n")
+		}
+	} else {
+		fmt.Printf("format:          header\n")
+		fmt.Printf("byte order:      %s\n", order)
+		fmt.Printf("media:           %s\n", header.Media)
+		if g := header.Geometry; g.Sectors() > 0 {
+			fmt.Printf("geometry:        %dx%dx%d, %d word sectors\n", g.Cylinders, g.Heads, g.SectorsPerTrack, g.SectorWords)
+		}
+		fmt.Printf("write protected: %s\n", yesNo(header.WriteProtected))
+		fmt.Printf("checksummed:     %s\n", yesNo(header.Checksummed))
+	}
+	size := sectorWords(images, args[0])
+	all := sectors(words, size)
+	used := 0
+	for _, sector := range all {
+		if sectorUsed(sector) {
+			used++
+		}
+	}
+	fmt.Printf("size:            %d words, %d sectors of %d words\n", len(words), len(all), size)
+	fmt.Printf("sectors used:    %d\n", used)
+	fmt.Printf("filesystem:      %s\n", filesystem(args[0], words))
+}
+
+func checksum(flags *flag.FlagSet, args []string) {
+	words, _ := load(args[0])
+	fmt.Printf("%08x  %s\n", wordsChecksum(words), args[0])
+}
+
+func diff(flags *flag.FlagSet, args []string) {
+	a, images := load(args[0])
+	b, _ := load(args[1])
+	size := *diffSector
+	if size <= 0 {
+		size = sectorWords(images, args[0])
+	}
+	as, bs := sectors(a, size), sectors(b, size)
+	differ := 0
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		switch {
+		case i >= len(as):
+			fmt.Printf("sector %d only in %s\n", i, args[1])
+		case i >= len(bs):
+			fmt.Printf("sector %d only in %s\n", i, args[0])
+		case !equalWords(as[i], bs[i]):
+			fmt.Printf("sector %d differs\n", i)
+		default:
+			continue
+		}
+		differ++
+	}
+	if differ > 0 {
+		fmt.Printf("%d sectors differ\n", differ)
+		os.Exit(1)
+	}
+}
+
+func equalWords(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
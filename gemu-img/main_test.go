@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/techcompliant/GEMU"
+)
+
+// program is some DCPU code: SET A, 0x30; HWI 0; "Hi"; SET PC, 0.
+var program = []uint16{0x7c01, 0x0030, 0x8640, 0x0048, 0x0069, 0x7f81, 0x0000}
+
+func programBytes(order binary.ByteOrder) []byte {
+	data := make([]byte, 2*len(program))
+	for i, word := range program {
+		order.PutUint16(data[2*i:], word)
+	}
+	return data
+}
+
+func gemuImg(t *testing.T, name string, args ...string) {
+	if !run(name, args) {
+		t.Fatalf("no %s command", name)
+	}
+}
+
+func readHeader(t *testing.T, image string) *gemu.ImageHeader {
+	header, err := gemu.ReadImageHeader(storage, image)
+	if err != nil {
+		t.Fatalf("%s: %v", image, err)
+	}
+	return header
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemu-img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := func(name string) string { return filepath.Join(dir, name) }
+
+	for _, test := range []struct {
+		name   string
+		stored []byte
+	}{
+		{"big", programBytes(binary.BigEndian)},
+		{"little", programBytes(binary.LittleEndian)},
+	} {
+		if err := ioutil.WriteFile(image(test.name), test.stored, 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, form := range [][]string{
+			{},
+			{"-little"},
+			{"-raw"},
+			{"-raw", "-little"},
+		} {
+			converted := image(test.name + ".converted")
+			gemuImg(t, "convert", append(form, image(test.name), converted)...)
+			words, _ := load(converted)
+			if !equalWords(words, program) {
+				t.Errorf("%s %v: converted to %x", test.name, form, words)
+			}
+
+			// Converting back to the original form gives the same bytes.
+			back := []string{"-raw"}
+			if test.name == "little" {
+				back = append(back, "-little")
+			}
+			gemuImg(t, "convert", append(back, converted, image(test.name+".back"))...)
+			if data, _ := ioutil.ReadFile(image(test.name + ".back")); !bytes.Equal(data, test.stored) {
+				t.Errorf("%s %v: round trip gave % x, want % x", test.name, form, data, test.stored)
+			}
+		}
+	}
+
+	// Converting keeps the media and geometry, and replaces a longer image.
+	gemuImg(t, "create", "-media", "harddisk", "-geometry", "2x1x1", image("disk"))
+	if err := ioutil.WriteFile(image("long"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gemuImg(t, "convert", "-little", "-wp", image("disk"), image("long"))
+	header := readHeader(t, image("long"))
+	want := gemu.ImageHeader{
+		Media:          gemu.ImageMediaHardDisk,
+		LittleEndian:   true,
+		WriteProtected: true,
+		Geometry:       gemu.DiskGeometry{Cylinders: 2, Heads: 1, SectorsPerTrack: 1, SectorWords: 512},
+		Checksummed:    true,
+		Checksum:       header.Checksum,
+	}
+	if *header != want {
+		t.Errorf("converted header %+v, want %+v", *header, want)
+	}
+	if data, _ := ioutil.ReadFile(image("long")); len(data) != gemu.ImageHeaderSize+2*1024 {
+		t.Errorf("converted image is %d bytes", len(data))
+	}
+	words, _ := load(image("long"))
+	if !equalWords(words, make([]uint16, 1024)) {
+		t.Error("converted blank disk is not blank")
+	}
+}
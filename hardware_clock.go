@@ -1,6 +1,7 @@
 package gemu
 
 import (
+	"encoding/binary"
 	"time"
 )
 
@@ -16,34 +17,164 @@ func init() {
 	RegisterClass(clockClass)
 }
 
+const (
+	ClockTimers = 4
+	ClockAlarms = 4
+)
+
+// ClockTimer divides the 60Hz base rate by Rate and counts the resulting
+// ticks.  Timer 0 is the one driven by HWI 0 to 2.
+type ClockTimer struct {
+	Rate      uint16
+	RateAccum uint16
+	Total     uint16
+	Interrupt uint16
+}
+
+// ClockAlarm interrupts once when the clock has been ticked At times since
+// reset.
+type ClockAlarm struct {
+	Armed     bool
+	At        uint64
+	Interrupt uint16
+}
+
 type Clock struct {
 	Hardware
-	Rate         uint16
-	RateAccum    uint16
-	Total        uint16
+	// ClockTimer is timer 0, embedded so Rate, Total and Interrupt are
+	// still fields of the Clock.  Timers holds the timers from 1 up.
+	ClockTimer
+	Timers       [ClockTimers - 1]ClockTimer
+	Alarms       [ClockAlarms]ClockAlarm
 	Accum        uint16
 	TicksLeft    int
-	Interrupt    uint16
-	RealOffset   time.Duration
+	RunTicks     uint64
 	RunTimeStart time.Time
+	Time         TimeSource
+
+	// The real time is Epoch at the host time EpochSet.  The epoch is kept
+	// as a time rather than an offset from the host, since the default one
+	// is further away than a time.Duration reaches.
+	Epoch    time.Time
+	EpochSet time.Time
+
+	storage Storage
+	item    string
+}
+
+// DefaultClockEpoch is the real time a new clock starts at.
+var DefaultClockEpoch = time.Date(2600, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type ClockOptions struct {
+	// Time defaults to RealTime.
+	Time TimeSource
+	// Epoch defaults to DefaultClockEpoch.
+	Epoch time.Time
+	// Item in Storage, if set, keeps the real time set by the guest across
+	// runs.  It is only meaningful with RealTime.
+	Storage Storage
+	Item    string
 }
 
 func NewClock() *Clock {
+	return NewClockWith(ClockOptions{})
+}
+
+func NewClockWith(opts ClockOptions) *Clock {
 	dev := &Clock{}
 	dev.Class = clockClass
-	realTime := time.Date(2600,
-		time.January,
-		1,
-		0,
-		0,
-		0,
-		0,
-		time.UTC)
-	dev.RealOffset = realTime.Sub(time.Now())
-	dev.RunTimeStart = time.Now()
+	dev.Time = opts.Time
+	if dev.Time == nil {
+		dev.Time = RealTime{}
+	}
+	dev.Epoch = opts.Epoch
+	if dev.Epoch.IsZero() {
+		dev.Epoch = DefaultClockEpoch
+	}
+	dev.EpochSet = dev.Time.Now()
+	dev.RunTimeStart = dev.EpochSet
+	if opts.Storage != nil && opts.Item != "" {
+		dev.storage, dev.item = opts.Storage, opts.Item
+		dev.loadEpoch()
+	}
 	return dev
 }
 
+// The saved epoch is the guest and host times as seconds and nanoseconds,
+// so it is always the same size and can be overwritten in place.
+const clockStateSize = 24
+
+func (c *Clock) loadEpoch() {
+	if !c.storage.Exists(c.item) || c.storage.Length(c.item) < clockStateSize {
+		return
+	}
+	data := make([]byte, clockStateSize)
+	c.storage.Read(c.item, 0, data)
+	c.Epoch = time.Unix(int64(binary.BigEndian.Uint64(data[0:])), int64(binary.BigEndian.Uint32(data[8:]))).UTC()
+	c.EpochSet = time.Unix(int64(binary.BigEndian.Uint64(data[12:])), int64(binary.BigEndian.Uint32(data[20:])))
+}
+
+func (c *Clock) saveEpoch() {
+	if c.storage == nil {
+		return
+	}
+	// A replay sets the time as it was set in the recording, which has
+	// nothing to do with the real time now.
+	if timeReplayed(c.Time) {
+		return
+	}
+	data := make([]byte, clockStateSize)
+	binary.BigEndian.PutUint64(data[0:], uint64(c.Epoch.Unix()))
+	binary.BigEndian.PutUint32(data[8:], uint32(c.Epoch.Nanosecond()))
+	binary.BigEndian.PutUint64(data[12:], uint64(c.EpochSet.Unix()))
+	binary.BigEndian.PutUint32(data[20:], uint32(c.EpochSet.Nanosecond()))
+	c.storage.Write(c.item, 0, data)
+}
+
+// RealTime returns the time the clock reports to the guest.
+func (c *Clock) RealTime() time.Time {
+	return c.Epoch.Add(c.Time.Now().Sub(c.EpochSet)).UTC()
+}
+
+func clockDate(D *DCPU) time.Time {
+	return time.Date(int(D.Reg[1]),
+		time.Month(D.Reg[2]>>8),
+		int(D.Reg[2]&0xFF),
+		int(D.Reg[3]>>8),
+		int(D.Reg[3]&0xFF),
+		int(D.Reg[4]),
+		int(D.Reg[5])*int(time.Millisecond),
+		time.UTC)
+}
+
+// clockDuration reads a run time in the layout RUN_TIME returns it in.
+func clockDuration(D *DCPU) time.Duration {
+	return time.Duration(D.Reg[2])*24*time.Hour +
+		time.Duration(D.Reg[3]>>8)*time.Hour +
+		time.Duration(D.Reg[3]&0xFF)*time.Minute +
+		time.Duration(D.Reg[4])*time.Second +
+		time.Duration(D.Reg[5])*time.Millisecond
+}
+
+func durationClockTicks(d time.Duration) uint64 {
+	if d < 0 {
+		return 0
+	}
+	return uint64(d / (time.Second / TicksPerSecond))
+}
+
+// HWI implements the Generic Clock, extended with more timers and alarms:
+//
+//	0x20 SET_TIMER     timer J runs at 60/B Hz, interrupting with message C
+//	0x21 GET_TIMER     C is set to the ticks of timer J since the last call
+//	0x30 ALARM_REAL    alarm J interrupts with message I at the real time B-Z,
+//	                   laid out as for SET_REAL_TIME
+//	0x31 ALARM_RUN     alarm J interrupts with message I at the run time C-Z,
+//	                   laid out as RUN_TIME returns it
+//	0x32 CLEAR_ALARM   disarms alarm J
+//
+// Alarms are kept in emulated ticks, so a real time alarm follows emulated
+// time once it is set.  Alarms set in the past go off straight away.
 func (c *Clock) HWI(D *DCPU) {
 	switch D.Reg[0] {
 	case 0:
@@ -54,41 +185,90 @@ func (c *Clock) HWI(D *DCPU) {
 	case 2:
 		c.Interrupt = D.Reg[1]
 	case 0x0010:
-		realTime := time.Now().Add(c.RealOffset)
+		realTime := c.RealTime()
 		D.Reg[1] = uint16(realTime.Year())
 		D.Reg[2] = uint16(int(realTime.Month())<<8 | realTime.Day())
 		D.Reg[3] = uint16(realTime.Hour()<<8 | realTime.Minute())
 		D.Reg[4] = uint16(realTime.Second())
 		D.Reg[5] = uint16(realTime.Nanosecond() / int(time.Millisecond))
 	case 0x0011:
-		runTimeTotal := time.Now().Sub(c.RunTimeStart)
+		runTimeTotal := c.Time.Now().Sub(c.RunTimeStart)
 		D.Reg[2] = uint16(runTimeTotal / (time.Hour * 24))
-		D.Reg[3] = uint16(runTimeTotal/(time.Hour))<<8 | uint16(runTimeTotal/(time.Minute))
-		D.Reg[4] = uint16(runTimeTotal / (time.Second))
-		D.Reg[5] = uint16(runTimeTotal / (time.Millisecond))
+		D.Reg[3] = uint16(runTimeTotal/time.Hour%24)<<8 | uint16(runTimeTotal/time.Minute%60)
+		D.Reg[4] = uint16(runTimeTotal / time.Second % 60)
+		D.Reg[5] = uint16(runTimeTotal / time.Millisecond % 1000)
 	case 0x0012:
-		realTime := time.Date(int(D.Reg[1]),
-			time.Month(D.Reg[2]>>8),
-			int(D.Reg[2]&0xFF),
-			int(D.Reg[3]>>8),
-			int(D.Reg[3]&0xFF),
-			int(D.Reg[4]),
-			int(D.Reg[5])*int(time.Millisecond),
-			time.UTC)
-		c.RealOffset = realTime.Sub(time.Now())
+		c.Epoch = clockDate(D)
+		c.EpochSet = c.Time.Now()
+		c.saveEpoch()
+	case 0x0020:
+		if timer := c.timer(D.Reg[7]); timer != nil {
+			*timer = ClockTimer{Rate: D.Reg[1], Interrupt: D.Reg[2]}
+		}
+	case 0x0021:
+		D.Reg[2] = 0
+		if timer := c.timer(D.Reg[7]); timer != nil {
+			D.Reg[2] = timer.Total
+			timer.Total = 0
+		}
+	case 0x0030:
+		if D.Reg[7] < ClockAlarms {
+			at := c.RunTicks + durationClockTicks(clockDate(D).Sub(c.RealTime()))
+			c.Alarms[D.Reg[7]] = ClockAlarm{Armed: true, At: at, Interrupt: D.Reg[6]}
+		}
+	case 0x0031:
+		if D.Reg[7] < ClockAlarms {
+			at := durationClockTicks(clockDuration(D))
+			c.Alarms[D.Reg[7]] = ClockAlarm{Armed: true, At: at, Interrupt: D.Reg[6]}
+		}
+	case 0x0032:
+		if D.Reg[7] < ClockAlarms {
+			c.Alarms[D.Reg[7]] = ClockAlarm{}
+		}
 	case 0xFFFF:
 		c.Reset()
 	}
 }
 
+// timer returns timer n, or nil if there is no such timer.
+func (c *Clock) timer(n uint16) *ClockTimer {
+	switch {
+	case n == 0:
+		return &c.ClockTimer
+	case n < ClockTimers:
+		return &c.Timers[n-1]
+	}
+	return nil
+}
+
 func (c *Clock) Reset() {
-	c.RunTimeStart = time.Now()
-	c.Rate = 0
-	c.Total = 0
-	c.Interrupt = 0
+	c.RunTimeStart = c.Time.Now()
+	c.RunTicks = 0
+	c.ClockTimer = ClockTimer{}
+	c.Timers = [ClockTimers - 1]ClockTimer{}
+	c.Alarms = [ClockAlarms]ClockAlarm{}
+}
+
+func (c *Clock) interrupt(msg uint16) {
+	if msg != 0 && c.Up != nil {
+		if dcpu, ok := c.Up.(*DCPU); ok {
+			dcpu.Int(msg)
+		}
+	}
 }
 
 func (c *Clock) Tick(ticks int) {
+	if ticker, ok := c.Time.(Ticker); ok {
+		ticker.Tick(ticks)
+	}
+	c.RunTicks += uint64(ticks)
+	for i := range c.Alarms {
+		alarm := &c.Alarms[i]
+		if alarm.Armed && c.RunTicks >= alarm.At {
+			alarm.Armed = false
+			c.interrupt(alarm.Interrupt)
+		}
+	}
 	c.TicksLeft -= ticks
 	for c.TicksLeft < 0 {
 		if c.Accum < 15 {
@@ -98,15 +278,14 @@ func (c *Clock) Tick(ticks int) {
 			c.Accum = 0
 			c.TicksLeft += 1676
 		}
-		c.RateAccum++
-		if c.RateAccum >= c.Rate {
-			c.RateAccum = 0
-			if c.Rate > 0 {
-				c.Total++
-				if c.Interrupt != 0 && c.Up != nil {
-					if dcpu, ok := c.Up.(*DCPU); ok {
-						dcpu.Int(c.Interrupt)
-					}
+		for n := uint16(0); n < ClockTimers; n++ {
+			timer := c.timer(n)
+			timer.RateAccum++
+			if timer.RateAccum >= timer.Rate {
+				timer.RateAccum = 0
+				if timer.Rate > 0 {
+					timer.Total++
+					c.interrupt(timer.Interrupt)
 				}
 			}
 		}
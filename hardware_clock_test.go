@@ -0,0 +1,151 @@
+package gemu
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestClock() (*DCPU, *Clock, *ManualTime) {
+	cpu := NewDCPU(0)
+	// Interrupts are only queued with an interrupt handler set.
+	cpu.IA = 1
+	source := NewManualTime(time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC))
+	clock := NewClockWith(ClockOptions{Time: source})
+	NewMachine(cpu).Attach(clock)
+	return cpu, clock, source
+}
+
+func clockHWI(cpu *DCPU, clock *Clock, regs ...uint16) {
+	copy(cpu.Reg[:], regs)
+	clock.HWI(cpu)
+}
+
+// sixtieths returns a number of ticks in which n 60ths of a second end.  The
+// first ends on the first tick and none is shorter than 1667 ticks.
+func sixtieths(n int) int {
+	return 1 + (n-1)*1667
+}
+
+func TestClockTimers(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		timer uint16
+		rate  uint16
+		ticks int
+		want  uint16
+	}{
+		{"off", 0, 0, sixtieths(60), 0},
+		{"60Hz", 0, 1, sixtieths(60), 60},
+		{"60Hz, one more", 0, 1, sixtieths(61), 61},
+		{"1Hz", 0, 60, sixtieths(600), 10},
+		{"1Hz, early", 0, 60, sixtieths(599), 9},
+		{"timer 3 at 30Hz", 3, 2, sixtieths(60), 30},
+		{"no timer 4", 4, 1, sixtieths(60), 0},
+	} {
+		cpu, clock, _ := newTestClock()
+		if test.timer == 0 {
+			clockHWI(cpu, clock, 0, test.rate)
+			clockHWI(cpu, clock, 2, 0x42)
+		} else {
+			clockHWI(cpu, clock, 0x20, test.rate, 0x42, 0, 0, 0, 0, test.timer)
+		}
+		clock.Tick(test.ticks)
+		if test.timer == 0 {
+			clockHWI(cpu, clock, 1)
+		} else {
+			clockHWI(cpu, clock, 0x21, 0, 0, 0, 0, 0, 0, test.timer)
+		}
+		if cpu.Reg[2] != test.want {
+			t.Errorf("%s: %d ticks, want %d", test.name, cpu.Reg[2], test.want)
+		}
+		if int(cpu.IQLen) != int(test.want) {
+			t.Errorf("%s: %d interrupts, want %d", test.name, cpu.IQLen, test.want)
+		}
+		clockHWI(cpu, clock, 1)
+		if cpu.Reg[2] != 0 {
+			t.Errorf("%s: count not reset by reading it", test.name)
+		}
+	}
+}
+
+func TestClockTimerZeroFields(t *testing.T) {
+	cpu, clock, _ := newTestClock()
+	clockHWI(cpu, clock, 0, 1)
+	clockHWI(cpu, clock, 2, 7)
+	if clock.Rate != 1 || clock.Interrupt != 7 {
+		t.Fatalf("Rate %d, Interrupt %d, want 1 and 7", clock.Rate, clock.Interrupt)
+	}
+	clock.Tick(sixtieths(60))
+	if clock.Total != 60 {
+		t.Errorf("Total is %d, want 60", clock.Total)
+	}
+}
+
+func TestClockAlarms(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// set arms alarm 1 with message 9.
+		set   func(cpu *DCPU, clock *Clock)
+		ticks int
+		fires bool
+	}{
+		{"run time, early", func(cpu *DCPU, clock *Clock) {
+			clockHWI(cpu, clock, 0x31, 0, 0, 0, 2, 0, 9, 1)
+		}, 2*TicksPerSecond - 1, false},
+		{"run time", func(cpu *DCPU, clock *Clock) {
+			clockHWI(cpu, clock, 0x31, 0, 0, 0, 2, 0, 9, 1)
+		}, 2 * TicksPerSecond, true},
+		{"real time", func(cpu *DCPU, clock *Clock) {
+			clockHWI(cpu, clock, 0x30, 2600, 0x0101, 0, 5, 0, 9, 1)
+		}, 5 * TicksPerSecond, true},
+		{"real time, early", func(cpu *DCPU, clock *Clock) {
+			clockHWI(cpu, clock, 0x30, 2600, 0x0101, 0, 5, 0, 9, 1)
+		}, 4 * TicksPerSecond, false},
+		{"in the past", func(cpu *DCPU, clock *Clock) {
+			clockHWI(cpu, clock, 0x30, 2599, 0x0101, 0, 0, 0, 9, 1)
+		}, 1, true},
+		{"cleared", func(cpu *DCPU, clock *Clock) {
+			clockHWI(cpu, clock, 0x31, 0, 0, 0, 2, 0, 9, 1)
+			clockHWI(cpu, clock, 0x32, 0, 0, 0, 0, 0, 0, 1)
+		}, 3 * TicksPerSecond, false},
+	} {
+		cpu, clock, _ := newTestClock()
+		test.set(cpu, clock)
+		clock.Tick(test.ticks)
+		fired := cpu.IQLen == 1 && cpu.IQ[0] == 9
+		if fired != test.fires || cpu.IQLen > 1 {
+			t.Errorf("%s: %d interrupts %x, want fired %v", test.name, cpu.IQLen, cpu.IQ[:cpu.IQLen], test.fires)
+		}
+	}
+}
+
+func TestClockRunTime(t *testing.T) {
+	for _, test := range []struct {
+		elapsed time.Duration
+		want    [4]uint16
+	}{
+		{0, [4]uint16{0, 0, 0, 0}},
+		{1500 * time.Millisecond, [4]uint16{0, 0, 1, 500}},
+		{59*time.Minute + 59*time.Second + 999*time.Millisecond, [4]uint16{0, 0x003b, 59, 999}},
+		{26*time.Hour + 3*time.Minute + 4*time.Second + 5*time.Millisecond, [4]uint16{1, 0x0203, 4, 5}},
+		{400 * 24 * time.Hour, [4]uint16{400, 0, 0, 0}},
+	} {
+		cpu, clock, source := newTestClock()
+		source.Advance(test.elapsed)
+		clockHWI(cpu, clock, 0x11)
+		if got := [4]uint16{cpu.Reg[2], cpu.Reg[3], cpu.Reg[4], cpu.Reg[5]}; got != test.want {
+			t.Errorf("run time after %v: %x, want %x", test.elapsed, got, test.want)
+		}
+	}
+}
+
+func TestClockRealTime(t *testing.T) {
+	cpu, clock, source := newTestClock()
+	clockHWI(cpu, clock, 0x12, 2650, 0x0c1f, 0x173b, 59, 500)
+	source.Advance(time.Second)
+	clockHWI(cpu, clock, 0x10)
+	want := [5]uint16{2651, 0x0101, 0x0000, 0, 500}
+	if got := [5]uint16{cpu.Reg[1], cpu.Reg[2], cpu.Reg[3], cpu.Reg[4], cpu.Reg[5]}; got != want {
+		t.Errorf("real time %d, want %d", got, want)
+	}
+}
@@ -1,21 +1,186 @@
 package gemu
 
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// There is no spec for the EEPROM.  It shares the embedded ROM's
+// manufacturer and version, and takes the device ID after the ROM's, as the
+// two are the same family of embedded memory with the same HWI interface.
+var eepromClass = &HardwareClass{
+	Name:  "eeprom",
+	Desc:  "Embedded EEPROM",
+	DevID: 0x17400012,
+	VerID: 0x0001,
+	MfgID: 0x12452135,
+}
+
+func init() {
+	RegisterClass(eepromClass)
+}
+
+// EEPROM is word addressable memory that survives power cycles.  Erasing
+// sets every word to 0xffff and programming can only clear bits.  Every
+// program or erase wears the words it touches, and once a word has been
+// through Endurance cycles it is stuck at its last value.
+//
+// With a Storage, the contents are kept in Item, stored big endian, and the
+// wear counts in Item + ".wear".
 type EEPROM struct {
-	Data []uint16
+	Hardware
+	Data      []uint16
+	Wear      []uint32
+	Endurance uint32
+
+	storage Storage
+	item    string
+}
+
+const DefaultEEPROMEndurance = 100000
+
+// NewEEPROM creates an EEPROM of size words, loading it from item in storage
+// if it exists there.  storage may be nil for an EEPROM that is forgotten on
+// exit.  An item that cannot be read or written is an error.
+func NewEEPROM(size int, storage Storage, item string) (*EEPROM, error) {
+	eeprom := &EEPROM{
+		Data:      make([]uint16, size),
+		Wear:      make([]uint32, size),
+		Endurance: DefaultEEPROMEndurance,
+		storage:   storage,
+		item:      item,
+	}
+	eeprom.Class = eepromClass
+	for i := range eeprom.Data {
+		eeprom.Data[i] = 0xFFFF
+	}
+	if storage == nil {
+		return eeprom, nil
+	}
+	stored := 0
+	if storage.Exists(item) {
+		var err error
+		if stored, err = eeprom.load(); err != nil {
+			return nil, err
+		}
+	}
+	// Store the words the item does not have yet, so partial writes later on
+	// do not leave holes.
+	if err := eeprom.save(stored, size-stored); err != nil {
+		return nil, err
+	}
+	return eeprom, nil
+}
+
+// load reads the stored words and their wear, returning how many there were.
+// Items saved without wear counts start out unworn.
+func (E *EEPROM) load() (int, error) {
+	ctx := context.Background()
+	storage := AsStorageV2(E.storage)
+	size, err := storage.Size(ctx, E.item)
+	if err != nil {
+		return 0, fmt.Errorf("loading EEPROM %s: %v", E.item, err)
+	}
+	stored := int(size / 2)
+	if stored > len(E.Data) {
+		stored = len(E.Data)
+	}
+	data := make([]byte, stored*2)
+	if _, err := storage.ReadAt(ctx, E.item, data, 0); err != nil && err != io.EOF {
+		return 0, fmt.Errorf("loading EEPROM %s: %v", E.item, err)
+	}
+	wear := make([]byte, stored*4)
+	if _, err := storage.ReadAt(ctx, E.item+".wear", wear, 0); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("loading EEPROM wear %s: %v", E.item, err)
+	}
+	for i := 0; i < stored; i++ {
+		E.Data[i] = binary.BigEndian.Uint16(data[i*2:])
+		E.Wear[i] = binary.BigEndian.Uint32(wear[i*4:])
+	}
+	return stored, nil
+}
+
+func (E *EEPROM) Worn(addr int) bool {
+	return E.Endurance > 0 && E.Wear[addr] >= E.Endurance
+}
+
+func (E *EEPROM) save(addr, count int) error {
+	if E.storage == nil || count == 0 {
+		return nil
+	}
+	data := make([]byte, count*2)
+	wear := make([]byte, count*4)
+	for i := 0; i < count; i++ {
+		binary.BigEndian.PutUint16(data[i*2:], E.Data[addr+i])
+		binary.BigEndian.PutUint32(wear[i*4:], E.Wear[addr+i])
+	}
+	ctx := context.Background()
+	storage := AsStorageV2(E.storage)
+	if _, err := storage.WriteAt(ctx, E.item, data, int64(addr*2)); err != nil {
+		return fmt.Errorf("saving EEPROM %s: %v", E.item, err)
+	}
+	if _, err := storage.WriteAt(ctx, E.item+".wear", wear, int64(addr*4)); err != nil {
+		return fmt.Errorf("saving EEPROM wear %s: %v", E.item, err)
+	}
+	return nil
 }
 
+// store saves words from the HWI, which has no way to report a failure to the
+// DCPU.
+func (E *EEPROM) store(addr, count int) {
+	if err := E.save(addr, count); err != nil {
+		log.Println(err)
+	}
+}
+
+// HWI takes the operation in B:
+//
+//	0 X is set to the size in words
+//	1 Y is set to the word at X
+//	2 programs the word at X with Y, clearing the bits clear in Y
+//	3 erases everything
+//	4 Y is set to the number of times the word at X has been programmed or
+//	  erased, saturating at 0xffff
+//
+// Addresses past the end read as 0xffff and cannot be programmed.
 func (E *EEPROM) HWI(D *DCPU) {
+	addr := int(D.Reg[3])
 	switch D.Reg[1] {
+	case 0:
+		D.Reg[3] = uint16(len(E.Data))
 	case 1:
-		D.Reg[4] = E.Data[D.Reg[3]]
+		D.Reg[4] = 0xFFFF
+		if addr < len(E.Data) {
+			D.Reg[4] = E.Data[addr]
+		}
 		D.WaitState += 1000 / D.TickRate
 	case 2:
-		E.Data[D.Reg[3]] &= D.Reg[4]
+		if addr < len(E.Data) && !E.Worn(addr) {
+			E.Data[addr] &= D.Reg[4]
+			E.Wear[addr]++
+			E.store(addr, 1)
+		}
 		D.WaitState += 5000 / D.TickRate
 	case 3:
 		for i := range E.Data {
-			E.Data[i] = 0xFFFF
+			if !E.Worn(i) {
+				E.Data[i] = 0xFFFF
+				E.Wear[i]++
+			}
 		}
+		E.store(0, len(E.Data))
 		D.WaitState += 10000 / D.TickRate
+	case 4:
+		D.Reg[4] = 0
+		if addr < len(E.Data) {
+			D.Reg[4] = 0xFFFF
+			if E.Wear[addr] < 0xFFFF {
+				D.Reg[4] = uint16(E.Wear[addr])
+			}
+		}
 	}
 }
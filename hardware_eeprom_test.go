@@ -0,0 +1,120 @@
+package gemu
+
+import (
+	"errors"
+	"testing"
+)
+
+func eepromHWI(cpu *DCPU, eeprom *EEPROM, b, x, y uint16) uint16 {
+	cpu.Reg[1], cpu.Reg[3], cpu.Reg[4] = b, x, y
+	eeprom.HWI(cpu)
+	return cpu.Reg[4]
+}
+
+func TestEEPROMProgramAndErase(t *testing.T) {
+	cpu := NewDCPU(0)
+	eeprom, err := NewEEPROM(16, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.Reg[1] = 0
+	eeprom.HWI(cpu)
+	if cpu.Reg[3] != 16 {
+		t.Errorf("size %d, want 16", cpu.Reg[3])
+	}
+	for _, step := range []struct {
+		b, x, y uint16
+		want    uint16
+	}{
+		{1, 5, 0, 0xFFFF},
+		// Programming can only clear bits.
+		{2, 5, 0x0FF0, 0},
+		{1, 5, 0, 0x0FF0},
+		{2, 5, 0xF0F0, 0},
+		{1, 5, 0, 0x00F0},
+		{4, 5, 0, 2},
+		{3, 0, 0, 0},
+		{1, 5, 0, 0xFFFF},
+		{4, 5, 0, 3},
+		{4, 6, 0, 1},
+	} {
+		if got := eepromHWI(cpu, eeprom, step.b, step.x, step.y); step.b != 2 && step.b != 3 && got != step.want {
+			t.Errorf("B=%d X=%d: Y=%04x, want %04x", step.b, step.x, got, step.want)
+		}
+	}
+}
+
+func TestEEPROMBounds(t *testing.T) {
+	cpu := NewDCPU(0)
+	eeprom, _ := NewEEPROM(16, nil, "")
+	eepromHWI(cpu, eeprom, 2, 16, 0)
+	eepromHWI(cpu, eeprom, 2, 0xFFFF, 0)
+	if got := eepromHWI(cpu, eeprom, 1, 16, 0); got != 0xFFFF {
+		t.Errorf("past the end reads %04x", got)
+	}
+	if got := eepromHWI(cpu, eeprom, 4, 0xFFFF, 0); got != 0 {
+		t.Errorf("past the end has worn %d times", got)
+	}
+}
+
+func TestEEPROMWear(t *testing.T) {
+	cpu := NewDCPU(0)
+	eeprom, _ := NewEEPROM(4, nil, "")
+	eeprom.Endurance = 3
+	eepromHWI(cpu, eeprom, 2, 1, 0x1234)
+	eepromHWI(cpu, eeprom, 3, 0, 0)
+	eepromHWI(cpu, eeprom, 2, 1, 0x00FF)
+	if !eeprom.Worn(1) || eeprom.Worn(0) {
+		t.Fatalf("worn %v and %v, want only word 1", eeprom.Worn(0), eeprom.Worn(1))
+	}
+	// Worn words are stuck.
+	eepromHWI(cpu, eeprom, 2, 1, 0)
+	eepromHWI(cpu, eeprom, 3, 0, 0)
+	if got := eepromHWI(cpu, eeprom, 1, 1, 0); got != 0x00FF {
+		t.Errorf("worn word reads %04x, want 00ff", got)
+	}
+	if got := eepromHWI(cpu, eeprom, 4, 1, 0); got != 3 {
+		t.Errorf("worn word has %d cycles, want 3", got)
+	}
+	eeprom.Wear[2] = 0x12345
+	if got := eepromHWI(cpu, eeprom, 4, 2, 0); got != 0xFFFF {
+		t.Errorf("wear reads %04x, want it to saturate", got)
+	}
+}
+
+func TestEEPROMStorage(t *testing.T) {
+	storage := NewMemStorage()
+	cpu := NewDCPU(0)
+	eeprom, err := NewEEPROM(8, storage, "ee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.Length("ee") != 16 || storage.Length("ee.wear") != 32 {
+		t.Fatalf("stored %d and %d bytes, want 16 and 32", storage.Length("ee"), storage.Length("ee.wear"))
+	}
+	eepromHWI(cpu, eeprom, 2, 5, 0x1234)
+	raw := make([]byte, 2)
+	storage.Read("ee", 10, raw)
+	if raw[0] != 0x12 || raw[1] != 0x34 {
+		t.Errorf("word 5 stored as % x, want big endian", raw)
+	}
+
+	// Growing keeps what was there and fills in the rest erased.
+	grown, err := NewEEPROM(12, storage, "ee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grown.Data[5] != 0x1234 || grown.Wear[5] != 1 || grown.Data[10] != 0xFFFF || storage.Length("ee") != 24 {
+		t.Errorf("grown EEPROM holds %04x worn %d, %04x", grown.Data[5], grown.Wear[5], grown.Data[10])
+	}
+
+	// Items saved without wear counts start out unworn.
+	storage.Delete("ee.wear")
+	if unworn, err := NewEEPROM(12, storage, "ee"); err != nil || unworn.Data[5] != 0x1234 || unworn.Wear[5] != 0 {
+		t.Errorf("without wear counts: %v", err)
+	}
+
+	if _, err := NewEEPROM(8, failingMem{NewMemStorage(), errors.New("no space")}, "ee"); err == nil {
+		t.Error("an EEPROM that cannot be saved was created")
+	}
+}
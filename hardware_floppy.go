@@ -1,7 +1,11 @@
 package gemu
 
 import (
+	"context"
+	"io"
+	"os"
 	"reflect"
+	"sync"
 	"unsafe"
 )
 
@@ -17,102 +21,213 @@ func init() {
 	RegisterClass(floppyClass)
 }
 
+const (
+	FD_STATE_NO_MEDIA uint16 = 0
+	FD_STATE_READY           = 1
+	FD_STATE_READY_WP        = 2
+	FD_STATE_BUSY            = 3
+)
+
+const (
+	FD_ERROR_NONE       uint16 = 0
+	FD_ERROR_BUSY              = 1
+	FD_ERROR_NO_MEDIA          = 2
+	FD_ERROR_PROTECTED         = 3
+	FD_ERROR_EJECT             = 4
+	FD_ERROR_BAD_SECTOR        = 5
+	FD_ERROR_BROKEN            = 0xffff
+)
+
+// A disk has 80 tracks of 18 sectors of 512 words.  Seeking takes 2.4ms per
+// track and sectors transfer at 30700 words per second.
+const (
+	FloppyTracks          = 80
+	FloppySectorsPerTrack = 18
+	FloppySectors         = FloppyTracks * FloppySectorsPerTrack
+	FloppySectorWords     = 512
+	FloppySectorBytes     = FloppySectorWords * 2
+	FloppySeekTicks       = 240
+	FloppySectorTicks     = 1668
+)
+
 type M35FD struct {
 	Hardware
 	Error     uint16
 	interrupt uint16
 
-	Running    bool
-	TicksLeft  int
-	Block      []byte
-	Addr       uint16
-	Read       bool
-	ActionDone bool
+	Running   bool
+	TicksLeft int
+	Block     []byte
+	Addr      uint16
+	Read      bool
+	Track     int
+	done      chan error
 
-	Disk string
+	Disk           string
+	WriteProtected bool
+	readOnly       bool
 
 	NeedSync bool
 
-	storage Storage
+	lastState uint16
+	lastError uint16
+
+	// diskMu guards Disk against CurrentDisk, and status, which is what
+	// Status reports, against Status.
+	diskMu sync.Mutex
+	status DriveStatus
+
+	storage *ImageStorage
 }
 
-func NewM35FD(flip bool) *M35FD {
+// NewM35FD creates an empty drive.  Disks can be stored in either byte
+// order, and disks with a header saying they are write protected cannot be
+// written.
+func NewM35FD() *M35FD {
 	floppy := &M35FD{}
 	floppy.Class = floppyClass
 	floppy.NeedSync = true
-	floppy.storage = defaultStorage
-	if flip {
-		floppy.storage = NewFlipStorage(defaultStorage)
-	}
+	floppy.storage = NewImageStorage(defaultStorage)
 	return floppy
 }
 
+// Protected reports whether the disk in the drive cannot be written, either
+// because it has been write protected or because its image was read only
+// when it was inserted.
+func (fd *M35FD) Protected() bool {
+	return fd.Disk != "" && (fd.WriteProtected || fd.readOnly)
+}
+
+func (fd *M35FD) State() uint16 {
+	switch {
+	case fd.Disk == "":
+		return FD_STATE_NO_MEDIA
+	case fd.Running:
+		return FD_STATE_BUSY
+	case fd.Protected():
+		return FD_STATE_READY_WP
+	}
+	return FD_STATE_READY
+}
+
+// changed interrupts the DCPU if the state or error has changed since the
+// last time, or always if force is set.
+func (fd *M35FD) changed(force bool) {
+	fd.snapshot()
+	state := fd.State()
+	if state == fd.lastState && fd.Error == fd.lastError && !force {
+		return
+	}
+	fd.lastState, fd.lastError = state, fd.Error
+	fd.NeedSync = true
+	if fd.interrupt != 0 && fd.Up != nil {
+		if dcpu, ok := fd.Up.(*DCPU); ok {
+			dcpu.Int(fd.interrupt)
+		}
+	}
+}
+
+func (fd *M35FD) blockWords() []uint16 {
+	rawData := []uint16{}
+	bytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&rawData))
+	bytesHeader.Data = uintptr(unsafe.Pointer(&fd.Block[0]))
+	bytesHeader.Len = FloppySectorWords
+	bytesHeader.Cap = FloppySectorWords
+	return rawData
+}
+
+// startIO checks whether a transfer of sector can start, setting Error if it
+// cannot.
+func (fd *M35FD) startIO(sector uint16, write bool) bool {
+	switch {
+	case fd.Running:
+		fd.Error = FD_ERROR_BUSY
+	case fd.Disk == "":
+		fd.Error = FD_ERROR_NO_MEDIA
+	case sector >= FloppySectors:
+		fd.Error = FD_ERROR_BAD_SECTOR
+	case write && fd.Protected():
+		fd.Error = FD_ERROR_PROTECTED
+	case !write && !fd.storage.Exists(fd.Disk):
+		fd.Error = FD_ERROR_BROKEN
+	default:
+		track := int(sector) / FloppySectorsPerTrack
+		seek := track - fd.Track
+		if seek < 0 {
+			seek = -seek
+		}
+		fd.Track = track
+		fd.TicksLeft = seek*FloppySeekTicks + FloppySectorTicks
+		fd.Block = make([]byte, FloppySectorBytes)
+		fd.done = make(chan error, 1)
+		fd.Running = true
+		fd.Read = !write
+		return true
+	}
+	return false
+}
+
+// readBlock reads block from disk at offset.  Images may be shorter than a
+// whole disk, and the sectors past their end read as zeroes.
+func readBlock(storage Storage, disk string, block []byte, offset int64) error {
+	n, err := AsStorageV2(storage).ReadAt(context.Background(), disk, block, offset)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		for i := n; i < len(block); i++ {
+			block[i] = 0
+		}
+		err = nil
+	}
+	return err
+}
+
+// storageError maps a storage error onto the error a transfer fails with.
+func storageError(err error) uint16 {
+	switch {
+	case err == nil:
+		return FD_ERROR_NONE
+	case os.IsPermission(err):
+		return FD_ERROR_PROTECTED
+	}
+	return FD_ERROR_BROKEN
+}
+
 func (fd *M35FD) HWI(D *DCPU) {
 	switch D.Reg[0] {
 	case 0:
-		if fd.Running {
-			D.Reg[1] = 3
-		} else if fd.Disk != "" {
-			/*if disk.Readonly {
-				D.Reg[1] = 2
-			} else {
-				D.Reg[1] = 1
-			}*/
-			D.Reg[1] = 1 // Need to reenable readonly checks
-		} else {
-			D.Reg[1] = 0
-		}
+		D.Reg[1] = fd.State()
 		D.Reg[2] = fd.Error
-		fd.Error = 0
+		fd.Error = FD_ERROR_NONE
+		fd.lastError = fd.Error
 	case 1:
 		fd.interrupt = D.Reg[3]
 	case 2:
-		if fd.Disk != "" {
-			fd.Block = make([]byte, 1024)
-			fd.ActionDone = false
-			go func(offset int) { fd.storage.Read(fd.Disk, offset, fd.Block); fd.ActionDone = true }(int(D.Reg[3]) * 1024)
-			fd.Running = true
-			fd.TicksLeft = 10000
+		D.Reg[1] = 0
+		if fd.startIO(D.Reg[3], false) {
 			fd.Addr = D.Reg[4]
-			fd.Read = true
-			fd.NeedSync = true
+			go func(disk string, offset int, block []byte, done chan error) {
+				done <- readBlock(fd.storage, disk, block, int64(offset))
+			}(fd.Disk, int(D.Reg[3])*FloppySectorBytes, fd.Block, fd.done)
 			D.Reg[1] = 1
-		} else {
-			fd.Error = 2
-			D.Reg[1] = 0
-		}
-		if fd.interrupt != 0 && fd.Up != nil {
-			if dcpu, ok := fd.Up.(*DCPU); ok {
-				dcpu.Int(fd.interrupt)
-			}
 		}
+		fd.changed(false)
 	case 3:
-		if fd.Disk != "" {
-
-			fd.Block = make([]byte, 1024)
-			rawData := []uint16{}
-			bytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&rawData))
-			bytesHeader.Data = uintptr(unsafe.Pointer(&fd.Block[0]))
-			bytesHeader.Len = 512
-			bytesHeader.Cap = 512
-			baseRam := fd.GetMem().GetRaw()[fd.Addr:]
-			copy(rawData, baseRam)
-			go func(offset int) { fd.storage.Write(fd.Disk, offset, fd.Block); fd.ActionDone = true }(int(D.Reg[3]) * 1024)
-			fd.Running = true
-			fd.TicksLeft = 10000
+		D.Reg[1] = 0
+		if fd.startIO(D.Reg[3], true) {
 			fd.Addr = D.Reg[4]
-			fd.Read = false
-			fd.NeedSync = true
-			D.Reg[1] = 1
-		} else {
-			fd.Error = 2
-			D.Reg[1] = 0
-		}
-		if fd.interrupt != 0 && fd.Up != nil {
-			if dcpu, ok := fd.Up.(*DCPU); ok {
-				dcpu.Int(fd.interrupt)
+			if fd.GetMem() != nil {
+				ram := fd.GetMem().GetRaw()
+				words := fd.blockWords()
+				for i := range words {
+					words[i] = ram[(int(fd.Addr)+i)&0xFFFF]
+				}
 			}
+			go func(disk string, offset int, block []byte, done chan error) {
+				_, err := AsStorageV2(fd.storage).WriteAt(context.Background(), disk, block, int64(offset))
+				done <- err
+			}(fd.Disk, int(D.Reg[3])*FloppySectorBytes, fd.Block, fd.done)
+			D.Reg[1] = 1
 		}
+		fd.changed(false)
 	}
 }
 
@@ -120,51 +235,76 @@ func (fd *M35FD) Tick(ticks int) {
 	if fd.Running {
 		fd.TicksLeft -= ticks
 		if fd.TicksLeft <= 0 {
-			if fd.Read {
-				if fd.ActionDone {
-					rawData := []uint16{}
-					bytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&rawData))
-					bytesHeader.Data = uintptr(unsafe.Pointer(&fd.Block[0]))
-					bytesHeader.Len = 512
-					bytesHeader.Cap = 512
-					if fd.GetMem() != nil {
-						copy(fd.GetMem().GetRaw()[fd.Addr:], rawData)
-					}
-					fd.Running = false
-					fd.NeedSync = true
-					if fd.interrupt != 0 && fd.Up != nil {
-						if dcpu, ok := fd.Up.(*DCPU); ok {
-							dcpu.Int(fd.interrupt)
-						}
-					}
-				}
-			} else {
-				if fd.ActionDone {
-					fd.Running = false
-					fd.NeedSync = true
-					if fd.interrupt != 0 && fd.Up != nil {
-						if dcpu, ok := fd.Up.(*DCPU); ok {
-							dcpu.Int(fd.interrupt)
-						}
-					}
+			// Wait for the transfer rather than polling for it, so it always
+			// completes on the same cycle however slow the host is.
+			err := <-fd.done
+			fd.Error = storageError(err)
+			if fd.Read && err == nil && fd.GetMem() != nil {
+				ram := fd.GetMem().GetRaw()
+				for i, word := range fd.blockWords() {
+					ram[(int(fd.Addr)+i)&0xFFFF] = word
 				}
 			}
-
+			fd.Running = false
+			fd.changed(false)
 		}
 	}
 }
 
 func (fd *M35FD) Reset() {
-	fd.Error = 0
+	fd.Error = FD_ERROR_NONE
+	fd.Running = false
+	fd.interrupt = 0
+	fd.lastState, fd.lastError = fd.State(), fd.Error
+	fd.snapshot()
+}
+
+// snapshot updates what Status reports.
+func (fd *M35FD) snapshot() {
+	fd.diskMu.Lock()
+	fd.status = DriveStatus{Disk: fd.Disk, WriteProtected: fd.Protected(), State: fd.State()}
+	fd.diskMu.Unlock()
 }
 
+// Status describes the drive as of its last state change.  It is safe to
+// call from any goroutine.
+func (fd *M35FD) Status() DriveStatus {
+	fd.diskMu.Lock()
+	defer fd.diskMu.Unlock()
+	return fd.status
+}
+
+// ChangeDisk ejects the current disk, if any, and inserts disk.  An empty
+// disk just ejects.  A transfer in progress fails with ERROR_EJECT.  The new
+// disk starts out without write protection.
 func (fd *M35FD) ChangeDisk(disk string) {
-	fd.Disk = disk
-	if fd.interrupt != 0 && fd.Up != nil {
-		if dcpu, ok := fd.Up.(*DCPU); ok {
-			dcpu.Int(fd.interrupt)
-		}
+	if fd.Running {
+		fd.Running = false
+		fd.Error = FD_ERROR_EJECT
 	}
+	fd.diskMu.Lock()
+	fd.Disk = disk
+	fd.diskMu.Unlock()
+	fd.storage.Forget(disk)
+	fd.WriteProtected = false
+	fd.readOnly = disk != "" && IsReadOnly(fd.storage, disk)
+	fd.changed(true)
+}
+
+// SetImageOrder sets the byte order of raw disks inserted from now on.
+func (fd *M35FD) SetImageOrder(order ImageOrder) {
+	fd.storage.RawOrder = order
+}
+
+func (fd *M35FD) CurrentDisk() string {
+	fd.diskMu.Lock()
+	defer fd.diskMu.Unlock()
+	return fd.Disk
+}
+
+func (fd *M35FD) SetWriteProtect(protect bool) {
+	fd.WriteProtected = protect
+	fd.changed(false)
 }
 
 func (fd *M35FD) IsDirty() bool {
@@ -0,0 +1,206 @@
+package gemu
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+// readOnlyMem is a MemStorage whose items cannot be written.
+type readOnlyMem struct{ *MemStorage }
+
+func (RO readOnlyMem) ReadOnly(Item string) bool { return true }
+
+// failingMem is a MemStorage whose writes fail with err.
+type failingMem struct {
+	*MemStorage
+	err error
+}
+
+func (FM failingMem) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	return 0, FM.err
+}
+
+func newTestFloppy(storage Storage) (*DCPU, *Machine, *M35FD) {
+	cpu := NewDCPU(0)
+	cpu.IA = 1
+	machine := NewMachine(cpu)
+	fd := NewM35FD()
+	fd.storage = NewImageStorage(storage)
+	fd.SetImageOrder(ImageOrderBig)
+	machine.Attach(fd)
+	return cpu, machine, fd
+}
+
+// floppyHWI sends A, X and Y to the drive and returns B and C.
+func floppyHWI(cpu *DCPU, fd *M35FD, a, x, y uint16) (uint16, uint16) {
+	cpu.Reg[0], cpu.Reg[3], cpu.Reg[4] = a, x, y
+	fd.HWI(cpu)
+	return cpu.Reg[1], cpu.Reg[2]
+}
+
+func TestFloppyErrors(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		storage Storage
+		disk    string
+		setup   func(cpu *DCPU, fd *M35FD)
+		a, x    uint16
+		want    uint16
+	}{
+		{"no media", NewMemStorage(), "", nil, 2, 0, FD_ERROR_NO_MEDIA},
+		{"bad sector", NewMemStorage(), "disk", nil, 2, FloppySectors, FD_ERROR_BAD_SECTOR},
+		{"missing image", NewMemStorage(), "disk", nil, 2, 0, FD_ERROR_BROKEN},
+		{"write protected", NewMemStorage(), "disk", func(cpu *DCPU, fd *M35FD) {
+			fd.SetWriteProtect(true)
+		}, 3, 0, FD_ERROR_PROTECTED},
+		{"read only image", readOnlyMem{NewMemStorage()}, "disk", nil, 3, 0, FD_ERROR_PROTECTED},
+		{"busy", NewMemStorage(), "disk", func(cpu *DCPU, fd *M35FD) {
+			floppyHWI(cpu, fd, 3, 0, 0)
+		}, 3, 1, FD_ERROR_BUSY},
+	} {
+		cpu, _, fd := newTestFloppy(test.storage)
+		fd.ChangeDisk(test.disk)
+		if test.setup != nil {
+			test.setup(cpu, fd)
+		}
+		if b, _ := floppyHWI(cpu, fd, test.a, test.x, 0); b != 0 {
+			t.Errorf("%s: transfer started", test.name)
+		}
+		if _, c := floppyHWI(cpu, fd, 0, 0, 0); c != test.want {
+			t.Errorf("%s: error %d, want %d", test.name, c, test.want)
+		}
+		if _, c := floppyHWI(cpu, fd, 0, 0, 0); c != FD_ERROR_NONE {
+			t.Errorf("%s: error %d not cleared by polling", test.name, c)
+		}
+	}
+}
+
+func TestFloppyStates(t *testing.T) {
+	cpu, machine, fd := newTestFloppy(NewMemStorage())
+	for _, step := range []struct {
+		name string
+		do   func()
+		want uint16
+	}{
+		{"empty", func() {}, FD_STATE_NO_MEDIA},
+		{"inserted", func() { fd.ChangeDisk("disk") }, FD_STATE_READY},
+		{"protected", func() { fd.SetWriteProtect(true) }, FD_STATE_READY_WP},
+		{"unprotected", func() { fd.SetWriteProtect(false) }, FD_STATE_READY},
+		{"writing", func() { floppyHWI(cpu, fd, 3, 0, 0) }, FD_STATE_BUSY},
+		{"written", func() { machine.Tick(FloppySectorTicks) }, FD_STATE_READY},
+		{"ejected", func() { fd.ChangeDisk("") }, FD_STATE_NO_MEDIA},
+	} {
+		step.do()
+		if b, _ := floppyHWI(cpu, fd, 0, 0, 0); b != step.want {
+			t.Errorf("%s: state %d, want %d", step.name, b, step.want)
+		}
+	}
+	_, _, fd = newTestFloppy(readOnlyMem{NewMemStorage()})
+	fd.ChangeDisk("disk")
+	if state := fd.State(); state != FD_STATE_READY_WP {
+		t.Errorf("read only image: state %d, want %d", state, FD_STATE_READY_WP)
+	}
+}
+
+func TestFloppyTiming(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		from, to uint16
+		ticks    int
+	}{
+		{"same track", 0, FloppySectorsPerTrack - 1, FloppySectorTicks},
+		{"two tracks out", 0, 2 * FloppySectorsPerTrack, 2*FloppySeekTicks + FloppySectorTicks},
+		{"back in", 5 * FloppySectorsPerTrack, FloppySectorsPerTrack, 4*FloppySeekTicks + FloppySectorTicks},
+		{"last track", 0, FloppySectors - 1, (FloppyTracks-1)*FloppySeekTicks + FloppySectorTicks},
+	} {
+		cpu, machine, fd := newTestFloppy(NewMemStorage())
+		fd.ChangeDisk("disk")
+		floppyHWI(cpu, fd, 3, test.from, 0)
+		machine.Tick(FloppyTracks*FloppySeekTicks + FloppySectorTicks)
+		floppyHWI(cpu, fd, 3, test.to, 0)
+		machine.Tick(test.ticks - 1)
+		if !fd.Running {
+			t.Errorf("%s: done early", test.name)
+			continue
+		}
+		machine.Tick(1)
+		if fd.Running {
+			t.Errorf("%s: not done after %d ticks", test.name, test.ticks)
+		}
+	}
+}
+
+func TestFloppyRoundTrip(t *testing.T) {
+	storage := NewMemStorage()
+	cpu, machine, fd := newTestFloppy(storage)
+	floppyHWI(cpu, fd, 1, 0, 0)
+	floppyHWI(cpu, fd, 1, 0x77, 0)
+	fd.ChangeDisk("disk")
+	cpu.IQLen = 0
+	for i := 0; i < FloppySectorWords; i++ {
+		// The block wraps around the end of memory.
+		cpu.Mem.RAM[(0xFF00+i)&0xFFFF] = uint16(i * 3)
+	}
+	if b, _ := floppyHWI(cpu, fd, 3, 37, 0xFF00); b != 1 {
+		t.Fatal("write did not start")
+	}
+	machine.Tick(FloppyTracks * FloppySeekTicks * 2)
+	raw := make([]byte, 2)
+	storage.Read("disk", 37*FloppySectorBytes+2*100, raw)
+	if raw[0] != 300>>8 || raw[1] != 300&0xFF {
+		t.Errorf("word 100 stored as % x, want big endian 300", raw)
+	}
+
+	if b, _ := floppyHWI(cpu, fd, 2, 37, 0x2000); b != 1 {
+		t.Fatal("read did not start")
+	}
+	machine.Tick(FloppyTracks * FloppySeekTicks * 2)
+	for i := 0; i < FloppySectorWords; i++ {
+		if cpu.Mem.RAM[0x2000+i] != uint16(i*3) {
+			t.Fatalf("word %d read back as %d", i, cpu.Mem.RAM[0x2000+i])
+		}
+	}
+	// Past the end of the image reads as zeroes.
+	cpu.Mem.RAM[0x3000] = 1
+	floppyHWI(cpu, fd, 2, FloppySectors-1, 0x3000)
+	machine.Tick(FloppyTracks * FloppySeekTicks * 2)
+	if _, c := floppyHWI(cpu, fd, 0, 0, 0); c != FD_ERROR_NONE || cpu.Mem.RAM[0x3000] != 0 {
+		t.Errorf("reading past the image: error %d, word %d", c, cpu.Mem.RAM[0x3000])
+	}
+	// Each start and end of a transfer changes the state.
+	if cpu.IQLen != 6 || cpu.IQ[0] != 0x77 {
+		t.Errorf("interrupts %x, want six of 77", cpu.IQ[:cpu.IQLen])
+	}
+}
+
+func TestFloppyTransferErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want uint16
+	}{
+		{"permission", &os.PathError{Op: "write", Path: "disk", Err: os.ErrPermission}, FD_ERROR_PROTECTED},
+		{"broken", errors.New("disk on fire"), FD_ERROR_BROKEN},
+	} {
+		cpu, machine, fd := newTestFloppy(failingMem{NewMemStorage(), test.err})
+		fd.ChangeDisk("disk")
+		if b, _ := floppyHWI(cpu, fd, 3, 0, 0); b != 1 {
+			t.Fatalf("%s: write did not start", test.name)
+		}
+		machine.Tick(FloppySectorTicks)
+		if _, c := floppyHWI(cpu, fd, 0, 0, 0); c != test.want {
+			t.Errorf("%s: error %d, want %d", test.name, c, test.want)
+		}
+	}
+
+	cpu, machine, fd := newTestFloppy(NewMemStorage())
+	fd.ChangeDisk("disk")
+	floppyHWI(cpu, fd, 3, 0, 0)
+	fd.ChangeDisk("")
+	machine.Tick(FloppySectorTicks)
+	if b, c := floppyHWI(cpu, fd, 0, 0, 0); b != FD_STATE_NO_MEDIA || c != FD_ERROR_EJECT {
+		t.Errorf("ejecting during a write: state %d, error %d", b, c)
+	}
+}
@@ -0,0 +1,365 @@
+package gemu
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+var hmdClass = &HardwareClass{
+	Name:  "hmd2043",
+	Desc:  "Harold Media Drive HMD2043",
+	DevID: 0x74fa4cae,
+	VerID: 0x07c2,
+	MfgID: 0x21544948,
+}
+
+func init() {
+	RegisterClass(hmdClass)
+}
+
+const (
+	HMD_QUERY_MEDIA_PRESENT    uint16 = 0x0000
+	HMD_QUERY_MEDIA_PARAMETERS        = 0x0001
+	HMD_QUERY_DEVICE_FLAGS            = 0x0002
+	HMD_UPDATE_DEVICE_FLAGS           = 0x0003
+	HMD_QUERY_INTERRUPT_TYPE          = 0x0004
+	HMD_SET_INTERRUPT_MESSAGE         = 0x0005
+	HMD_READ_SECTORS                  = 0x0010
+	HMD_WRITE_SECTORS                 = 0x0011
+	HMD_QUERY_MEDIA_QUALITY           = 0xFFFF
+)
+
+// Errors are returned in A.  ERROR_PROTECTED and ERROR_BROKEN are not in
+// the HMD2043 spec: writes to write locked media fail with ERROR_PROTECTED,
+// and transfers the host storage fails with ERROR_BROKEN.
+const (
+	HMD_ERROR_NONE           uint16 = 0x0000
+	HMD_ERROR_NO_MEDIA              = 0x0001
+	HMD_ERROR_INVALID_SECTOR        = 0x0002
+	HMD_ERROR_PENDING               = 0x0003
+	HMD_ERROR_PROTECTED             = 0x0004
+	HMD_ERROR_BROKEN                = 0x0005
+)
+
+const (
+	HMD_FLAG_NON_BLOCKING           uint16 = 0x0001
+	HMD_FLAG_MEDIA_STATUS_INTERRUPT        = 0x0002
+)
+
+const (
+	HMD_INTERRUPT_NONE           uint16 = 0x0000
+	HMD_INTERRUPT_MEDIA_STATUS          = 0x0001
+	HMD_INTERRUPT_READ_COMPLETE         = 0x0002
+	HMD_INTERRUPT_WRITE_COMPLETE        = 0x0003
+)
+
+const HMDMediaAuthentic uint16 = 0x7fff
+
+// DiskGeometry describes the layout of a disk.  Sectors are numbered
+// cylinder by cylinder, so seeks are only needed between cylinders.
+type DiskGeometry struct {
+	Cylinders       int
+	Heads           int
+	SectorsPerTrack int
+	SectorWords     int
+}
+
+// HMU1440 is the standard 1440 sector Harold media unit.
+var HMU1440 = DiskGeometry{Cylinders: 80, Heads: 2, SectorsPerTrack: 9, SectorWords: 512}
+
+// Sectors returns the number of sectors, at most 0xffff as sector numbers
+// have to fit in a register.
+func (G DiskGeometry) Sectors() int {
+	sectors := G.Cylinders * G.Heads * G.SectorsPerTrack
+	if sectors > 0xffff {
+		sectors = 0xffff
+	}
+	return sectors
+}
+
+func (G DiskGeometry) SectorBytes() int {
+	return G.SectorWords * 2
+}
+
+func (G DiskGeometry) cylinder(sector int) int {
+	return sector / (G.Heads * G.SectorsPerTrack)
+}
+
+type HMD2043 struct {
+	Hardware
+	Geometry DiskGeometry
+	// SeekTicks is the time to move the heads by one cylinder, SectorTicks
+	// the time to transfer one sector.
+	SeekTicks   int
+	SectorTicks int
+
+	Disk        string
+	diskMu      sync.Mutex
+	WriteLocked bool
+
+	Flags         uint16
+	Message       uint16
+	LastInterrupt uint16
+	LastError     uint16
+
+	Cylinder  int
+	Running   bool
+	TicksLeft int
+	Read      bool
+	Block     []byte
+	Addr      uint16
+	done      chan error
+
+	// geometry is what disks without a header are taken to have.
+	geometry DiskGeometry
+	storage  *ImageStorage
+}
+
+// NewHMD2043 creates a drive for disks of the given geometry, with the
+// timing of a small hard disk: 1ms per cylinder seeked and 1ms per sector.
+// Disks whose header gives their geometry use that instead.
+func NewHMD2043(geometry DiskGeometry) *HMD2043 {
+	hmd := &HMD2043{Geometry: geometry, SeekTicks: 100, SectorTicks: 100, geometry: geometry}
+	hmd.Class = hmdClass
+	hmd.storage = NewImageStorage(defaultStorage)
+	return hmd
+}
+
+func (H *HMD2043) interrupt(kind uint16, err uint16) {
+	H.LastInterrupt, H.LastError = kind, err
+	if H.Message != 0 && H.Up != nil {
+		if dcpu, ok := H.Up.(*DCPU); ok {
+			dcpu.Int(H.Message)
+		}
+	}
+}
+
+// transferTicks returns how long a transfer takes, moving the heads to the
+// last cylinder it touches.
+func (H *HMD2043) transferTicks(sector, count int) int {
+	first, last := H.Geometry.cylinder(sector), H.Geometry.cylinder(sector+count-1)
+	seek := first - H.Cylinder
+	if seek < 0 {
+		seek = -seek
+	}
+	seek += last - first
+	H.Cylinder = last
+	return seek*H.SeekTicks + count*H.SectorTicks
+}
+
+func (H *HMD2043) HWI(D *DCPU) {
+	switch D.Reg[0] {
+	case HMD_QUERY_MEDIA_PRESENT:
+		D.Reg[1] = 0
+		if H.Disk != "" {
+			D.Reg[1] = 1
+		}
+		D.Reg[0] = HMD_ERROR_NONE
+	case HMD_QUERY_MEDIA_PARAMETERS:
+		if H.Disk == "" {
+			D.Reg[0] = HMD_ERROR_NO_MEDIA
+			return
+		}
+		D.Reg[1] = uint16(H.Geometry.SectorWords)
+		D.Reg[2] = uint16(H.Geometry.Sectors())
+		D.Reg[3] = 0
+		if H.WriteLocked || IsReadOnly(H.storage, H.Disk) {
+			D.Reg[3] = 1
+		}
+		D.Reg[0] = HMD_ERROR_NONE
+	case HMD_QUERY_DEVICE_FLAGS:
+		D.Reg[1] = H.Flags
+		D.Reg[0] = HMD_ERROR_NONE
+	case HMD_UPDATE_DEVICE_FLAGS:
+		if H.Running {
+			D.Reg[0] = HMD_ERROR_PENDING
+			return
+		}
+		H.Flags = D.Reg[1]
+		D.Reg[0] = HMD_ERROR_NONE
+	case HMD_QUERY_INTERRUPT_TYPE:
+		D.Reg[1] = H.LastInterrupt
+		D.Reg[0] = H.LastError
+	case HMD_SET_INTERRUPT_MESSAGE:
+		H.Message = D.Reg[1]
+		D.Reg[0] = HMD_ERROR_NONE
+	case HMD_READ_SECTORS, HMD_WRITE_SECTORS:
+		D.Reg[0] = H.transfer(D, D.Reg[0] == HMD_WRITE_SECTORS)
+	case HMD_QUERY_MEDIA_QUALITY:
+		if H.Disk == "" {
+			D.Reg[0] = HMD_ERROR_NO_MEDIA
+			return
+		}
+		D.Reg[1] = HMDMediaAuthentic
+		D.Reg[0] = HMD_ERROR_NONE
+	}
+}
+
+// transfer starts reading or writing C sectors from sector B at address X.
+// In blocking mode the transfer happens straight away and the DCPU waits for
+// as long as it would have taken, otherwise it completes in Tick with an
+// interrupt.
+func (H *HMD2043) transfer(D *DCPU, write bool) uint16 {
+	sector, count := int(D.Reg[1]), int(D.Reg[2])
+	switch {
+	case H.Running:
+		return HMD_ERROR_PENDING
+	case H.Disk == "":
+		return HMD_ERROR_NO_MEDIA
+	case sector+count > H.Geometry.Sectors():
+		return HMD_ERROR_INVALID_SECTOR
+	case write && (H.WriteLocked || IsReadOnly(H.storage, H.Disk)):
+		return HMD_ERROR_PROTECTED
+	case count == 0:
+		return HMD_ERROR_NONE
+	}
+	H.Addr = D.Reg[3]
+	H.Read = !write
+	H.Block = make([]byte, count*H.Geometry.SectorBytes())
+	if write {
+		H.fromMemory()
+	}
+	ticks := H.transferTicks(sector, count)
+	offset := int64(sector * H.Geometry.SectorBytes())
+	if H.Flags&HMD_FLAG_NON_BLOCKING == 0 {
+		err := H.transferBlock(H.Disk, H.Block, offset, write)
+		if !write && err == nil {
+			H.toMemory()
+		}
+		if D.TickRate > 0 {
+			D.WaitState += ticks / D.TickRate
+		}
+		return hmdError(err)
+	}
+	H.Running = true
+	H.TicksLeft = ticks
+	H.done = make(chan error, 1)
+	go func(disk string, block []byte, done chan error) {
+		done <- H.transferBlock(disk, block, offset, write)
+	}(H.Disk, H.Block, H.done)
+	return HMD_ERROR_NONE
+}
+
+func (H *HMD2043) transferBlock(disk string, block []byte, offset int64, write bool) error {
+	if !write {
+		return readBlock(H.storage, disk, block, offset)
+	}
+	_, err := H.storage.WriteAt(context.Background(), disk, block, offset)
+	return err
+}
+
+// hmdError maps a storage error onto the error a transfer fails with.
+func hmdError(err error) uint16 {
+	switch {
+	case err == nil:
+		return HMD_ERROR_NONE
+	case os.IsPermission(err):
+		return HMD_ERROR_PROTECTED
+	}
+	return HMD_ERROR_BROKEN
+}
+
+func (H *HMD2043) blockWords() []uint16 {
+	rawData := []uint16{}
+	bytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&rawData))
+	bytesHeader.Data = uintptr(unsafe.Pointer(&H.Block[0]))
+	bytesHeader.Len = len(H.Block) / 2
+	bytesHeader.Cap = len(H.Block) / 2
+	return rawData
+}
+
+func (H *HMD2043) fromMemory() {
+	if H.GetMem() == nil {
+		return
+	}
+	ram := H.GetMem().GetRaw()
+	words := H.blockWords()
+	for i := range words {
+		words[i] = ram[(int(H.Addr)+i)&0xFFFF]
+	}
+}
+
+func (H *HMD2043) toMemory() {
+	if H.GetMem() == nil {
+		return
+	}
+	ram := H.GetMem().GetRaw()
+	for i, word := range H.blockWords() {
+		ram[(int(H.Addr)+i)&0xFFFF] = word
+	}
+}
+
+func (H *HMD2043) Tick(ticks int) {
+	if !H.Running {
+		return
+	}
+	H.TicksLeft -= ticks
+	if H.TicksLeft > 0 {
+		return
+	}
+	err := <-H.done
+	H.Running = false
+	if H.Read {
+		if err == nil {
+			H.toMemory()
+		}
+		H.interrupt(HMD_INTERRUPT_READ_COMPLETE, hmdError(err))
+	} else {
+		H.interrupt(HMD_INTERRUPT_WRITE_COMPLETE, hmdError(err))
+	}
+}
+
+func (H *HMD2043) Reset() {
+	H.Flags = 0
+	H.Message = 0
+	H.LastInterrupt = HMD_INTERRUPT_NONE
+	H.LastError = HMD_ERROR_NONE
+	H.Running = false
+}
+
+// ChangeDisk ejects the current disk, if any, and inserts disk.  A transfer
+// in progress completes with ERROR_NO_MEDIA, once the host has finished with
+// the old disk.
+func (H *HMD2043) ChangeDisk(disk string) {
+	if H.Running {
+		<-H.done
+		H.Running = false
+		kind := uint16(HMD_INTERRUPT_WRITE_COMPLETE)
+		if H.Read {
+			kind = HMD_INTERRUPT_READ_COMPLETE
+		}
+		H.interrupt(kind, HMD_ERROR_NO_MEDIA)
+	}
+	H.diskMu.Lock()
+	H.Disk = disk
+	H.diskMu.Unlock()
+	H.WriteLocked = false
+	H.storage.Forget(disk)
+	H.Geometry = H.geometry
+	if disk != "" {
+		if header := H.storage.Header(disk); header != nil && header.Geometry.Sectors() > 0 && header.Geometry.SectorWords > 0 {
+			H.Geometry = header.Geometry
+		}
+	}
+	if H.Flags&HMD_FLAG_MEDIA_STATUS_INTERRUPT != 0 {
+		H.interrupt(HMD_INTERRUPT_MEDIA_STATUS, HMD_ERROR_NONE)
+	}
+}
+
+// SetImageOrder sets the byte order of raw disks inserted from now on.
+func (H *HMD2043) SetImageOrder(order ImageOrder) {
+	H.storage.RawOrder = order
+}
+
+func (H *HMD2043) CurrentDisk() string {
+	H.diskMu.Lock()
+	defer H.diskMu.Unlock()
+	return H.Disk
+}
+
+func (H *HMD2043) SetWriteProtect(protect bool) {
+	H.WriteLocked = protect
+}
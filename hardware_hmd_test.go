@@ -0,0 +1,140 @@
+package gemu
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// slowMem is a MemStorage whose writes wait until release is closed.
+type slowMem struct {
+	*MemStorage
+	release chan bool
+}
+
+func (SM slowMem) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	<-SM.release
+	return SM.MemStorage.WriteAt(ctx, Item, data, offset)
+}
+
+func newTestHMD(storage Storage) (*DCPU, *Machine, *HMD2043) {
+	cpu := NewDCPU(0)
+	cpu.IA = 1
+	machine := NewMachine(cpu)
+	hmd := NewHMD2043(HMU1440)
+	hmd.storage = NewImageStorage(storage)
+	machine.Attach(hmd)
+	return cpu, machine, hmd
+}
+
+// hmdHWI sends A, B, C and X to the drive and returns A.
+func hmdHWI(cpu *DCPU, hmd *HMD2043, a, b, c, x uint16) uint16 {
+	cpu.Reg[0], cpu.Reg[1], cpu.Reg[2], cpu.Reg[3] = a, b, c, x
+	hmd.HWI(cpu)
+	return cpu.Reg[0]
+}
+
+func TestHMDRoundTrip(t *testing.T) {
+	for _, nonBlocking := range []bool{false, true} {
+		cpu, machine, hmd := newTestHMD(NewMemStorage())
+		hmd.ChangeDisk("disk")
+		if nonBlocking {
+			hmdHWI(cpu, hmd, HMD_UPDATE_DEVICE_FLAGS, HMD_FLAG_NON_BLOCKING, 0, 0)
+			hmdHWI(cpu, hmd, HMD_SET_INTERRUPT_MESSAGE, 0x55, 0, 0)
+		}
+		for i := 0; i < 2*HMU1440.SectorWords; i++ {
+			cpu.Mem.RAM[0x1000+i] = uint16(i)
+		}
+		if a := hmdHWI(cpu, hmd, HMD_WRITE_SECTORS, 100, 2, 0x1000); a != HMD_ERROR_NONE {
+			t.Fatalf("non-blocking %v: write failed with %d", nonBlocking, a)
+		}
+		machine.Tick(100000)
+		if a := hmdHWI(cpu, hmd, HMD_READ_SECTORS, 100, 2, 0x4000); a != HMD_ERROR_NONE {
+			t.Fatalf("non-blocking %v: read failed with %d", nonBlocking, a)
+		}
+		machine.Tick(100000)
+		for i := 0; i < 2*HMU1440.SectorWords; i++ {
+			if cpu.Mem.RAM[0x4000+i] != uint16(i) {
+				t.Fatalf("non-blocking %v: word %d read back as %d", nonBlocking, i, cpu.Mem.RAM[0x4000+i])
+			}
+		}
+		if nonBlocking && (cpu.IQLen != 2 || hmd.LastInterrupt != HMD_INTERRUPT_READ_COMPLETE) {
+			t.Errorf("%d interrupts, last of type %d", cpu.IQLen, hmd.LastInterrupt)
+		}
+	}
+}
+
+func TestHMDErrors(t *testing.T) {
+	permission := &os.PathError{Op: "write", Path: "disk", Err: os.ErrPermission}
+	for _, test := range []struct {
+		name    string
+		storage Storage
+		flags   uint16
+		want    uint16
+	}{
+		{"blocking, protected", failingMem{NewMemStorage(), permission}, 0, HMD_ERROR_PROTECTED},
+		{"blocking, broken", failingMem{NewMemStorage(), errors.New("head crash")}, 0, HMD_ERROR_BROKEN},
+		{"non-blocking, protected", failingMem{NewMemStorage(), permission}, HMD_FLAG_NON_BLOCKING, HMD_ERROR_PROTECTED},
+		{"non-blocking, broken", failingMem{NewMemStorage(), errors.New("head crash")}, HMD_FLAG_NON_BLOCKING, HMD_ERROR_BROKEN},
+	} {
+		cpu, machine, hmd := newTestHMD(test.storage)
+		hmd.ChangeDisk("disk")
+		hmdHWI(cpu, hmd, HMD_UPDATE_DEVICE_FLAGS, test.flags, 0, 0)
+		a := hmdHWI(cpu, hmd, HMD_WRITE_SECTORS, 0, 1, 0)
+		if test.flags&HMD_FLAG_NON_BLOCKING == 0 {
+			if a != test.want {
+				t.Errorf("%s: write returned %d, want %d", test.name, a, test.want)
+			}
+			continue
+		}
+		if a != HMD_ERROR_NONE {
+			t.Errorf("%s: write did not start: %d", test.name, a)
+		}
+		machine.Tick(100000)
+		if a := hmdHWI(cpu, hmd, HMD_QUERY_INTERRUPT_TYPE, 0, 0, 0); a != test.want || cpu.Reg[1] != HMD_INTERRUPT_WRITE_COMPLETE {
+			t.Errorf("%s: interrupt %d with error %d, want a write completing with %d", test.name, cpu.Reg[1], a, test.want)
+		}
+	}
+
+	cpu, _, hmd := newTestHMD(NewMemStorage())
+	for _, test := range []struct {
+		name    string
+		a, b, c uint16
+		want    uint16
+	}{
+		{"no media", HMD_READ_SECTORS, 0, 1, HMD_ERROR_NO_MEDIA},
+		{"past the end", HMD_READ_SECTORS, 1439, 2, HMD_ERROR_INVALID_SECTOR},
+		{"write locked", HMD_WRITE_SECTORS, 0, 1, HMD_ERROR_PROTECTED},
+	} {
+		switch test.name {
+		case "past the end":
+			hmd.ChangeDisk("disk")
+		case "write locked":
+			hmd.SetWriteProtect(true)
+		}
+		if a := hmdHWI(cpu, hmd, test.a, test.b, test.c, 0); a != test.want {
+			t.Errorf("%s: %d, want %d", test.name, a, test.want)
+		}
+	}
+}
+
+func TestHMDChangeDiskWaits(t *testing.T) {
+	storage := slowMem{NewMemStorage(), make(chan bool)}
+	cpu, _, hmd := newTestHMD(storage)
+	hmd.ChangeDisk("disk")
+	hmdHWI(cpu, hmd, HMD_UPDATE_DEVICE_FLAGS, HMD_FLAG_NON_BLOCKING, 0, 0)
+	hmdHWI(cpu, hmd, HMD_WRITE_SECTORS, 0, 1, 0)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(storage.release)
+	}()
+	hmd.ChangeDisk("other")
+	if !storage.Exists("disk") {
+		t.Error("disk changed before the write to the old one finished")
+	}
+	if hmd.LastError != HMD_ERROR_NO_MEDIA || hmd.Running {
+		t.Errorf("transfer ended with %d, running %v", hmd.LastError, hmd.Running)
+	}
+}
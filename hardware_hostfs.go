@@ -0,0 +1,350 @@
+package gemu
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var hostfsClass = &HardwareClass{
+	Name:  "hostfs",
+	Desc:  "GEMU Host Filesystem",
+	DevID: 0x48465331,
+	VerID: 0x0001,
+	MfgID: 0x47454d55,
+}
+
+func init() {
+	RegisterClass(hostfsClass)
+}
+
+// Operations are passed in A.
+const (
+	HOSTFS_OPEN   uint16 = 0x0000
+	HOSTFS_CLOSE         = 0x0001
+	HOSTFS_READ          = 0x0002
+	HOSTFS_WRITE         = 0x0003
+	HOSTFS_SEEK          = 0x0004
+	HOSTFS_STAT          = 0x0005
+	HOSTFS_LIST          = 0x0006
+	HOSTFS_DELETE        = 0x0007
+)
+
+// Errors are returned in A.
+const (
+	HOSTFS_ERROR_NONE          uint16 = 0x0000
+	HOSTFS_ERROR_NOT_FOUND            = 0x0001
+	HOSTFS_ERROR_BAD_NAME             = 0x0002
+	HOSTFS_ERROR_BAD_HANDLE           = 0x0003
+	HOSTFS_ERROR_NO_HANDLES           = 0x0004
+	HOSTFS_ERROR_PROTECTED            = 0x0005
+	HOSTFS_ERROR_FULL                 = 0x0006
+	HOSTFS_ERROR_BROKEN               = 0x0007
+	HOSTFS_ERROR_NOT_SUPPORTED        = 0x0008
+)
+
+// Open modes, in B.  HOSTFS_MODE_TEXT can be added to any of them.
+const (
+	HOSTFS_MODE_READ   uint16 = 0x0000
+	HOSTFS_MODE_WRITE         = 0x0001
+	HOSTFS_MODE_APPEND        = 0x0002
+	HOSTFS_MODE_TEXT          = 0x0010
+)
+
+const (
+	HostFSHandles = 8
+	// HostFSMaxName is the longest name, in words, read from memory.
+	HostFSMaxName = 256
+)
+
+// HostFS is a paravirtual device giving the guest files in a Storage, meant
+// for tools that need to load and save files on the host without disk
+// images.  Give it a JailStorage to keep the guest inside one directory;
+// names are cleaned with CleanItemName whatever the Storage.
+//
+// Names are zero terminated strings in memory, a character to a word, of
+// slash separated parts.  Files are read and written two bytes to a word,
+// big endian, or in text mode a byte to a word, the high byte being dropped
+// on writes.  The last byte of a file of odd length reads as a word of its
+// own, padded with a zero low byte.  Positions and counts are in words.
+//
+// Calls complete straight away.
+type HostFS struct {
+	Hardware
+
+	storage Storage
+	files   [HostFSHandles]*hostFile
+}
+
+type hostFile struct {
+	name   string
+	offset int64
+	write  bool
+	text   bool
+}
+
+func NewHostFS(storage Storage) *HostFS {
+	hfs := &HostFS{storage: storage}
+	hfs.Class = hostfsClass
+	return hfs
+}
+
+func (F *hostFile) wordBytes() int64 {
+	if F.text {
+		return 1
+	}
+	return 2
+}
+
+// hostfsError turns a Storage error into the error returned to the guest.
+func hostfsError(err error) uint16 {
+	if err == nil {
+		return HOSTFS_ERROR_NONE
+	}
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	switch {
+	case os.IsNotExist(err):
+		return HOSTFS_ERROR_NOT_FOUND
+	case err == ErrBadItemName || err == ErrOutsideJail:
+		return HOSTFS_ERROR_BAD_NAME
+	case os.IsPermission(err):
+		return HOSTFS_ERROR_PROTECTED
+	case err == ErrQuotaExceeded:
+		return HOSTFS_ERROR_FULL
+	case err == ErrNotSupported:
+		return HOSTFS_ERROR_NOT_SUPPORTED
+	}
+	return HOSTFS_ERROR_BROKEN
+}
+
+// HWI takes the operation in A and returns an error in A:
+//
+//	OPEN    X name, B mode.  Sets B to a handle from 1 to 8.  WRITE
+//	        creates the file, emptying it if it exists, and APPEND creates
+//	        it and starts at its end.
+//	CLOSE   B handle
+//	READ    B handle, X address, C count.  Sets C to the words read, 0 at
+//	        the end of the file.
+//	WRITE   B handle, X address, C count.  Sets C to the words written.
+//	SEEK    B handle, X low and Y high word of the position
+//	STAT    X name.  Sets B and C to the low and high words of the size in
+//	        bytes.
+//	LIST    X name prefix, B index, Y buffer, C buffer size.  Copies the
+//	        name of the Bth file whose name starts with the prefix, in
+//	        name order, to the buffer, zero terminated and cut short if
+//	        it does not fit, and sets C to its full length.  Fails with
+//	        NOT_FOUND past the last file.
+//	DELETE  X name
+func (F *HostFS) HWI(D *DCPU) {
+	switch D.Reg[0] {
+	case HOSTFS_OPEN:
+		D.Reg[0], D.Reg[1] = F.open(D.Reg[3], D.Reg[1])
+	case HOSTFS_CLOSE:
+		if F.file(D.Reg[1]) == nil {
+			D.Reg[0] = HOSTFS_ERROR_BAD_HANDLE
+			return
+		}
+		F.files[D.Reg[1]-1] = nil
+		D.Reg[0] = HOSTFS_ERROR_NONE
+	case HOSTFS_READ:
+		D.Reg[0], D.Reg[2] = F.read(F.file(D.Reg[1]), D.Reg[3], D.Reg[2])
+	case HOSTFS_WRITE:
+		D.Reg[0], D.Reg[2] = F.write(F.file(D.Reg[1]), D.Reg[3], D.Reg[2])
+	case HOSTFS_SEEK:
+		file := F.file(D.Reg[1])
+		if file == nil {
+			D.Reg[0] = HOSTFS_ERROR_BAD_HANDLE
+			return
+		}
+		file.offset = (int64(D.Reg[4])<<16 | int64(D.Reg[3])) * file.wordBytes()
+		D.Reg[0] = HOSTFS_ERROR_NONE
+	case HOSTFS_STAT:
+		name, err := F.name(D.Reg[3])
+		if err != HOSTFS_ERROR_NONE {
+			D.Reg[0] = err
+			return
+		}
+		info, serr := StatItem(F.storage, name)
+		if serr != nil {
+			D.Reg[0] = hostfsError(serr)
+			return
+		}
+		D.Reg[1], D.Reg[2] = uint16(info.Size), uint16(info.Size>>16)
+		D.Reg[0] = HOSTFS_ERROR_NONE
+	case HOSTFS_LIST:
+		D.Reg[0], D.Reg[2] = F.list(D.Reg[3], D.Reg[1], D.Reg[4], D.Reg[2])
+	case HOSTFS_DELETE:
+		name, err := F.name(D.Reg[3])
+		if err == HOSTFS_ERROR_NONE {
+			err = hostfsError(DeleteItem(F.storage, name))
+		}
+		D.Reg[0] = err
+	}
+}
+
+func (F *HostFS) file(handle uint16) *hostFile {
+	if handle < 1 || handle > HostFSHandles {
+		return nil
+	}
+	return F.files[handle-1]
+}
+
+// readString reads a zero terminated string from memory, up to max words.
+func (F *HostFS) readString(addr uint16, max int) string {
+	mem := F.GetMem()
+	if mem == nil {
+		return ""
+	}
+	ram := mem.GetRaw()
+	var text []byte
+	for i := 0; i < max; i++ {
+		word := ram[(int(addr)+i)&0xFFFF]
+		if word == 0 {
+			break
+		}
+		if word > 0xFF {
+			word = '?'
+		}
+		text = append(text, byte(word))
+	}
+	return string(text)
+}
+
+func (F *HostFS) name(addr uint16) (string, uint16) {
+	name, err := CleanItemName(F.readString(addr, HostFSMaxName))
+	if err != nil {
+		return "", HOSTFS_ERROR_BAD_NAME
+	}
+	return name, HOSTFS_ERROR_NONE
+}
+
+func (F *HostFS) open(addr, mode uint16) (uint16, uint16) {
+	name, err := F.name(addr)
+	if err != HOSTFS_ERROR_NONE {
+		return err, 0
+	}
+	handle := 0
+	for i, file := range F.files {
+		if file == nil {
+			handle = i + 1
+			break
+		}
+	}
+	if handle == 0 {
+		return HOSTFS_ERROR_NO_HANDLES, 0
+	}
+	file := &hostFile{name: name, text: mode&HOSTFS_MODE_TEXT != 0}
+	switch mode &^ HOSTFS_MODE_TEXT {
+	case HOSTFS_MODE_READ:
+		if !F.storage.Exists(name) {
+			return HOSTFS_ERROR_NOT_FOUND, 0
+		}
+	case HOSTFS_MODE_WRITE, HOSTFS_MODE_APPEND:
+		file.write = true
+		if IsReadOnly(F.storage, name) {
+			return HOSTFS_ERROR_PROTECTED, 0
+		}
+		var serr error
+		switch {
+		case !F.storage.Exists(name):
+			_, serr = AsStorageV2(F.storage).WriteAt(context.Background(), name, nil, 0)
+		case mode&^HOSTFS_MODE_TEXT == HOSTFS_MODE_WRITE:
+			serr = TruncateItem(F.storage, name, 0)
+		default:
+			file.offset, serr = AsStorageV2(F.storage).Size(context.Background(), name)
+		}
+		if serr != nil {
+			return hostfsError(serr), 0
+		}
+	default:
+		return HOSTFS_ERROR_NOT_SUPPORTED, 0
+	}
+	F.files[handle-1] = file
+	return HOSTFS_ERROR_NONE, uint16(handle)
+}
+
+func (F *HostFS) read(file *hostFile, addr, count uint16) (uint16, uint16) {
+	if file == nil {
+		return HOSTFS_ERROR_BAD_HANDLE, 0
+	}
+	data := make([]byte, int64(count)*file.wordBytes())
+	n, err := AsStorageV2(F.storage).ReadAt(context.Background(), file.name, data, file.offset)
+	if err != nil && err != io.EOF {
+		return hostfsError(err), 0
+	}
+	words := (n + int(file.wordBytes()) - 1) / int(file.wordBytes())
+	if n%2 != 0 && !file.text {
+		data[n] = 0
+	}
+	file.offset += int64(n)
+	if mem := F.GetMem(); mem != nil {
+		ram := mem.GetRaw()
+		for i := 0; i < words; i++ {
+			word := uint16(data[i])
+			if !file.text {
+				word = uint16(data[i*2])<<8 | uint16(data[i*2+1])
+			}
+			ram[(int(addr)+i)&0xFFFF] = word
+		}
+	}
+	return HOSTFS_ERROR_NONE, uint16(words)
+}
+
+func (F *HostFS) write(file *hostFile, addr, count uint16) (uint16, uint16) {
+	if file == nil {
+		return HOSTFS_ERROR_BAD_HANDLE, 0
+	}
+	if !file.write {
+		return HOSTFS_ERROR_PROTECTED, 0
+	}
+	data := make([]byte, int64(count)*file.wordBytes())
+	if mem := F.GetMem(); mem != nil {
+		ram := mem.GetRaw()
+		for i := 0; i < int(count); i++ {
+			word := ram[(int(addr)+i)&0xFFFF]
+			if file.text {
+				data[i] = byte(word)
+			} else {
+				data[i*2], data[i*2+1] = byte(word>>8), byte(word)
+			}
+		}
+	}
+	n, err := AsStorageV2(F.storage).WriteAt(context.Background(), file.name, data, file.offset)
+	words := n / int(file.wordBytes())
+	file.offset += int64(words) * file.wordBytes()
+	return hostfsError(err), uint16(words)
+}
+
+func (F *HostFS) list(addr, index, buffer, size uint16) (uint16, uint16) {
+	prefix := F.readString(addr, HostFSMaxName)
+	if strings.Contains(prefix, "..") {
+		return HOSTFS_ERROR_BAD_NAME, 0
+	}
+	items, err := ListItems(F.storage, prefix)
+	if err != nil {
+		return hostfsError(err), 0
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	if int(index) >= len(items) {
+		return HOSTFS_ERROR_NOT_FOUND, 0
+	}
+	name := items[index].Name
+	if mem := F.GetMem(); mem != nil && size > 0 {
+		ram := mem.GetRaw()
+		i := 0
+		for ; i < len(name) && i < int(size)-1; i++ {
+			ram[(int(buffer)+i)&0xFFFF] = uint16(name[i])
+		}
+		ram[(int(buffer)+i)&0xFFFF] = 0
+	}
+	return HOSTFS_ERROR_NONE, uint16(len(name))
+}
+
+// Reset closes every file.
+func (F *HostFS) Reset() {
+	F.files = [HostFSHandles]*hostFile{}
+}
@@ -0,0 +1,184 @@
+package gemu
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func newTestHostFS(storage Storage) (*DCPU, *HostFS) {
+	cpu := NewDCPU(0)
+	machine := NewMachine(cpu)
+	hfs := NewHostFS(storage)
+	machine.Attach(hfs)
+	return cpu, hfs
+}
+
+// hostfsHWI sends A, B, C, X and Y to the device and returns A.
+func hostfsHWI(cpu *DCPU, hfs *HostFS, a, b, c, x, y uint16) uint16 {
+	cpu.Reg[0], cpu.Reg[1], cpu.Reg[2], cpu.Reg[3], cpu.Reg[4] = a, b, c, x, y
+	hfs.HWI(cpu)
+	return cpu.Reg[0]
+}
+
+// putString writes a zero terminated name into memory at addr.
+func putString(cpu *DCPU, addr uint16, text string) {
+	for i := 0; i < len(text); i++ {
+		cpu.Mem.RAM[int(addr)+i] = uint16(text[i])
+	}
+	cpu.Mem.RAM[int(addr)+len(text)] = 0
+}
+
+func TestHostFSFiles(t *testing.T) {
+	storage := NewMemStorage()
+	cpu, hfs := newTestHostFS(storage)
+	putString(cpu, 0x100, "src/a.txt")
+
+	// Text files are a byte to a word.
+	if a := hostfsHWI(cpu, hfs, HOSTFS_OPEN, HOSTFS_MODE_WRITE|HOSTFS_MODE_TEXT, 0, 0x100, 0); a != HOSTFS_ERROR_NONE || cpu.Reg[1] != 1 {
+		t.Fatalf("open for writing: error %d, handle %d", a, cpu.Reg[1])
+	}
+	putString(cpu, 0x200, "hello")
+	if a := hostfsHWI(cpu, hfs, HOSTFS_WRITE, 1, 5, 0x200, 0); a != HOSTFS_ERROR_NONE || cpu.Reg[2] != 5 {
+		t.Fatalf("write: error %d, %d words", a, cpu.Reg[2])
+	}
+	hostfsHWI(cpu, hfs, HOSTFS_CLOSE, 1, 0, 0, 0)
+	if got := string(storage.Export()["src/a.txt"]); got != "hello" {
+		t.Errorf("wrote %q", got)
+	}
+
+	// Other files are two bytes to a word, big endian.
+	hostfsHWI(cpu, hfs, HOSTFS_OPEN, HOSTFS_MODE_APPEND, 0, 0x100, 0)
+	cpu.Mem.RAM[0x300] = 0x4142
+	hostfsHWI(cpu, hfs, HOSTFS_WRITE, 1, 1, 0x300, 0)
+	hostfsHWI(cpu, hfs, HOSTFS_CLOSE, 1, 0, 0, 0)
+	if got := string(storage.Export()["src/a.txt"]); got != "helloAB" {
+		t.Errorf("appended to make %q", got)
+	}
+	if a := hostfsHWI(cpu, hfs, HOSTFS_STAT, 0, 0, 0x100, 0); a != HOSTFS_ERROR_NONE || cpu.Reg[1] != 7 || cpu.Reg[2] != 0 {
+		t.Errorf("stat: error %d, size %d:%d", a, cpu.Reg[2], cpu.Reg[1])
+	}
+
+	// The odd byte at the end reads as a word of its own.
+	hostfsHWI(cpu, hfs, HOSTFS_OPEN, HOSTFS_MODE_READ, 0, 0x100, 0)
+	hostfsHWI(cpu, hfs, HOSTFS_SEEK, 1, 0, 1, 0)
+	if a := hostfsHWI(cpu, hfs, HOSTFS_READ, 1, 10, 0x400, 0); a != HOSTFS_ERROR_NONE || cpu.Reg[2] != 3 {
+		t.Fatalf("read: error %d, %d words", a, cpu.Reg[2])
+	}
+	for i, want := range []uint16{0x6c6c, 0x6f41, 0x4200} {
+		if got := cpu.Mem.RAM[0x400+i]; got != want {
+			t.Errorf("word %d read as %04x, want %04x", i, got, want)
+		}
+	}
+	if a := hostfsHWI(cpu, hfs, HOSTFS_READ, 1, 10, 0x400, 0); a != HOSTFS_ERROR_NONE || cpu.Reg[2] != 0 {
+		t.Errorf("read at the end: error %d, %d words", a, cpu.Reg[2])
+	}
+	if a := hostfsHWI(cpu, hfs, HOSTFS_WRITE, 1, 1, 0x300, 0); a != HOSTFS_ERROR_PROTECTED {
+		t.Errorf("write to a file open for reading: error %d", a)
+	}
+
+	// Opening for writing empties the file.
+	hostfsHWI(cpu, hfs, HOSTFS_OPEN, HOSTFS_MODE_WRITE, 0, 0x100, 0)
+	if handle := cpu.Reg[1]; handle != 2 || storage.Length("src/a.txt") != 0 {
+		t.Errorf("reopened as %d, %d bytes long", handle, storage.Length("src/a.txt"))
+	}
+
+	putString(cpu, 0x100, "src/a.txt")
+	if a := hostfsHWI(cpu, hfs, HOSTFS_DELETE, 0, 0, 0x100, 0); a != HOSTFS_ERROR_NONE || storage.Exists("src/a.txt") {
+		t.Errorf("delete: error %d", a)
+	}
+}
+
+func TestHostFSList(t *testing.T) {
+	storage := NewMemStorageFrom(map[string][]byte{"b": {}, "src/a.txt": {}, "src/b.txt": {}})
+	cpu, hfs := newTestHostFS(storage)
+	putString(cpu, 0x100, "src/")
+	for i, want := range []string{"src/a.txt", "src/b.txt"} {
+		if a := hostfsHWI(cpu, hfs, HOSTFS_LIST, uint16(i), 16, 0x100, 0x500); a != HOSTFS_ERROR_NONE || cpu.Reg[2] != uint16(len(want)) {
+			t.Fatalf("listing %d: error %d, length %d", i, a, cpu.Reg[2])
+		}
+		for j := 0; j <= len(want); j++ {
+			var c uint16
+			if j < len(want) {
+				c = uint16(want[j])
+			}
+			if cpu.Mem.RAM[0x500+j] != c {
+				t.Errorf("listing %d: word %d is %d, want %d", i, j, cpu.Mem.RAM[0x500+j], c)
+			}
+		}
+	}
+	if a := hostfsHWI(cpu, hfs, HOSTFS_LIST, 2, 16, 0x100, 0x500); a != HOSTFS_ERROR_NOT_FOUND {
+		t.Errorf("listing past the end: error %d", a)
+	}
+
+	// Names that do not fit are cut short, but the full length is returned.
+	cpu.Mem.RAM[0x504] = 0xFFFF
+	hostfsHWI(cpu, hfs, HOSTFS_LIST, 0, 4, 0x100, 0x500)
+	if cpu.Reg[2] != 9 || cpu.Mem.RAM[0x502] != 'c' || cpu.Mem.RAM[0x503] != 0 || cpu.Mem.RAM[0x504] != 0xFFFF {
+		t.Errorf("short buffer: length %d, buffer %v", cpu.Reg[2], cpu.Mem.RAM[0x500:0x505])
+	}
+
+	putString(cpu, 0x100, "../")
+	if a := hostfsHWI(cpu, hfs, HOSTFS_LIST, 0, 16, 0x100, 0x500); a != HOSTFS_ERROR_BAD_NAME {
+		t.Errorf("listing outside: error %d", a)
+	}
+}
+
+func TestHostFSErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	jail, _ := newTestJail(t, dir, JailOptions{Quota: 4})
+	for _, test := range []struct {
+		name    string
+		storage Storage
+		a, b    uint16
+		file    string
+		want    uint16
+	}{
+		{"missing", NewMemStorage(), HOSTFS_OPEN, HOSTFS_MODE_READ, "nope", HOSTFS_ERROR_NOT_FOUND},
+		{"outside", NewMemStorage(), HOSTFS_OPEN, HOSTFS_MODE_WRITE, "../x", HOSTFS_ERROR_BAD_NAME},
+		{"empty name", NewMemStorage(), HOSTFS_STAT, 0, "", HOSTFS_ERROR_BAD_NAME},
+		{"bad mode", NewMemStorage(), HOSTFS_OPEN, 3, "x", HOSTFS_ERROR_NOT_SUPPORTED},
+		{"read only", readOnlyMem{NewMemStorage()}, HOSTFS_OPEN, HOSTFS_MODE_WRITE, "x", HOSTFS_ERROR_PROTECTED},
+		{"broken", failingMem{NewMemStorage(), errors.New("disk on fire")}, HOSTFS_OPEN, HOSTFS_MODE_WRITE, "x", HOSTFS_ERROR_BROKEN},
+		{"stat missing", jail, HOSTFS_STAT, 0, "nope", HOSTFS_ERROR_NOT_FOUND},
+		{"delete missing", jail, HOSTFS_DELETE, 0, "nope", HOSTFS_ERROR_NOT_FOUND},
+		{"bad handle", NewMemStorage(), HOSTFS_CLOSE, 9, "", HOSTFS_ERROR_BAD_HANDLE},
+		{"unopened handle", NewMemStorage(), HOSTFS_READ, 1, "", HOSTFS_ERROR_BAD_HANDLE},
+		{"seek unopened", NewMemStorage(), HOSTFS_SEEK, 1, "", HOSTFS_ERROR_BAD_HANDLE},
+	} {
+		cpu, hfs := newTestHostFS(test.storage)
+		putString(cpu, 0x100, test.file)
+		if a := hostfsHWI(cpu, hfs, test.a, test.b, 1, 0x100, 0); a != test.want {
+			t.Errorf("%s: error %d, want %d", test.name, a, test.want)
+		}
+	}
+
+	cpu, hfs := newTestHostFS(jail)
+	putString(cpu, 0x100, "big")
+	hostfsHWI(cpu, hfs, HOSTFS_OPEN, HOSTFS_MODE_WRITE, 0, 0x100, 0)
+	if a := hostfsHWI(cpu, hfs, HOSTFS_WRITE, cpu.Reg[1], 20, 0x300, 0); a != HOSTFS_ERROR_FULL {
+		t.Errorf("writing past the quota: error %d", a)
+	}
+}
+
+func TestHostFSHandles(t *testing.T) {
+	cpu, hfs := newTestHostFS(NewMemStorageFrom(map[string][]byte{"a": {}}))
+	putString(cpu, 0x100, "a")
+	for i := 1; i <= HostFSHandles; i++ {
+		if a := hostfsHWI(cpu, hfs, HOSTFS_OPEN, HOSTFS_MODE_READ, 0, 0x100, 0); a != HOSTFS_ERROR_NONE || cpu.Reg[1] != uint16(i) {
+			t.Fatalf("open %d: error %d, handle %d", i, a, cpu.Reg[1])
+		}
+	}
+	if a := hostfsHWI(cpu, hfs, HOSTFS_OPEN, HOSTFS_MODE_READ, 0, 0x100, 0); a != HOSTFS_ERROR_NO_HANDLES {
+		t.Errorf("open with every handle in use: error %d", a)
+	}
+	hostfsHWI(cpu, hfs, HOSTFS_CLOSE, 3, 0, 0, 0)
+	if hostfsHWI(cpu, hfs, HOSTFS_OPEN, HOSTFS_MODE_READ, 0, 0x100, 0); cpu.Reg[1] != 3 {
+		t.Errorf("reopened as handle %d, want 3", cpu.Reg[1])
+	}
+	hfs.Reset()
+	if hostfsHWI(cpu, hfs, HOSTFS_OPEN, HOSTFS_MODE_READ, 0, 0x100, 0); cpu.Reg[1] != 1 {
+		t.Errorf("opened as handle %d after a reset, want 1", cpu.Reg[1])
+	}
+}
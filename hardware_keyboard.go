@@ -1,4 +1,10 @@
-package gemu 
+package gemu
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
 
 const (
 	CLEAR_BUFFER uint16 = 0
@@ -8,6 +14,37 @@ const (
 	SET_MODE            = 4
 )
 
+const (
+	KEY_BACKSPACE uint16 = 0x10
+	KEY_RETURN           = 0x11
+	KEY_INSERT           = 0x12
+	KEY_DELETE           = 0x13
+	KEY_UP               = 0x80
+	KEY_DOWN             = 0x81
+	KEY_LEFT             = 0x82
+	KEY_RIGHT            = 0x83
+	KEY_SHIFT            = 0x90
+	KEY_CONTROL          = 0x91
+)
+
+const KeyBufferSize = 8
+
+// ValidKey reports whether key is one of the key codes of the Generic
+// Keyboard spec.
+func ValidKey(key uint16) bool {
+	switch {
+	case key >= KEY_BACKSPACE && key <= KEY_DELETE:
+		return true
+	case key >= 0x20 && key <= 0x7f:
+		return true
+	case key >= KEY_UP && key <= KEY_RIGHT:
+		return true
+	case key == KEY_SHIFT || key == KEY_CONTROL:
+		return true
+	}
+	return false
+}
+
 var keyboardClass = &HardwareClass{
 	Name:  "keyboard",
 	Desc:  "Generic Keyboard",
@@ -23,10 +60,21 @@ func init() {
 type Keyboard struct {
 	Hardware
 	keycount  int
-	keybuffer [8]uint8
-	keydown   [8]uint8
+	keybuffer [KeyBufferSize]uint16
+	keydown   [KeyBufferSize]uint16
 	interrupt uint16
 	mode      uint16
+
+	// paste is filled by Paste from any goroutine and fed into the buffer
+	// from the tick loop.
+	pasteMu      sync.Mutex
+	paste        []uint16
+	pastePending int32
+}
+
+// Paster is implemented by key inputs that accept bulk text.
+type Paster interface {
+	Paste(text string) int
 }
 
 func NewKeyboard() *Keyboard {
@@ -41,20 +89,17 @@ func (K *Keyboard) HWI(D *DCPU) {
 		K.keycount = 0
 	case GET_NEXT:
 		if K.keycount > 0 {
-			D.Reg[2] = uint16(K.keybuffer[0])
-			for i := 0; i < 7; i++ {
-				K.keybuffer[i] = K.keybuffer[i+1]
-			}
+			D.Reg[2] = K.keybuffer[0]
+			copy(K.keybuffer[:], K.keybuffer[1:])
 			K.keycount--
 		} else {
 			D.Reg[2] = 0
 		}
+		K.feedPaste()
 	case CHECK_KEY:
 		D.Reg[2] = 0
-		for i := 0; i < 7; i++ {
-			if K.keydown[i] == uint8(D.Reg[1]) {
-				D.Reg[2] = 1
-			}
+		if D.Reg[1] != 0 && K.IsDown(D.Reg[1]) {
+			D.Reg[2] = 1
 		}
 	case SET_INT:
 		K.interrupt = D.Reg[1]
@@ -67,33 +112,49 @@ func (K *Keyboard) HWI(D *DCPU) {
 	}
 }
 
+// IsDown reports whether key is currently held.
+func (K *Keyboard) IsDown(key uint16) bool {
+	for _, down := range K.keydown {
+		if down == key {
+			return true
+		}
+	}
+	return false
+}
+
+// RawKey reports a key being pressed or released.  Every key is tracked for
+// CHECK_KEY.  In mode 1 presses and releases (with bit 15 set) are queued,
+// in mode 0 only presses of keys from 0x80 up, such as the arrows, Shift and
+// Control, are, as typed text arrives through ParsedKey.
 func (K *Keyboard) RawKey(key uint16, state bool) {
-	if key >= 0x80 || K.mode == 1 {
-		if state {
+	if state {
+		if !K.IsDown(key) {
 			handled := false
-			for i := 0; i < 8; i++ {
+			for i := range K.keydown {
 				if K.keydown[i] == 0 {
-					K.keydown[i] = uint8(key)
+					K.keydown[i] = key
 					handled = true
 					break
 				}
 			}
 			if !handled {
-				K.keydown[7] = uint8(key)
+				K.keydown[KeyBufferSize-1] = key
 			}
-		} else {
-			for i := 0; i < 8; i++ {
-				if K.keydown[i] == uint8(key) {
-					K.keydown[i] = 0
-				}
+		}
+	} else {
+		for i := range K.keydown {
+			if K.keydown[i] == key {
+				K.keydown[i] = 0
 			}
 		}
+	}
+	if K.mode == 1 {
 		if !state {
 			key |= 0x8000
 		}
-		if state || K.mode == 1 {
-			K.queueKey(key)
-		}
+		K.queueKey(key)
+	} else if state && key >= 0x80 {
+		K.queueKey(key)
 	}
 }
 
@@ -103,13 +164,88 @@ func (K *Keyboard) ParsedKey(key uint16) {
 	}
 }
 
+// Pending returns the number of keys waiting in the buffer.
+func (K *Keyboard) Pending() int {
+	return K.keycount
+}
+
+// Paste queues text to be typed.  It is safe to call from any goroutine.
+// Keys are moved into the buffer on the next tick and then as the guest
+// takes keys out with GET_NEXT, so long texts are not lost.  Newlines become
+// Return and characters without a key code are dropped.  It returns the
+// number of keys queued.
+func (K *Keyboard) Paste(text string) int {
+	keys := pasteKeys(text)
+	K.pasteMu.Lock()
+	K.paste = append(K.paste, keys...)
+	atomic.StoreInt32(&K.pastePending, int32(len(K.paste)))
+	K.pasteMu.Unlock()
+	return len(keys)
+}
+
+func pasteKeys(text string) []uint16 {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	keys := []uint16{}
+	for _, r := range text {
+		if r == '\r' {
+			r = '\n'
+		}
+		code, ok := RuneCode(r)
+		if !ok || code == KEY_BACKSPACE {
+			continue
+		}
+		keys = append(keys, code)
+	}
+	return keys
+}
+
+// Pasting returns the number of pasted keys not yet in the buffer.
+func (K *Keyboard) Pasting() int {
+	return int(atomic.LoadInt32(&K.pastePending))
+}
+
+func (K *Keyboard) CancelPaste() {
+	K.pasteMu.Lock()
+	K.paste = nil
+	atomic.StoreInt32(&K.pastePending, 0)
+	K.pasteMu.Unlock()
+}
+
+func (K *Keyboard) Tick(ticks int) {
+	if atomic.LoadInt32(&K.pastePending) != 0 {
+		K.feedPaste()
+	}
+}
+
+func (K *Keyboard) feedPaste() {
+	K.pasteMu.Lock()
+	defer K.pasteMu.Unlock()
+	defer func() { atomic.StoreInt32(&K.pastePending, int32(len(K.paste))) }()
+	for len(K.paste) > 0 {
+		key := K.paste[0]
+		if K.mode == 1 {
+			if K.keycount > KeyBufferSize-2 {
+				return
+			}
+			K.queueKey(key)
+			K.queueKey(key | 0x8000)
+		} else {
+			if K.keycount >= KeyBufferSize {
+				return
+			}
+			K.queueKey(key)
+		}
+		K.paste = K.paste[1:]
+	}
+}
+
 func (K *Keyboard) queueKey(key uint16) {
-	if K.keycount < 8 {
-		K.keybuffer[K.keycount] = uint8(key)
+	if K.keycount < KeyBufferSize {
+		K.keybuffer[K.keycount] = key
 		K.keycount++
 	} else {
 		copy(K.keybuffer[:], K.keybuffer[1:])
-		K.keybuffer[7] = uint8(key)
+		K.keybuffer[KeyBufferSize-1] = key
 	}
 	if K.interrupt != 0 {
 		if K.Up != nil {
@@ -122,6 +258,7 @@ func (K *Keyboard) queueKey(key uint16) {
 
 func (K *Keyboard) Reset() {
 	K.keycount = 0
+	K.CancelPaste()
 	for i := range K.keydown {
 		K.keydown[i] = 0
 	}
@@ -1,5 +1,9 @@
 package gemu
 
+import (
+	"strings"
+)
+
 var LemDefFont = []uint16{
 	0xffff, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff,
 	0x242e, 0x2400, 0x082A, 0x0800, 0x0008, 0x0000, 0x0808, 0x0808,
@@ -141,3 +145,119 @@ func (L *Lem1802) IsDirty() bool {
 func (L *Lem1802) ClearDirty() {
 	L.NeedSync = false
 }
+
+const (
+	LemWidth  = 32
+	LemHeight = 12
+)
+
+// LemUnknownChar is reported for cells whose glyph does not match any
+// character of the default font.
+const LemUnknownChar = '?'
+
+type LemCell struct {
+	Char  byte
+	Fg    uint16
+	Bg    uint16
+	Blink bool
+}
+
+type LemScreen struct {
+	Cells   [LemHeight][LemWidth]LemCell
+	Palette [16]uint16
+	Border  uint16
+}
+
+var lemGlyphChars map[uint32]byte
+
+func init() {
+	lemGlyphChars = make(map[uint32]byte)
+	addGlyph := func(c int) {
+		glyph := uint32(LemDefFont[c*2])<<16 | uint32(LemDefFont[c*2+1])
+		if _, ok := lemGlyphChars[glyph]; !ok {
+			lemGlyphChars[glyph] = byte(c)
+		}
+	}
+	for c := 0x20; c < 0x7f; c++ {
+		addGlyph(c)
+	}
+	for c := 0; c < 0x20; c++ {
+		addGlyph(c)
+	}
+	addGlyph(0x7f)
+}
+
+// Screen decodes the current display memory into characters and colours.
+// With the default font cells map directly to ASCII, with a custom font the
+// glyph bitmaps are matched against the default font.  Cells whose
+// foreground and background colours are equal are reported as spaces.
+func (L *Lem1802) Screen() *LemScreen {
+	S := &LemScreen{Border: L.Border & 0xf}
+	for y := range S.Cells {
+		for x := range S.Cells[y] {
+			S.Cells[y][x].Char = ' '
+		}
+	}
+	copy(S.Palette[:], LemDefPal)
+	mem := L.GetMem()
+	if mem == nil {
+		return S
+	}
+	ram := mem.GetRaw()
+	if L.PalMem != 0 {
+		for i := range S.Palette {
+			S.Palette[i] = ram[(int(L.PalMem)+i)&0xFFFF]
+		}
+	}
+	if L.DspMem == 0 {
+		return S
+	}
+	for i := 0; i < LemWidth*LemHeight; i++ {
+		vtw := ram[(int(L.DspMem)+i)&0xFFFF]
+		cell := LemCell{
+			Char:  byte(vtw & 0x7f),
+			Fg:    (vtw >> 12) & 0x0f,
+			Bg:    (vtw >> 8) & 0x0f,
+			Blink: vtw&0x80 != 0,
+		}
+		if L.FontMem != 0 {
+			addr := int(L.FontMem) + int(cell.Char)*2
+			glyph := uint32(ram[addr&0xFFFF])<<16 | uint32(ram[(addr+1)&0xFFFF])
+			if c, ok := lemGlyphChars[glyph]; ok {
+				cell.Char = c
+			} else if c, ok := lemGlyphChars[^glyph]; ok {
+				cell.Char = c
+				cell.Fg, cell.Bg = cell.Bg, cell.Fg
+			} else {
+				cell.Char = LemUnknownChar
+			}
+		}
+		if S.Palette[cell.Fg] == S.Palette[cell.Bg] {
+			cell.Char = ' '
+		}
+		S.Cells[i/LemWidth][i%LemWidth] = cell
+	}
+	return S
+}
+
+// Lines returns the screen as text, one string per row.  Characters outside
+// the printable ASCII range are replaced by spaces.
+func (S *LemScreen) Lines() []string {
+	lines := make([]string, LemHeight)
+	for y := range S.Cells {
+		line := make([]byte, LemWidth)
+		for x, cell := range S.Cells[y] {
+			if cell.Char < 0x20 || cell.Char > 0x7e {
+				line[x] = ' '
+			} else {
+				line[x] = cell.Char
+			}
+		}
+		lines[y] = string(line)
+	}
+	return lines
+}
+
+func (S *LemScreen) String() string {
+	return strings.Join(S.Lines(), "\n")
+}
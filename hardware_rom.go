@@ -1,6 +1,10 @@
 package gemu
 
 import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"log"
 	"reflect"
 	"unsafe"
 )
@@ -20,34 +24,126 @@ func init() {
 type ROM struct {
 	Hardware
 	Data []uint16
+	// WriteEnable writes what the guest flashes back to Image.  Without it
+	// flashing only changes the ROM in memory.
+	WriteEnable bool
+	Image       string
+
+	storage *ImageStorage
+}
+
+type RomOptions struct {
+	// Size is the ROM size in words.  Shorter images are padded with zeros,
+	// 0 means the size of the image.
+	Size        int
+	WriteEnable bool
+	// Order is the byte order of a raw image, guessed from its contents by
+	// default.
+	Order ImageOrder
 }
 
-func NewRom(romImage string, flip bool) *ROM {
-	rom := &ROM{}
+func NewRom(romImage string) (*ROM, error) {
+	return NewRomWith(romImage, RomOptions{})
+}
+
+// NewRomWith loads romImage, in whichever byte order it is stored.  An image
+// whose header has a checksum has to match it.
+func NewRomWith(romImage string, opts RomOptions) (*ROM, error) {
+	rom := &ROM{WriteEnable: opts.WriteEnable, Image: romImage}
 	rom.Class = romClass
-	storage := defaultStorage
-	if flip {
-		storage = NewFlipStorage(storage)
+	rom.storage = NewImageStorage(defaultStorage)
+	rom.storage.RawOrder = opts.Order
+	if !rom.storage.Exists(romImage) {
+		return nil, fmt.Errorf("rom image %s does not exist", romImage)
+	}
+	length := rom.storage.Length(romImage) / 2
+	size := opts.Size
+	if size == 0 {
+		size = length
+	}
+	if length > size {
+		return nil, fmt.Errorf("rom image %s is %d words, larger than the %d word rom", romImage, length, size)
+	}
+	if size == 0 || size > 0x10000 {
+		return nil, fmt.Errorf("bad rom size %d", size)
+	}
+	rom.Data = make([]uint16, size)
+	if length > 0 {
+		if _, err := AsStorageV2(rom.storage).ReadAt(context.Background(), romImage, wordBytes(rom.Data[:length]), 0); err != nil {
+			return nil, fmt.Errorf("reading rom image %s: %v", romImage, err)
+		}
+	}
+	return rom, nil
+}
+
+func wordBytes(words []uint16) []byte {
+	if len(words) == 0 {
+		return nil
 	}
-	if storage.Exists(romImage) {
-		rom.Data = make([]uint16, storage.Length(romImage)/2)
-		rawData := []byte{}
-		bytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&rawData))
-		bytesHeader.Data = uintptr(unsafe.Pointer(&rom.Data[0]))
-		bytesHeader.Len = len(rom.Data) * 2
-		bytesHeader.Cap = len(rom.Data) * 2
-		storage.Read(romImage, 0, rawData)
+	rawData := []byte{}
+	bytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&rawData))
+	bytesHeader.Data = uintptr(unsafe.Pointer(&words[0]))
+	bytesHeader.Len = len(words) * 2
+	bytesHeader.Cap = len(words) * 2
+	return rawData
+}
+
+// Checksum returns the CRC-32 of the ROM contents as big endian words.
+func (R *ROM) Checksum() uint32 {
+	data := make([]byte, len(R.Data)*2)
+	for i, word := range R.Data {
+		data[i*2], data[i*2+1] = byte(word>>8), byte(word)
 	}
-	return rom
+	return crc32.ChecksumIEEE(data)
 }
 
+// save writes the ROM back to its image.  Images with a header keep it,
+// with the checksum of the new contents.  Images in read only storage, like
+// the built in ones, are only changed in memory.
+func (R *ROM) save() error {
+	if IsReadOnly(R.storage, R.Image) {
+		return nil
+	}
+	header := R.storage.Header(R.Image)
+	if header == nil {
+		_, err := R.storage.WriteAt(context.Background(), R.Image, wordBytes(R.Data), 0)
+		return err
+	}
+	defer R.storage.Forget(R.Image)
+	return WriteImage(R.storage.Storage, R.Image, *header, false, wordBytes(R.Data))
+}
+
+// HWI takes the operation in A:
+//
+//	0 copies the ROM to RAM and jumps to it
+//	1 flashes the ROM from RAM starting at B, wrapping at the end of RAM.
+//	  C is set to 1, or to 0 if the ROM is write enabled and the image
+//	  could not be written back.
+//	2 B and C are set to the low and high words of the checksum
+//	3 B is set to the size of the ROM in words
 func (R *ROM) HWI(D *DCPU) {
 	switch D.Reg[0] {
 	case 0:
 		D.Mem.LoadMem(R.Data)
 		D.PC = 0
 	case 1:
-		copy(R.Data, D.Mem.GetRaw()[D.Reg[1]:])
+		ram := D.Mem.GetRaw()
+		for i := range R.Data {
+			R.Data[i] = ram[(int(D.Reg[1])+i)&0xFFFF]
+		}
+		D.Reg[2] = 1
+		if !R.WriteEnable {
+			return
+		}
+		if err := R.save(); err != nil {
+			log.Println("Flashing rom failed:", err)
+			D.Reg[2] = 0
+		}
+	case 2:
+		crc := R.Checksum()
+		D.Reg[1], D.Reg[2] = uint16(crc), uint16(crc>>16)
+	case 3:
+		D.Reg[1] = uint16(len(R.Data))
 	}
 }
 
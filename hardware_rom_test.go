@@ -0,0 +1,106 @@
+package gemu
+
+import "testing"
+
+// withStorage makes storage the default until the returned function is
+// called.
+func withStorage(storage Storage) func() {
+	old := defaultStorage
+	SetStorage(storage)
+	return func() { SetStorage(old) }
+}
+
+func flashRom(rom *ROM, words ...uint16) uint16 {
+	cpu := NewDCPU(0)
+	// The image wraps around the end of RAM.
+	for i, word := range words {
+		cpu.Mem.RAM[(0xFFFE+i)&0xFFFF] = word
+	}
+	cpu.Reg[0], cpu.Reg[1] = 1, 0xFFFE
+	rom.HWI(cpu)
+	return cpu.Reg[2]
+}
+
+func TestRomLoad(t *testing.T) {
+	storage := NewMemStorageFrom(map[string][]byte{"rom.bin": {0x00, 0x12, 0x00, 0x34}})
+	defer withStorage(storage)()
+	if _, err := NewRom("missing.bin"); err == nil {
+		t.Error("loaded a missing image")
+	}
+	if _, err := NewRomWith("rom.bin", RomOptions{Size: 1}); err == nil {
+		t.Error("loaded an image larger than the rom")
+	}
+	rom, err := NewRomWith("rom.bin", RomOptions{Size: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rom.Data) != 4 || rom.Data[0] != 0x0012 || rom.Data[1] != 0x0034 || rom.Data[2] != 0 {
+		t.Errorf("loaded %04x", rom.Data)
+	}
+	rom, _ = NewRomWith("rom.bin", RomOptions{Order: ImageOrderLittle})
+	if rom.Data[0] != 0x1200 {
+		t.Errorf("little endian image loaded as %04x", rom.Data)
+	}
+}
+
+func TestRomFlashWithoutWriteEnable(t *testing.T) {
+	storage := NewMemStorageFrom(map[string][]byte{"rom.bin": {0x00, 0x12, 0x00, 0x34}})
+	defer withStorage(storage)()
+	rom, _ := NewRomWith("rom.bin", RomOptions{Size: 4})
+	if c := flashRom(rom, 1, 2, 3, 4); c != 1 {
+		t.Errorf("flashing returned %d", c)
+	}
+	if rom.Data[0] != 1 || rom.Data[3] != 4 {
+		t.Errorf("flashed %04x", rom.Data)
+	}
+	if storage.Length("rom.bin") != 4 {
+		t.Error("the image was written without -romwrite")
+	}
+}
+
+func TestRomFlashChecksum(t *testing.T) {
+	storage := NewMemStorage()
+	defer withStorage(storage)()
+	header := ImageHeader{Media: ImageMediaROM}
+	if err := WriteImage(storage, "rom.img", header, false, make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	rom, err := NewRomWith("rom.img", RomOptions{WriteEnable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := flashRom(rom, 1, 2, 3, 4); c != 1 {
+		t.Fatalf("flashing returned %d", c)
+	}
+	stored, err := ReadImageHeader(storage, "rom.img")
+	if err != nil || !stored.Checksummed || stored.Checksum != rom.Checksum() || stored.Media != ImageMediaROM {
+		t.Fatalf("header after flashing %+v, %v", stored, err)
+	}
+	if storage.Exists("rom.img.crc32") {
+		t.Error("checksum written next to the image")
+	}
+	reloaded, err := NewRom("rom.img")
+	if err != nil || reloaded.Data[3] != 4 {
+		t.Fatalf("reloaded %v, %v", reloaded, err)
+	}
+
+	// Corrupt the last word.
+	storage.Write("rom.img", ImageHeaderSize+7, []byte{9})
+	if _, err := NewRom("rom.img"); err == nil {
+		t.Error("loaded an image that fails its checksum")
+	}
+}
+
+func TestRomFlashRaw(t *testing.T) {
+	storage := NewMemStorageFrom(map[string][]byte{"rom.bin": make([]byte, 4)})
+	defer withStorage(storage)()
+	rom, _ := NewRomWith("rom.bin", RomOptions{WriteEnable: true, Order: ImageOrderBig})
+	if c := flashRom(rom, 0x1234, 0x5678); c != 1 {
+		t.Fatalf("flashing returned %d", c)
+	}
+	raw := make([]byte, 4)
+	storage.Read("rom.bin", 0, raw)
+	if raw[0] != 0x12 || raw[3] != 0x78 || storage.Length("rom.bin") != 4 {
+		t.Errorf("raw image is % x after flashing", raw)
+	}
+}
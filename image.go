@@ -0,0 +1,244 @@
+package gemu
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Images may start with a header describing them.  It is ImageHeaderSize
+// bytes, big endian:
+//
+//	0  "GEMUIMG1"
+//	8  flags
+//	10 media
+//	12 words per sector
+//	14 cylinders
+//	16 heads
+//	18 sectors per track
+//	20 CRC-32 of the data, as stored
+//	24 reserved, zero
+//
+// The image data follows it.  Images without a header are raw words, and
+// their byte order is guessed from their contents.
+const (
+	ImageMagic      = "GEMUIMG1"
+	ImageHeaderSize = 32
+)
+
+const (
+	ImageLittleEndian   uint16 = 0x0001
+	ImageWriteProtected        = 0x0002
+	ImageChecksummed           = 0x0004
+)
+
+type ImageMedia uint16
+
+const (
+	ImageMediaUnknown ImageMedia = iota
+	ImageMediaROM
+	ImageMediaFloppy
+	ImageMediaHardDisk
+	ImageMediaEEPROM
+)
+
+var imageMediaNames = []string{"unknown", "rom", "floppy", "harddisk", "eeprom"}
+
+func (M ImageMedia) String() string {
+	if int(M) < len(imageMediaNames) {
+		return imageMediaNames[M]
+	}
+	return fmt.Sprintf("media%d", uint16(M))
+}
+
+func ParseImageMedia(name string) (ImageMedia, error) {
+	for i, media := range imageMediaNames {
+		if media == name {
+			return ImageMedia(i), nil
+		}
+	}
+	return ImageMediaUnknown, fmt.Errorf("unknown media %s", name)
+}
+
+// ImageOrder is the byte order raw images are taken to be stored in.
+// Images with a header are always read in the order it gives.
+type ImageOrder int
+
+const (
+	ImageOrderAuto ImageOrder = iota
+	ImageOrderBig
+	ImageOrderLittle
+)
+
+var imageOrderNames = []string{"auto", "big", "little"}
+
+func (O ImageOrder) String() string {
+	if O >= 0 && int(O) < len(imageOrderNames) {
+		return imageOrderNames[O]
+	}
+	return fmt.Sprintf("order%d", int(O))
+}
+
+func ParseImageOrder(name string) (ImageOrder, error) {
+	for i, order := range imageOrderNames {
+		if order == name {
+			return ImageOrder(i), nil
+		}
+	}
+	return ImageOrderAuto, fmt.Errorf("unknown byte order %s", name)
+}
+
+var (
+	ErrNoImageHeader = errors.New("image has no header")
+	ErrImageChecksum = errors.New("image does not match its checksum")
+)
+
+type ImageHeader struct {
+	Media          ImageMedia
+	LittleEndian   bool
+	WriteProtected bool
+	Geometry       DiskGeometry
+	// Checksum is only kept while Checksummed is set.  Writing to an image
+	// through an ImageStorage clears it.
+	Checksummed bool
+	Checksum    uint32
+}
+
+func ParseImageHeader(data []byte) (*ImageHeader, error) {
+	if len(data) < ImageHeaderSize || string(data[:len(ImageMagic)]) != ImageMagic {
+		return nil, ErrNoImageHeader
+	}
+	flags := binary.BigEndian.Uint16(data[8:])
+	return &ImageHeader{
+		Media:          ImageMedia(binary.BigEndian.Uint16(data[10:])),
+		LittleEndian:   flags&ImageLittleEndian != 0,
+		WriteProtected: flags&ImageWriteProtected != 0,
+		Geometry: DiskGeometry{
+			SectorWords:     int(binary.BigEndian.Uint16(data[12:])),
+			Cylinders:       int(binary.BigEndian.Uint16(data[14:])),
+			Heads:           int(binary.BigEndian.Uint16(data[16:])),
+			SectorsPerTrack: int(binary.BigEndian.Uint16(data[18:])),
+		},
+		Checksummed: flags&ImageChecksummed != 0,
+		Checksum:    binary.BigEndian.Uint32(data[20:]),
+	}, nil
+}
+
+func (H *ImageHeader) Bytes() []byte {
+	data := make([]byte, ImageHeaderSize)
+	copy(data, ImageMagic)
+	var flags uint16
+	if H.LittleEndian {
+		flags |= ImageLittleEndian
+	}
+	if H.WriteProtected {
+		flags |= ImageWriteProtected
+	}
+	if H.Checksummed {
+		flags |= ImageChecksummed
+	}
+	binary.BigEndian.PutUint16(data[8:], flags)
+	binary.BigEndian.PutUint16(data[10:], uint16(H.Media))
+	binary.BigEndian.PutUint16(data[12:], uint16(H.Geometry.SectorWords))
+	binary.BigEndian.PutUint16(data[14:], uint16(H.Geometry.Cylinders))
+	binary.BigEndian.PutUint16(data[16:], uint16(H.Geometry.Heads))
+	binary.BigEndian.PutUint16(data[18:], uint16(H.Geometry.SectorsPerTrack))
+	if H.Checksummed {
+		binary.BigEndian.PutUint32(data[20:], H.Checksum)
+	}
+	return data
+}
+
+// ReadImageHeader returns the header of item, or ErrNoImageHeader if it is a
+// raw image.
+func ReadImageHeader(storage Storage, item string) (*ImageHeader, error) {
+	if storage.Length(item) < ImageHeaderSize {
+		return nil, ErrNoImageHeader
+	}
+	data := make([]byte, ImageHeaderSize)
+	storage.Read(item, 0, data)
+	return ParseImageHeader(data)
+}
+
+// imageGuessBytes is how much of a raw image its byte order is guessed from.
+const imageGuessBytes = 16384
+
+// GuessBigEndian guesses the byte order of raw image data.  Small numbers and
+// text are common in DCPU code and data, so their high bytes are mostly zero
+// when read the right way round, and most words decode to valid
+// instructions.  Ties, like blank disks, are big endian, the usual order for
+// DCPU images.
+func GuessBigEndian(data []byte) bool {
+	if len(data) > imageGuessBytes {
+		data = data[:imageGuessBytes]
+	}
+	score := 0
+	for i := 0; i+1 < len(data); i += 2 {
+		big := uint16(data[i])<<8 | uint16(data[i+1])
+		little := uint16(data[i+1])<<8 | uint16(data[i])
+		score += wordScore(big) - wordScore(little)
+	}
+	return score >= 0
+}
+
+func wordScore(word uint16) int {
+	score := 0
+	if word&0xFF00 == 0 && word != 0 {
+		score += 2
+	}
+	op := word & 0x1F
+	if op == 0 {
+		switch (word >> 5) & 0x1F {
+		case 0x01, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x10, 0x11, 0x12:
+			score++
+		}
+	} else if op != 0x18 && op != 0x19 && op != 0x1C && op != 0x1D {
+		score++
+	}
+	return score
+}
+
+// ConvertImage copies the image in src to dst, writing it with header, or
+// with just its data in the header's byte order if raw is set.  The byte
+// order of raw sources is guessed.
+func ConvertImage(src Storage, srcItem string, dst Storage, dstItem string, header ImageHeader, raw bool) error {
+	images := NewImageStorage(src)
+	if !images.Exists(srcItem) {
+		return fmt.Errorf("image %s does not exist", srcItem)
+	}
+	data := make([]byte, images.Length(srcItem))
+	if err := images.Load(srcItem, data); err != nil {
+		return err
+	}
+	return WriteImage(dst, dstItem, header, raw, data)
+}
+
+// WriteImage writes data, little endian words, as an image in the byte order
+// given by header, replacing whatever was in item.  Unless raw is set the
+// header is written too, with a checksum.
+func WriteImage(dst Storage, item string, header ImageHeader, raw bool, data []byte) error {
+	stored := append([]byte{}, data...)
+	if !header.LittleEndian {
+		swapBytes(stored)
+	}
+	if !raw {
+		header.Checksummed = true
+		header.Checksum = crc32.ChecksumIEEE(stored)
+		stored = append(header.Bytes(), stored...)
+	}
+	if dst.Exists(item) {
+		if err := TruncateItem(dst, item, 0); err != nil {
+			return fmt.Errorf("cannot overwrite image %s: %v", item, err)
+		}
+	}
+	_, err := AsStorageV2(dst).WriteAt(context.Background(), item, stored, 0)
+	return err
+}
+
+func swapBytes(data []byte) {
+	for i := 0; i+1 < len(data); i += 2 {
+		data[i], data[i+1] = data[i+1], data[i]
+	}
+}
@@ -0,0 +1,109 @@
+package gemu
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// testProgram is some DCPU code: SET A, 0x30; HWI 0; "Hi"; SET PC, 0.
+var testProgram = []uint16{0x7c01, 0x0030, 0x8640, 0x0048, 0x0069, 0x7f81, 0x0000}
+
+func programBytes(order binary.ByteOrder) []byte {
+	data := make([]byte, 2*len(testProgram))
+	for i, word := range testProgram {
+		order.PutUint16(data[2*i:], word)
+	}
+	return data
+}
+
+func TestGuessBigEndian(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"big endian code", programBytes(binary.BigEndian), true},
+		{"little endian code", programBytes(binary.LittleEndian), false},
+		{"big endian text", []byte{0, 'H', 0, 'e', 0, 'l', 0, 'l', 0, 'o'}, true},
+		{"little endian text", []byte{'H', 0, 'e', 0, 'l', 0, 'l', 0, 'o', 0}, false},
+		{"blank", make([]byte, 512), true},
+		{"empty", nil, true},
+		{"odd length", []byte{'H', 0, 'i', 0, 0}, false},
+	} {
+		if got := GuessBigEndian(test.data); got != test.want {
+			t.Errorf("%s: guessed big endian %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// Only the start of an image counts.
+	data := append(programBytes(binary.LittleEndian), make([]byte, imageGuessBytes)...)
+	for i := imageGuessBytes; i+1 < len(data); i += 2 {
+		data[i+1] = 'x'
+	}
+	if GuessBigEndian(data) {
+		t.Error("guessed from past the start of the image")
+	}
+}
+
+func TestImageHeader(t *testing.T) {
+	header := ImageHeader{
+		Media:          ImageMediaHardDisk,
+		LittleEndian:   true,
+		WriteProtected: true,
+		Geometry:       HMU1440,
+		Checksummed:    true,
+		Checksum:       0xDEADBEEF,
+	}
+	data := header.Bytes()
+	if len(data) != ImageHeaderSize || string(data[:len(ImageMagic)]) != ImageMagic {
+		t.Fatalf("header is % x", data)
+	}
+	parsed, err := ParseImageHeader(data)
+	if err != nil || *parsed != header {
+		t.Errorf("parsed %+v, %v, want %+v", parsed, err, header)
+	}
+
+	header.Checksummed = false
+	parsed, _ = ParseImageHeader(header.Bytes())
+	if parsed.Checksummed || parsed.Checksum != 0 {
+		t.Errorf("checksum %x kept without Checksummed", parsed.Checksum)
+	}
+
+	for _, data := range [][]byte{nil, data[:ImageHeaderSize-1], make([]byte, ImageHeaderSize)} {
+		if _, err := ParseImageHeader(data); err != ErrNoImageHeader {
+			t.Errorf("parsing % x: %v", data, err)
+		}
+	}
+}
+
+func TestWriteImageChecksum(t *testing.T) {
+	storage := NewMemStorage()
+	data := programBytes(binary.LittleEndian)
+	// The checksum is of the image as stored, after the header.
+	for _, test := range []struct {
+		header ImageHeader
+		stored []byte
+	}{
+		{ImageHeader{Media: ImageMediaROM}, programBytes(binary.BigEndian)},
+		{ImageHeader{Media: ImageMediaROM, LittleEndian: true}, programBytes(binary.LittleEndian)},
+	} {
+		if err := WriteImage(storage, "image", test.header, false, data); err != nil {
+			t.Fatal(err)
+		}
+		header, err := ReadImageHeader(storage, "image")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := crc32.ChecksumIEEE(test.stored); !header.Checksummed || header.Checksum != want {
+			t.Errorf("little endian %v: checksum %x (checksummed %v), want %x", test.header.LittleEndian, header.Checksum, header.Checksummed, want)
+		}
+	}
+
+	if err := WriteImage(storage, "raw", ImageHeader{}, true, data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadImageHeader(storage, "raw"); err != ErrNoImageHeader {
+		t.Errorf("raw image has a header: %v", err)
+	}
+}
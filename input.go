@@ -0,0 +1,222 @@
+package gemu
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type InputKind int
+
+const (
+	InputRawKey InputKind = iota
+	InputParsedKey
+	InputPaste
+	InputDisk
+	InputTime
+	InputClockEpoch
+	InputWriteProtect
+	InputSwapDisks
+)
+
+var inputKindNames = []string{"key", "char", "paste", "disk", "time", "epoch", "protect", "swap"}
+
+const inputLogMagic = "gemu-input"
+const inputLogVersion = 1
+
+// InputEvent is a single host input to a device, stamped with the machine
+// cycle it was applied at.  Device is the index of the device on the CPU.
+type InputEvent struct {
+	Cycle  uint64
+	Kind   InputKind
+	Device int
+	Key    uint16
+	State  bool
+	Text   string
+	Value  int64
+}
+
+// String formats the event as a line of an input log.
+func (E InputEvent) String() string {
+	prefix := fmt.Sprintf("%d %s %d", E.Cycle, inputKindNames[E.Kind], E.Device)
+	switch E.Kind {
+	case InputRawKey:
+		return fmt.Sprintf("%s 0x%04x %d", prefix, E.Key, inputState(E.State))
+	case InputWriteProtect:
+		return fmt.Sprintf("%s %d", prefix, inputState(E.State))
+	case InputParsedKey:
+		return fmt.Sprintf("%s 0x%04x", prefix, E.Key)
+	case InputPaste, InputDisk:
+		return fmt.Sprintf("%s %s", prefix, strconv.Quote(E.Text))
+	case InputClockEpoch:
+		return fmt.Sprintf("%s %d %s", prefix, E.Value, E.Text)
+	}
+	return fmt.Sprintf("%s %d", prefix, E.Value)
+}
+
+func inputState(state bool) int {
+	if state {
+		return 1
+	}
+	return 0
+}
+
+func ParseInputEvent(line string) (InputEvent, error) {
+	ev := InputEvent{}
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) != 4 {
+		return ev, fmt.Errorf("malformed input event %q", line)
+	}
+	var err error
+	if ev.Cycle, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return ev, err
+	}
+	ev.Kind = -1
+	for kind, name := range inputKindNames {
+		if fields[1] == name {
+			ev.Kind = InputKind(kind)
+		}
+	}
+	if ev.Kind < 0 {
+		return ev, fmt.Errorf("unknown input event %q", fields[1])
+	}
+	if ev.Device, err = strconv.Atoi(fields[2]); err != nil {
+		return ev, err
+	}
+	arg := fields[3]
+	switch ev.Kind {
+	case InputRawKey:
+		args := strings.Fields(arg)
+		if len(args) != 2 {
+			return ev, fmt.Errorf("malformed key event %q", line)
+		}
+		key, err := strconv.ParseUint(args[0], 0, 16)
+		if err != nil {
+			return ev, err
+		}
+		ev.Key, ev.State = uint16(key), args[1] == "1"
+	case InputParsedKey:
+		key, err := strconv.ParseUint(arg, 0, 16)
+		if err != nil {
+			return ev, err
+		}
+		ev.Key = uint16(key)
+	case InputWriteProtect:
+		ev.State = arg == "1"
+	case InputPaste, InputDisk:
+		ev.Text, err = strconv.Unquote(arg)
+	case InputClockEpoch:
+		args := strings.Fields(arg)
+		if len(args) != 2 {
+			return ev, fmt.Errorf("malformed epoch event %q", line)
+		}
+		ev.Value, err = strconv.ParseInt(args[0], 10, 64)
+		ev.Text = args[1]
+	default:
+		ev.Value, err = strconv.ParseInt(arg, 10, 64)
+	}
+	return ev, err
+}
+
+// InputRecorder appends input events to an item in a Storage as they
+// happen, so a log survives the emulator crashing.  Recording stops at the
+// first write that fails, and Err returns the error.
+type InputRecorder struct {
+	storage Storage
+	item    string
+	offset  int
+	err     error
+	mu      sync.Mutex
+}
+
+// NewInputRecorder creates a recorder writing to item.  Storage cannot
+// truncate, so item must not exist yet.
+func NewInputRecorder(storage Storage, item string) (*InputRecorder, error) {
+	if storage.Exists(item) && storage.Length(item) > 0 {
+		return nil, fmt.Errorf("input log %s already exists", item)
+	}
+	return &InputRecorder{storage: storage, item: item}, nil
+}
+
+func (R *InputRecorder) writeLine(line string) {
+	R.mu.Lock()
+	defer R.mu.Unlock()
+	if R.err != nil {
+		return
+	}
+	data := []byte(line + "\n")
+	n, err := AsStorageV2(R.storage).WriteAt(context.Background(), R.item, data, int64(R.offset))
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		R.err = fmt.Errorf("recording input to %s: %v", R.item, err)
+		return
+	}
+	R.offset += len(data)
+}
+
+// Err returns the error that stopped recording, if any.
+func (R *InputRecorder) Err() error {
+	R.mu.Lock()
+	defer R.mu.Unlock()
+	return R.err
+}
+
+func (R *InputRecorder) start(cycle uint64) {
+	R.writeLine(fmt.Sprintf("%s %d %d", inputLogMagic, inputLogVersion, cycle))
+}
+
+func (R *InputRecorder) Record(ev InputEvent) {
+	R.writeLine(ev.String())
+}
+
+// InputLog is a recorded session.  Start is the machine cycle recording
+// began at, which a replay has to start from too.
+type InputLog struct {
+	Start  uint64
+	Events []InputEvent
+}
+
+func ReadInputLog(r io.Reader) (*InputLog, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	if !scanner.Scan() {
+		return nil, errors.New("empty input log")
+	}
+	log := &InputLog{}
+	var magic string
+	var version int
+	if _, err := fmt.Sscanf(scanner.Text(), "%s %d %d", &magic, &version, &log.Start); err != nil || magic != inputLogMagic {
+		return nil, errors.New("not an input log")
+	}
+	if version != inputLogVersion {
+		return nil, fmt.Errorf("unsupported input log version %d", version)
+	}
+	for line := 2; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		ev, err := ParseInputEvent(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("input log line %d: %v", line, err)
+		}
+		log.Events = append(log.Events, ev)
+	}
+	return log, scanner.Err()
+}
+
+func LoadInputLog(storage Storage, item string) (*InputLog, error) {
+	if !storage.Exists(item) {
+		return nil, fmt.Errorf("input log %s does not exist", item)
+	}
+	data := make([]byte, storage.Length(item))
+	storage.Read(item, 0, data)
+	return ReadInputLog(bytes.NewReader(data))
+}
@@ -0,0 +1,352 @@
+package gemu
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var x11Printable = []string{
+	"space", "exclam", "quotedbl", "numbersign", "dollar", "percent", "ampersand", "apostrophe",
+	"parenleft", "parenright", "asterisk", "plus", "comma", "minus", "period", "slash",
+	"0", "1", "2", "3", "4", "5", "6", "7", "8", "9",
+	"colon", "semicolon", "less", "equal", "greater", "question", "at",
+	"A", "B", "C", "D", "E", "F", "G", "H", "I", "J", "K", "L", "M",
+	"N", "O", "P", "Q", "R", "S", "T", "U", "V", "W", "X", "Y", "Z",
+	"bracketleft", "backslash", "bracketright", "asciicircum", "underscore", "grave",
+	"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m",
+	"n", "o", "p", "q", "r", "s", "t", "u", "v", "w", "x", "y", "z",
+	"braceleft", "bar", "braceright", "asciitilde",
+}
+
+var x11Special = []struct {
+	name   string
+	keysym uint32
+	code   uint16
+}{
+	{"BackSpace", 0xff08, KEY_BACKSPACE},
+	{"Return", 0xff0d, KEY_RETURN},
+	{"KP_Enter", 0xff8d, KEY_RETURN},
+	{"Insert", 0xff63, KEY_INSERT},
+	{"KP_Insert", 0xff9e, KEY_INSERT},
+	{"Delete", 0xffff, KEY_DELETE},
+	{"KP_Delete", 0xff9f, KEY_DELETE},
+	{"Up", 0xff52, KEY_UP},
+	{"KP_Up", 0xff97, KEY_UP},
+	{"Down", 0xff54, KEY_DOWN},
+	{"KP_Down", 0xff99, KEY_DOWN},
+	{"Left", 0xff51, KEY_LEFT},
+	{"KP_Left", 0xff96, KEY_LEFT},
+	{"Right", 0xff53, KEY_RIGHT},
+	{"KP_Right", 0xff98, KEY_RIGHT},
+	{"Shift_L", 0xffe1, KEY_SHIFT},
+	{"Shift_R", 0xffe2, KEY_SHIFT},
+	{"Control_L", 0xffe3, KEY_CONTROL},
+	{"Control_R", 0xffe4, KEY_CONTROL},
+	{"KP_Space", 0xff80, ' '},
+	{"KP_Multiply", 0xffaa, '*'},
+	{"KP_Add", 0xffab, '+'},
+	{"KP_Separator", 0xffac, ','},
+	{"KP_Subtract", 0xffad, '-'},
+	{"KP_Decimal", 0xffae, '.'},
+	{"KP_Divide", 0xffaf, '/'},
+	{"KP_Equal", 0xffbd, '='},
+}
+
+var x11Names map[string]uint16
+var x11Keysyms map[uint32]uint16
+
+func init() {
+	x11Names = make(map[string]uint16)
+	x11Keysyms = make(map[uint32]uint16)
+	for i, name := range x11Printable {
+		x11Names[name] = uint16(0x20 + i)
+		x11Keysyms[uint32(0x20+i)] = uint16(0x20 + i)
+	}
+	for _, key := range x11Special {
+		x11Names[key.name] = key.code
+		x11Keysyms[key.keysym] = key.code
+	}
+	for i := 0; i < 10; i++ {
+		x11Names[fmt.Sprintf("KP_%d", i)] = uint16('0' + i)
+		x11Keysyms[uint32(0xffb0+i)] = uint16('0' + i)
+	}
+}
+
+// RuneCode maps a character onto a key code.  Newlines become Return and
+// backspace and DEL become Backspace.
+func RuneCode(r rune) (uint16, bool) {
+	switch {
+	case r == '\n' || r == '\r':
+		return KEY_RETURN, true
+	case r == '\b' || r == 0x7f:
+		return KEY_BACKSPACE, true
+	case r >= 0x20 && r < 0x7f:
+		return uint16(r), true
+	}
+	return 0, false
+}
+
+// KeyNameCode maps an X11 keysym name, as used by tinyfb, or a single
+// character onto a key code.
+func KeyNameCode(name string) (uint16, bool) {
+	if code, ok := x11Names[name]; ok {
+		return code, true
+	}
+	if r, size := utf8.DecodeRuneInString(name); size == len(name) && size > 0 {
+		return RuneCode(r)
+	}
+	return 0, false
+}
+
+// KeysymCode maps a numeric X11 keysym, as used by RFB, onto a key code.
+func KeysymCode(keysym uint32) (uint16, bool) {
+	code, ok := x11Keysyms[keysym]
+	return code, ok
+}
+
+// KeyLayout describes which character each key of a host keyboard layout
+// produces with Shift held.  It is used when the host reports unshifted keys
+// and when characters have to be typed as key presses.  Only keys with
+// Generic Keyboard codes on both levels are listed, so characters like £
+// that the keyboard cannot send are left out.
+//
+// Unsupported: the uk 3 key (£) and the de 3 key (§), which type 3 with
+// Shift held, and the de AltGr layer, whose characters are typed as they
+// arrive from the host but cannot be produced from unshifted keys.
+type KeyLayout struct {
+	Name    string
+	shifted map[rune]rune
+	base    map[rune]rune
+}
+
+func newKeyLayout(name string, pairs string) *KeyLayout {
+	layout := &KeyLayout{Name: name, shifted: make(map[rune]rune), base: make(map[rune]rune)}
+	runes := []rune(pairs)
+	for i := 0; i+1 < len(runes); i += 2 {
+		layout.shifted[runes[i]] = runes[i+1]
+		layout.base[runes[i+1]] = runes[i]
+	}
+	for r := 'a'; r <= 'z'; r++ {
+		layout.shifted[r] = r - 'a' + 'A'
+		layout.base[r-'a'+'A'] = r
+	}
+	return layout
+}
+
+var KeyLayouts = map[string]*KeyLayout{
+	"us": newKeyLayout("us", "1!2@3#4$5%6^7&8*9(0)-_=+[{]}\\|;:'\",<.>/?`~"),
+	"uk": newKeyLayout("uk", "1!2\"4$5%6^7&8*9(0)-_=+[{]};:'@#~,<.>/?\\|"),
+	"de": newKeyLayout("de", "1!2\"4$5%6&7/8(9)0=+*#'<>,;.:-_"),
+}
+
+func LookupKeyLayout(name string) (*KeyLayout, error) {
+	layout, ok := KeyLayouts[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown keyboard layout %q", name)
+	}
+	return layout, nil
+}
+
+// Shift returns the key code produced by key with Shift held.
+func (L *KeyLayout) Shift(key uint16) uint16 {
+	if shifted, ok := L.shifted[rune(key)]; ok {
+		if code, ok := RuneCode(shifted); ok {
+			return code
+		}
+	}
+	return key
+}
+
+// Unshift returns the key that produces key, and whether Shift is needed.
+func (L *KeyLayout) Unshift(key uint16) (uint16, bool) {
+	if base, ok := L.base[rune(key)]; ok {
+		if code, ok := RuneCode(base); ok {
+			return code, true
+		}
+	}
+	return key, false
+}
+
+// KeyInput is anything that accepts key events, usually a Machine's
+// KeyInput.  Frontends call it from their own goroutines, so it has to be
+// safe for concurrent use.
+type KeyInput interface {
+	RawKey(key uint16, state bool)
+	ParsedKey(key uint16)
+}
+
+// HostKeyboard translates host key events into Generic Keyboard events.  It
+// tracks Shift and Control, applies the layout to unshifted keys and
+// optionally repeats held keys, counted in ticks.  Attach it to a Machine as
+// a ticker for key repeat to work.  Its lock only covers its own state, and
+// several HostKeyboards may share an Input.
+type HostKeyboard struct {
+	Input       KeyInput
+	Layout      *KeyLayout
+	RepeatDelay int
+	RepeatRate  int
+
+	mu         sync.Mutex
+	held       map[uint16]bool
+	shift      bool
+	control    bool
+	repeatKey  uint16
+	repeatLeft int
+}
+
+func NewHostKeyboard(input KeyInput, layout *KeyLayout) *HostKeyboard {
+	if layout == nil {
+		layout = KeyLayouts["us"]
+	}
+	return &HostKeyboard{
+		Input:  input,
+		Layout: layout,
+		held:   make(map[uint16]bool),
+	}
+}
+
+func (H *HostKeyboard) Shift() bool {
+	H.mu.Lock()
+	defer H.mu.Unlock()
+	return H.shift
+}
+
+func (H *HostKeyboard) Control() bool {
+	H.mu.Lock()
+	defer H.mu.Unlock()
+	return H.control
+}
+
+func (H *HostKeyboard) baseKey(key uint16) uint16 {
+	base, _ := H.Layout.Unshift(key)
+	return base
+}
+
+func (H *HostKeyboard) key(code uint16, press bool) {
+	switch code {
+	case KEY_SHIFT:
+		H.shift = press
+	case KEY_CONTROL:
+		H.control = press
+	}
+	if press {
+		if H.shift && code < 0x80 {
+			code = H.Layout.Shift(code)
+		}
+		H.held[code] = true
+		H.Input.RawKey(code, true)
+		if code != KEY_SHIFT && code != KEY_CONTROL {
+			H.repeatKey = code
+			H.repeatLeft = H.RepeatDelay
+		}
+		return
+	}
+	// The key may have been pressed with a different Shift state, so
+	// release whatever was produced by the same physical key.
+	base := H.baseKey(code)
+	for held := range H.held {
+		if H.baseKey(held) == base {
+			delete(H.held, held)
+			H.Input.RawKey(held, false)
+			if held == H.repeatKey {
+				H.repeatKey = 0
+			}
+		}
+	}
+}
+
+func (H *HostKeyboard) typed(code uint16) {
+	if code < 0x80 && !H.control {
+		H.Input.ParsedKey(code)
+	}
+}
+
+// Key handles a key press or release named by its X11 keysym name.
+func (H *HostKeyboard) Key(name string, press bool) {
+	code, ok := KeyNameCode(name)
+	if !ok {
+		return
+	}
+	H.mu.Lock()
+	defer H.mu.Unlock()
+	H.key(code, press)
+}
+
+// Char handles typed text, either a single character or an X11 keysym name.
+func (H *HostKeyboard) Char(name string) {
+	code, ok := KeyNameCode(name)
+	if !ok || code >= 0x80 {
+		return
+	}
+	H.mu.Lock()
+	defer H.mu.Unlock()
+	H.Input.ParsedKey(code)
+}
+
+// Keysym handles a numeric X11 keysym event, which stands for both the key
+// and the text it types.
+func (H *HostKeyboard) Keysym(keysym uint32, press bool) {
+	code, ok := KeysymCode(keysym)
+	if !ok {
+		return
+	}
+	H.mu.Lock()
+	defer H.mu.Unlock()
+	H.key(code, press)
+	if press {
+		if H.shift && code < 0x80 {
+			code = H.Layout.Shift(code)
+		}
+		H.typed(code)
+	}
+}
+
+// PressKey presses and releases key.
+func (H *HostKeyboard) PressKey(key uint16) {
+	H.mu.Lock()
+	defer H.mu.Unlock()
+	H.Input.RawKey(key, true)
+	H.typed(key)
+	H.Input.RawKey(key, false)
+}
+
+// TypeRune types a character, holding Shift around it if the layout needs
+// Shift to produce it.  Characters without a key code are dropped.
+func (H *HostKeyboard) TypeRune(r rune) {
+	code, ok := RuneCode(r)
+	if !ok {
+		return
+	}
+	H.mu.Lock()
+	defer H.mu.Unlock()
+	_, shift := H.Layout.Unshift(code)
+	shift = shift && !H.shift
+	if shift {
+		H.Input.RawKey(KEY_SHIFT, true)
+	}
+	H.Input.RawKey(code, true)
+	H.typed(code)
+	H.Input.RawKey(code, false)
+	if shift {
+		H.Input.RawKey(KEY_SHIFT, false)
+	}
+}
+
+func (H *HostKeyboard) Tick(ticks int) {
+	H.mu.Lock()
+	defer H.mu.Unlock()
+	if H.repeatKey == 0 || H.RepeatDelay <= 0 {
+		return
+	}
+	H.repeatLeft -= ticks
+	for H.repeatLeft <= 0 {
+		H.repeatLeft += H.RepeatRate
+		if H.RepeatRate <= 0 {
+			H.repeatLeft = H.RepeatDelay
+		}
+		H.Input.RawKey(H.repeatKey, true)
+		H.typed(H.repeatKey)
+	}
+}
@@ -0,0 +1,371 @@
+package gemu
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TicksPerSecond is the rate a Machine is ticked at to run in real time.
+const TicksPerSecond = 100000
+
+// Machine runs a DCPU together with the devices attached to it from a single
+// tick loop and counts the ticks run so far.
+//
+// Host input sent through the Machine is queued and applied between ticks,
+// stamped with the cycle it was applied at.  That makes a session
+// reproducible: it can be recorded with Record and played back with Replay.
+type Machine struct {
+	CPU     *DCPU
+	Tickers []Ticker
+	Cycles  uint64
+
+	inputMu      sync.Mutex
+	inputs       []InputEvent
+	inputPending int32
+
+	recorder   *InputRecorder
+	replay     *InputLog
+	replayNext int
+	clockTimes map[int][]int64
+}
+
+func NewMachine(cpu *DCPU) *Machine {
+	return &Machine{CPU: cpu}
+}
+
+func (M *Machine) Attach(hw IHardware) {
+	M.CPU.Attach(hw)
+	hw.SetUp(M.CPU)
+	if ticker, ok := hw.(Ticker); ok {
+		M.Tickers = append(M.Tickers, ticker)
+	}
+}
+
+// AddTicker ticks t alongside the devices, for helpers that are not
+// attached hardware.
+func (M *Machine) AddTicker(t Ticker) {
+	M.Tickers = append(M.Tickers, t)
+}
+
+func (M *Machine) Start() {
+	M.CPU.Start()
+}
+
+func (M *Machine) Tick(ticks int) {
+	for l1 := 0; l1 < ticks; l1++ {
+		if atomic.LoadInt32(&M.inputPending) != 0 {
+			M.applyInputs()
+		}
+		if M.replay != nil {
+			M.applyReplay()
+		}
+		M.CPU.Tick(1)
+		for _, ticker := range M.Tickers {
+			ticker.Tick(1)
+		}
+		M.Cycles++
+	}
+}
+
+func (M *Machine) deviceIndex(hw IHardware) int {
+	for i, dev := range M.CPU.Down {
+		if dev == hw {
+			return i
+		}
+	}
+	return -1
+}
+
+// Input queues ev to be applied before the next tick.  It is safe to call
+// from any goroutine.  Input is ignored while a replay is running.
+func (M *Machine) Input(ev InputEvent) {
+	M.inputMu.Lock()
+	M.inputs = append(M.inputs, ev)
+	atomic.StoreInt32(&M.inputPending, 1)
+	M.inputMu.Unlock()
+}
+
+func (M *Machine) applyInputs() {
+	M.inputMu.Lock()
+	inputs := M.inputs
+	M.inputs = nil
+	atomic.StoreInt32(&M.inputPending, 0)
+	M.inputMu.Unlock()
+	if M.replay != nil {
+		return
+	}
+	for _, ev := range inputs {
+		ev.Cycle = M.Cycles
+		M.apply(ev)
+	}
+}
+
+func (M *Machine) apply(ev InputEvent) {
+	if ev.Device < 0 || ev.Device >= len(M.CPU.Down) {
+		return
+	}
+	if M.recorder != nil {
+		M.recorder.Record(ev)
+	}
+	switch dev := M.CPU.Down[ev.Device].(type) {
+	case *Keyboard:
+		switch ev.Kind {
+		case InputRawKey:
+			dev.RawKey(ev.Key, ev.State)
+		case InputParsedKey:
+			dev.ParsedKey(ev.Key)
+		case InputPaste:
+			dev.Paste(ev.Text)
+		}
+	case DiskDrive:
+		switch ev.Kind {
+		case InputDisk:
+			if ev.Text != "" && dev.CurrentDisk() != "" {
+				dev.ChangeDisk("")
+			}
+			dev.ChangeDisk(ev.Text)
+		case InputSwapDisks:
+			M.swapDisks(dev, int(ev.Value))
+		case InputWriteProtect:
+			dev.SetWriteProtect(ev.State)
+		}
+	}
+}
+
+// MachineKeys passes key events for a keyboard through the machine's input
+// queue.  Frontends use it in place of the Keyboard itself.
+type MachineKeys struct {
+	machine *Machine
+	device  int
+}
+
+func (M *Machine) KeyInput(keyboard *Keyboard) *MachineKeys {
+	return &MachineKeys{machine: M, device: M.deviceIndex(keyboard)}
+}
+
+func (K *MachineKeys) RawKey(key uint16, state bool) {
+	K.machine.Input(InputEvent{Kind: InputRawKey, Device: K.device, Key: key, State: state})
+}
+
+func (K *MachineKeys) ParsedKey(key uint16) {
+	K.machine.Input(InputEvent{Kind: InputParsedKey, Device: K.device, Key: key})
+}
+
+func (K *MachineKeys) Paste(text string) int {
+	K.machine.Input(InputEvent{Kind: InputPaste, Device: K.device, Text: text})
+	return len(pasteKeys(text))
+}
+
+// ChangeDisk queues a disk change for drive.  A disk already in the drive is
+// ejected first, so software sees the drive empty in between.
+func (M *Machine) ChangeDisk(drive DiskDrive, disk string) {
+	M.Input(InputEvent{Kind: InputDisk, Device: M.deviceIndex(drive), Text: disk})
+}
+
+// SwapDisks queues exchanging the disks in two drives.
+func (M *Machine) SwapDisks(a, b DiskDrive) {
+	M.Input(InputEvent{Kind: InputSwapDisks, Device: M.deviceIndex(a), Value: int64(M.deviceIndex(b))})
+}
+
+func (M *Machine) swapDisks(drive DiskDrive, other int) {
+	if other < 0 || other >= len(M.CPU.Down) {
+		return
+	}
+	drive2, ok := M.CPU.Down[other].(DiskDrive)
+	if !ok {
+		return
+	}
+	diskA, diskB := drive.CurrentDisk(), drive2.CurrentDisk()
+	if diskA != "" {
+		drive.ChangeDisk("")
+	}
+	if diskB != "" {
+		drive2.ChangeDisk("")
+	}
+	if diskB != "" {
+		drive.ChangeDisk(diskB)
+	}
+	if diskA != "" {
+		drive2.ChangeDisk(diskA)
+	}
+}
+
+// WriteProtect queues setting or clearing the write protection of the disk
+// in drive.
+func (M *Machine) WriteProtect(drive DiskDrive, protect bool) {
+	M.Input(InputEvent{Kind: InputWriteProtect, Device: M.deviceIndex(drive), State: protect})
+}
+
+// Record logs all input from now on to recorder, along with every time the
+// clocks read the host time.  Start recording before the machine is started
+// to record a session from cold boot.  A recording already running is
+// stopped first.
+func (M *Machine) Record(recorder *InputRecorder) {
+	M.StopRecording()
+	M.recorder = recorder
+	recorder.start(M.Cycles)
+	for i, dev := range M.CPU.Down {
+		if clock, ok := dev.(*Clock); ok {
+			recorder.Record(InputEvent{
+				Cycle:  M.Cycles,
+				Kind:   InputClockEpoch,
+				Device: i,
+				Value:  clock.EpochSet.UnixNano(),
+				Text:   clock.Epoch.Format(time.RFC3339Nano),
+			})
+			clock.Time = &recordedTime{source: clock.Time, machine: M, device: i}
+		}
+	}
+}
+
+// Replay plays log back instead of taking host input.  The machine has to be
+// in the state the recording started from, with the same devices and media,
+// for the replay to follow the recorded run.  Host input is accepted again
+// once the log runs out.
+func (M *Machine) Replay(log *InputLog) error {
+	if log.Start != M.Cycles {
+		return fmt.Errorf("input log starts at cycle %d, machine is at %d", log.Start, M.Cycles)
+	}
+	M.unwrapClocks(true)
+	M.replay = log
+	M.replayNext = 0
+	M.clockTimes = make(map[int][]int64)
+	for _, ev := range log.Events {
+		if ev.Kind == InputTime {
+			M.clockTimes[ev.Device] = append(M.clockTimes[ev.Device], ev.Value)
+		}
+	}
+	for i, dev := range M.CPU.Down {
+		if clock, ok := dev.(*Clock); ok {
+			clock.Time = &replayedTime{source: clock.Time, machine: M, device: i}
+		}
+	}
+	M.applyReplay()
+	return nil
+}
+
+// StopRecording stops logging input, returning the recorder's error.
+func (M *Machine) StopRecording() error {
+	if M.recorder == nil {
+		return nil
+	}
+	M.unwrapClocks(false)
+	recorder := M.recorder
+	M.recorder = nil
+	return recorder.Err()
+}
+
+// unwrapClocks gives the clocks back the time sources Replay, or Record if
+// replayed is false, wrapped.
+func (M *Machine) unwrapClocks(replayed bool) {
+	for _, dev := range M.CPU.Down {
+		if clock, ok := dev.(*Clock); ok {
+			clock.Time = unwrapTime(clock.Time, replayed)
+		}
+	}
+}
+
+func unwrapTime(t TimeSource, replayed bool) TimeSource {
+	switch wrapped := t.(type) {
+	case *recordedTime:
+		if !replayed {
+			return unwrapTime(wrapped.source, replayed)
+		}
+		wrapped.source = unwrapTime(wrapped.source, replayed)
+	case *replayedTime:
+		if replayed {
+			return unwrapTime(wrapped.source, replayed)
+		}
+		wrapped.source = unwrapTime(wrapped.source, replayed)
+	}
+	return t
+}
+
+// timeReplayed reports whether a replay is supplying the readings of t.
+func timeReplayed(t TimeSource) bool {
+	for {
+		switch wrapped := t.(type) {
+		case *replayedTime:
+			return true
+		case *recordedTime:
+			t = wrapped.source
+		default:
+			return false
+		}
+	}
+}
+
+// recordedTime logs every reading of a clock's time source.
+type recordedTime struct {
+	source  TimeSource
+	machine *Machine
+	device  int
+}
+
+func (R *recordedTime) Now() time.Time {
+	t := R.source.Now()
+	R.machine.recorder.Record(InputEvent{Cycle: R.machine.Cycles, Kind: InputTime, Device: R.device, Value: t.UnixNano()})
+	return t
+}
+
+func (R *recordedTime) Tick(ticks int) {
+	if ticker, ok := R.source.(Ticker); ok {
+		ticker.Tick(ticks)
+	}
+}
+
+// replayedTime returns the recorded readings of a clock's time source, then
+// falls back to the source once they run out.
+type replayedTime struct {
+	source  TimeSource
+	machine *Machine
+	device  int
+}
+
+func (R *replayedTime) Now() time.Time {
+	times := R.machine.clockTimes[R.device]
+	if len(times) == 0 {
+		return R.source.Now()
+	}
+	R.machine.clockTimes[R.device] = times[1:]
+	return time.Unix(0, times[0])
+}
+
+func (R *replayedTime) Tick(ticks int) {
+	if ticker, ok := R.source.(Ticker); ok {
+		ticker.Tick(ticks)
+	}
+}
+
+// Replaying reports whether a replay still has input left to apply.
+func (M *Machine) Replaying() bool {
+	return M.replay != nil
+}
+
+func (M *Machine) applyReplay() {
+	events := M.replay.Events
+	for ; M.replayNext < len(events) && events[M.replayNext].Cycle <= M.Cycles; M.replayNext++ {
+		ev := events[M.replayNext]
+		switch ev.Kind {
+		case InputTime:
+		case InputClockEpoch:
+			if ev.Device < 0 || ev.Device >= len(M.CPU.Down) {
+				continue
+			}
+			if clock, ok := M.CPU.Down[ev.Device].(*Clock); ok {
+				epoch, err := time.Parse(time.RFC3339Nano, ev.Text)
+				if err == nil {
+					clock.Epoch, clock.EpochSet = epoch, time.Unix(0, ev.Value)
+				}
+			}
+		default:
+			M.apply(ev)
+		}
+	}
+	if M.replayNext >= len(events) {
+		M.replay = nil
+		M.unwrapClocks(true)
+	}
+}
@@ -0,0 +1,439 @@
+/*
+Package rfb implements a minimal RFB 3.8 (VNC) server for GEMU displays.
+
+The server offers no authentication and only the raw encoding, which every
+viewer supports.  Incremental updates carry only the tiles that changed since
+the client last saw them.
+*/
+package rfb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	"github.com/techcompliant/GEMU"
+)
+
+const tileSize = 16
+
+const maxCutText = 1 << 20
+
+const (
+	msgSetPixelFormat           = 0
+	msgSetEncodings             = 2
+	msgFramebufferUpdateRequest = 3
+	msgKeyEvent                 = 4
+	msgPointerEvent             = 5
+	msgClientCutText            = 6
+)
+
+type Server struct {
+	Display  gemu.Display
+	Keys     gemu.KeyInput
+	Layout   *gemu.KeyLayout
+	Name     string
+	Scale    int
+	Interval time.Duration
+}
+
+type pixelFormat struct {
+	BitsPerPixel uint8
+	Depth        uint8
+	BigEndian    uint8
+	TrueColour   uint8
+	RedMax       uint16
+	GreenMax     uint16
+	BlueMax      uint16
+	RedShift     uint8
+	GreenShift   uint8
+	BlueShift    uint8
+	_            [3]byte
+}
+
+var serverFormat = pixelFormat{
+	BitsPerPixel: 32,
+	Depth:        24,
+	TrueColour:   1,
+	RedMax:       255,
+	GreenMax:     255,
+	BlueMax:      255,
+	RedShift:     16,
+	GreenShift:   8,
+	BlueShift:    0,
+}
+
+type updateRequest struct {
+	incremental bool
+	rect        image.Rectangle
+}
+
+type conn struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+	format pixelFormat
+	last   *image.RGBA
+	keys   *gemu.HostKeyboard
+
+	clipboard string
+}
+
+func NewServer(display gemu.Display, keys gemu.KeyInput) *Server {
+	return &Server{
+		Display:  display,
+		Keys:     keys,
+		Name:     "GEMU",
+		Scale:    4,
+		Interval: 50 * time.Millisecond,
+	}
+}
+
+func (S *Server) bounds() image.Rectangle {
+	return image.Rect(0, 0, (gemu.DisplayWidth+12)*S.Scale, (gemu.DisplayHeight+12)*S.Scale)
+}
+
+// frame renders the display with its border at the server scale.
+func (S *Server) frame() *image.RGBA {
+	img := image.NewRGBA(S.bounds())
+	draw.Draw(img, img.Bounds(), &image.Uniform{S.Display.BorderColor()}, image.ZP, draw.Src)
+	display := S.Display.Render()
+	for y := 0; y < gemu.DisplayHeight*S.Scale; y++ {
+		for x := 0; x < gemu.DisplayWidth*S.Scale; x++ {
+			img.SetRGBA(x+6*S.Scale, y+6*S.Scale, display.RGBAAt(x/S.Scale, y/S.Scale))
+		}
+	}
+	return img
+}
+
+func (S *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return S.Serve(l)
+}
+
+func (S *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := S.serveConn(c); err != nil && err != io.EOF {
+				log.Printf("rfb: %s: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (S *Server) serveConn(nc net.Conn) error {
+	defer nc.Close()
+	c := &conn{server: S, conn: nc, reader: bufio.NewReader(nc), format: serverFormat}
+	if S.Keys != nil {
+		c.keys = gemu.NewHostKeyboard(S.Keys, S.Layout)
+	}
+	if err := c.handshake(); err != nil {
+		return err
+	}
+
+	events := make(chan interface{}, 16)
+	errs := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		errs <- c.readMessages(events, quit)
+		close(events)
+	}()
+
+	ticker := time.NewTicker(S.Interval)
+	defer ticker.Stop()
+	var pending *updateRequest
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return <-errs
+			}
+			switch ev := ev.(type) {
+			case pixelFormat:
+				c.format = ev
+				c.last = nil
+			case updateRequest:
+				pending = &ev
+			}
+		case <-ticker.C:
+		}
+		if pending != nil {
+			sent, err := c.sendUpdate(*pending)
+			if err != nil {
+				return err
+			}
+			if sent {
+				pending = nil
+			}
+		}
+	}
+}
+
+func (c *conn) handshake() error {
+	if _, err := io.WriteString(c.conn, "RFB 003.008\n"); err != nil {
+		return err
+	}
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(c.reader, version); err != nil {
+		return err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return fmt.Errorf("unsupported protocol version %q", version)
+	}
+	if minor < 7 {
+		if err := binary.Write(c.conn, binary.BigEndian, uint32(1)); err != nil {
+			return err
+		}
+	} else {
+		if _, err := c.conn.Write([]byte{1, 1}); err != nil {
+			return err
+		}
+		security, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if security != 1 {
+			return fmt.Errorf("unsupported security type %d", security)
+		}
+		if minor >= 8 {
+			if err := binary.Write(c.conn, binary.BigEndian, uint32(0)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := c.reader.ReadByte(); err != nil {
+		return err
+	}
+	bounds := c.server.bounds()
+	init := []interface{}{
+		uint16(bounds.Dx()),
+		uint16(bounds.Dy()),
+		serverFormat,
+		uint32(len(c.server.Name)),
+		[]byte(c.server.Name),
+	}
+	for _, field := range init {
+		if err := binary.Write(c.conn, binary.BigEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) readMessages(events chan<- interface{}, quit <-chan struct{}) error {
+	send := func(ev interface{}) error {
+		select {
+		case events <- ev:
+			return nil
+		case <-quit:
+			return io.EOF
+		}
+	}
+	for {
+		msgType, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch msgType {
+		case msgSetPixelFormat:
+			msg := struct {
+				_      [3]byte
+				Format pixelFormat
+			}{}
+			if err := binary.Read(c.reader, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			if msg.Format.TrueColour == 0 {
+				return errors.New("colour map pixel formats are not supported")
+			}
+			if err := send(msg.Format); err != nil {
+				return err
+			}
+		case msgSetEncodings:
+			msg := struct {
+				_     byte
+				Count uint16
+			}{}
+			if err := binary.Read(c.reader, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(ioutil.Discard, c.reader, int64(msg.Count)*4); err != nil {
+				return err
+			}
+		case msgFramebufferUpdateRequest:
+			msg := struct {
+				Incremental         uint8
+				X, Y, Width, Height uint16
+			}{}
+			if err := binary.Read(c.reader, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			rect := image.Rect(int(msg.X), int(msg.Y), int(msg.X)+int(msg.Width), int(msg.Y)+int(msg.Height))
+			req := updateRequest{incremental: msg.Incremental != 0, rect: rect.Intersect(c.server.bounds())}
+			if err := send(req); err != nil {
+				return err
+			}
+		case msgKeyEvent:
+			msg := struct {
+				Down   uint8
+				_      [2]byte
+				Keysym uint32
+			}{}
+			if err := binary.Read(c.reader, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			c.keyEvent(msg.Keysym, msg.Down != 0)
+		case msgPointerEvent:
+			if _, err := io.CopyN(ioutil.Discard, c.reader, 5); err != nil {
+				return err
+			}
+		case msgClientCutText:
+			msg := struct {
+				_      [3]byte
+				Length uint32
+			}{}
+			if err := binary.Read(c.reader, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			if msg.Length > maxCutText {
+				return fmt.Errorf("cut text of %d bytes is too long", msg.Length)
+			}
+			text := make([]byte, msg.Length)
+			if _, err := io.ReadFull(c.reader, text); err != nil {
+				return err
+			}
+			c.cutText(text)
+		default:
+			return fmt.Errorf("unknown client message %d", msgType)
+		}
+	}
+}
+
+func (c *conn) keyEvent(keysym uint32, down bool) {
+	if c.keys == nil {
+		return
+	}
+	if code, _ := gemu.KeysymCode(keysym); code == gemu.KEY_INSERT && c.keys.Shift() {
+		if paster, ok := c.server.Keys.(gemu.Paster); ok && down {
+			paster.Paste(c.clipboard)
+		}
+		return
+	}
+	c.keys.Keysym(keysym, down)
+}
+
+// cutText remembers the client clipboard.  Viewers send it whenever their
+// clipboard changes, so it is only typed when Shift+Insert is pressed.  RFB
+// sends Latin-1, which matches the keyboard's ASCII range.
+func (c *conn) cutText(text []byte) {
+	runes := make([]rune, len(text))
+	for i, b := range text {
+		runes[i] = rune(b)
+	}
+	c.clipboard = string(runes)
+}
+
+// dirtyRects returns the tiles of rect that differ between the frame and the
+// last frame sent to the client.
+func (c *conn) dirtyRects(frame *image.RGBA, req updateRequest) []image.Rectangle {
+	if !req.incremental || c.last == nil {
+		return []image.Rectangle{req.rect}
+	}
+	rects := []image.Rectangle{}
+	for ty := req.rect.Min.Y; ty < req.rect.Max.Y; ty += tileSize {
+		for tx := req.rect.Min.X; tx < req.rect.Max.X; tx += tileSize {
+			tile := image.Rect(tx, ty, tx+tileSize, ty+tileSize).Intersect(req.rect)
+			if tileChanged(frame, c.last, tile) {
+				rects = append(rects, tile)
+			}
+		}
+	}
+	return rects
+}
+
+func tileChanged(a, b *image.RGBA, tile image.Rectangle) bool {
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			if a.RGBAAt(x, y) != b.RGBAAt(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *conn) sendUpdate(req updateRequest) (bool, error) {
+	frame := c.server.frame()
+	rects := c.dirtyRects(frame, req)
+	if len(rects) == 0 || req.rect.Empty() {
+		return false, nil
+	}
+	out := bufio.NewWriter(c.conn)
+	binary.Write(out, binary.BigEndian, []uint16{0, uint16(len(rects))})
+	for _, rect := range rects {
+		binary.Write(out, binary.BigEndian, []uint16{
+			uint16(rect.Min.X), uint16(rect.Min.Y), uint16(rect.Dx()), uint16(rect.Dy()),
+		})
+		binary.Write(out, binary.BigEndian, int32(0))
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				c.writePixel(out, frame, x, y)
+			}
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return false, err
+	}
+	if c.last == nil {
+		c.last = image.NewRGBA(frame.Bounds())
+	}
+	for _, rect := range rects {
+		draw.Draw(c.last, rect, frame, rect.Min, draw.Src)
+	}
+	return true, nil
+}
+
+func (c *conn) writePixel(out *bufio.Writer, frame *image.RGBA, x, y int) {
+	f := c.format
+	col := frame.RGBAAt(x, y)
+	pixel := (uint32(col.R)*uint32(f.RedMax)/255)<<f.RedShift |
+		(uint32(col.G)*uint32(f.GreenMax)/255)<<f.GreenShift |
+		(uint32(col.B)*uint32(f.BlueMax)/255)<<f.BlueShift
+	switch f.BitsPerPixel {
+	case 8:
+		out.WriteByte(uint8(pixel))
+	case 16:
+		buf := make([]byte, 2)
+		if f.BigEndian != 0 {
+			binary.BigEndian.PutUint16(buf, uint16(pixel))
+		} else {
+			binary.LittleEndian.PutUint16(buf, uint16(pixel))
+		}
+		out.Write(buf)
+	default:
+		buf := make([]byte, 4)
+		if f.BigEndian != 0 {
+			binary.BigEndian.PutUint32(buf, pixel)
+		} else {
+			binary.LittleEndian.PutUint32(buf, pixel)
+		}
+		out.Write(buf)
+	}
+}
@@ -1,5 +1,11 @@
 package gemu
 
+import (
+	"errors"
+	"os"
+	"time"
+)
+
 var defaultStorage Storage
 
 func SetStorage(storage Storage) {
@@ -12,3 +18,88 @@ type Storage interface {
 	Read(Item string, offset int, data []byte)
 	Write(Item string, offset int, data []byte)
 }
+
+// ReadOnlyStorage is implemented by storages that can tell when an item
+// cannot be written.
+type ReadOnlyStorage interface {
+	ReadOnly(Item string) bool
+}
+
+func IsReadOnly(storage Storage, item string) bool {
+	if ro, ok := storage.(ReadOnlyStorage); ok {
+		return ro.ReadOnly(item)
+	}
+	return false
+}
+
+// ErrNotSupported is returned when a storage cannot do what was asked.
+var ErrNotSupported = errors.New("not supported by storage")
+
+// ItemInfo describes a stored item.  ModTime is zero for storages that do not
+// keep one.
+type ItemInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// ListStorage is implemented by storages that can enumerate their items.
+// List returns the items whose names start with prefix, sorted by name.
+type ListStorage interface {
+	List(prefix string) ([]ItemInfo, error)
+}
+
+type StatStorage interface {
+	Stat(Item string) (ItemInfo, error)
+}
+
+type DeleteStorage interface {
+	Delete(Item string) error
+}
+
+type RenameStorage interface {
+	Rename(from, to string) error
+}
+
+type TruncateStorage interface {
+	Truncate(Item string, size int64) error
+}
+
+func ListItems(storage Storage, prefix string) ([]ItemInfo, error) {
+	if ls, ok := storage.(ListStorage); ok {
+		return ls.List(prefix)
+	}
+	return nil, ErrNotSupported
+}
+
+// StatItem falls back on Exists and Length for storages without Stat.
+func StatItem(storage Storage, item string) (ItemInfo, error) {
+	if ss, ok := storage.(StatStorage); ok {
+		return ss.Stat(item)
+	}
+	if !storage.Exists(item) {
+		return ItemInfo{}, &os.PathError{Op: "stat", Path: item, Err: os.ErrNotExist}
+	}
+	return ItemInfo{Name: item, Size: int64(storage.Length(item))}, nil
+}
+
+func DeleteItem(storage Storage, item string) error {
+	if ds, ok := storage.(DeleteStorage); ok {
+		return ds.Delete(item)
+	}
+	return ErrNotSupported
+}
+
+func RenameItem(storage Storage, from, to string) error {
+	if rs, ok := storage.(RenameStorage); ok {
+		return rs.Rename(from, to)
+	}
+	return ErrNotSupported
+}
+
+func TruncateItem(storage Storage, item string, size int64) error {
+	if ts, ok := storage.(TruncateStorage); ok {
+		return ts.Truncate(item, size)
+	}
+	return ErrNotSupported
+}
@@ -0,0 +1,205 @@
+package gemu
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BundleManifestItem is where a software bundle describes what it contains.
+const BundleManifestItem = "manifest.json"
+
+// BundleManifest names the ROM and floppies a bundle should be run with.
+type BundleManifest struct {
+	Name     string   `json:"name"`
+	Rom      string   `json:"rom"`
+	Floppies []string `json:"floppies"`
+}
+
+// ArchiveStorage is a read only Storage of the files in a .zip, .tar or
+// .tar.gz archive.  The archive is read into memory when it is opened.
+type ArchiveStorage struct {
+	items map[string]archiveItem
+}
+
+type archiveItem struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewArchiveStorage opens the archive in file, telling the format from its
+// contents rather than its name.
+func NewArchiveStorage(file string) (*ArchiveStorage, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	AS := &ArchiveStorage{items: map[string]archiveItem{}}
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.Equal(magic, []byte("PK\x03\x04")):
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			err = AS.readZip(f, info.Size())
+		}
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(r); err == nil {
+			err = AS.readTar(gz)
+		}
+	default:
+		err = AS.readTar(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading archive %s: %v", file, err)
+	}
+	return AS, nil
+}
+
+func (AS *ArchiveStorage) add(name string, data []byte, modTime time.Time) {
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+		return
+	}
+	AS.items[name] = archiveItem{data: data, modTime: modTime}
+}
+
+func (AS *ArchiveStorage) readZip(r io.ReaderAt, size int64) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, file := range archive.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		AS.add(file.Name, data, file.Modified)
+	}
+	return nil
+}
+
+func (AS *ArchiveStorage) readTar(r io.Reader) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return err
+		}
+		AS.add(header.Name, data, header.ModTime)
+	}
+}
+
+// Manifest reads the bundle's manifest.json.
+func (AS *ArchiveStorage) Manifest() (*BundleManifest, error) {
+	item, ok := AS.items[BundleManifestItem]
+	if !ok {
+		return nil, fmt.Errorf("bundle has no %s", BundleManifestItem)
+	}
+	manifest := &BundleManifest{}
+	if err := json.Unmarshal(item.data, manifest); err != nil {
+		return nil, fmt.Errorf("bad %s: %v", BundleManifestItem, err)
+	}
+	return manifest, nil
+}
+
+func (AS *ArchiveStorage) Exists(Item string) bool {
+	_, ok := AS.items[Item]
+	return ok
+}
+
+func (AS *ArchiveStorage) Length(Item string) int {
+	return len(AS.items[Item].data)
+}
+
+func (AS *ArchiveStorage) Read(Item string, offset int, data []byte) {
+	AS.ReadAt(context.Background(), Item, data, int64(offset))
+}
+
+func (AS *ArchiveStorage) Write(Item string, offset int, data []byte) {
+}
+
+func (AS *ArchiveStorage) ReadOnly(Item string) bool {
+	return true
+}
+
+func (AS *ArchiveStorage) Size(ctx context.Context, Item string) (int64, error) {
+	item, ok := AS.items[Item]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(len(item.data)), nil
+}
+
+func (AS *ArchiveStorage) ReadAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	item, ok := AS.items[Item]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset >= int64(len(item.data)) {
+		return 0, io.EOF
+	}
+	n := copy(data, item.data[offset:])
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (AS *ArchiveStorage) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: Item, Err: os.ErrPermission}
+}
+
+func (AS *ArchiveStorage) List(prefix string) ([]ItemInfo, error) {
+	items := []ItemInfo{}
+	for name, item := range AS.items {
+		if strings.HasPrefix(name, prefix) {
+			items = append(items, ItemInfo{Name: name, Size: int64(len(item.data)), ModTime: item.modTime})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+func (AS *ArchiveStorage) Stat(Item string) (ItemInfo, error) {
+	item, ok := AS.items[Item]
+	if !ok {
+		return ItemInfo{}, &os.PathError{Op: "stat", Path: Item, Err: os.ErrNotExist}
+	}
+	return ItemInfo{Name: Item, Size: int64(len(item.data)), ModTime: item.modTime}, nil
+}
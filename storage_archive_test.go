@@ -0,0 +1,148 @@
+package gemu
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testBundle = []struct{ name, data string }{
+	{"manifest.json", `{"name": "x", "rom": "r.bin", "floppies": ["sub/d.img"]}`},
+	{"r.bin", "\x01\x02\x03\x04"},
+	{"./sub/d.img", "disk"},
+	{"../evil", "no"},
+	{"/abs", "no"},
+	{"..", "no"},
+}
+
+func zipBundle(files ...struct{ name, data string }) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range files {
+		w, _ := zw.Create(file.name)
+		w.Write([]byte(file.data))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func tarBundle(files ...struct{ name, data string }) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "sub/", Mode: 0755, Typeflag: tar.TypeDir})
+	for _, file := range files {
+		tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(file.data))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(data)
+	gw.Close()
+	return buf.Bytes()
+}
+
+// openArchive writes data to a file in dir and opens it.
+func openArchive(dir, name string, data []byte) (*ArchiveStorage, error) {
+	file := filepath.Join(dir, name)
+	ioutil.WriteFile(file, data, 0644)
+	return NewArchiveStorage(file)
+}
+
+func TestArchiveFormats(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"bundle.zip", zipBundle(testBundle...)},
+		{"bundle.tar", tarBundle(testBundle...)},
+		{"bundle.tar.gz", gzipped(tarBundle(testBundle...))},
+		// The format comes from the contents, not the name.
+		{"bundle.dat", zipBundle(testBundle...)},
+	} {
+		archive, err := openArchive(dir, test.name, test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		manifest, err := archive.Manifest()
+		if err != nil || manifest.Rom != "r.bin" || len(manifest.Floppies) != 1 {
+			t.Errorf("%s: manifest %+v, %v", test.name, manifest, err)
+		}
+		items, _ := archive.List("")
+		var names []string
+		for _, item := range items {
+			names = append(names, item.Name)
+		}
+		if got := strings.Join(names, " "); got != "manifest.json r.bin sub/d.img" {
+			t.Errorf("%s: holds %s", test.name, got)
+		}
+		data := make([]byte, 4)
+		archive.Read("sub/d.img", 0, data)
+		if string(data) != "disk" {
+			t.Errorf("%s: read %q", test.name, data)
+		}
+		if !IsReadOnly(archive, "r.bin") {
+			t.Errorf("%s: writable", test.name)
+		}
+	}
+}
+
+func TestArchiveMalformed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	zipped := zipBundle(testBundle...)
+	tarred := tarBundle(testBundle...)
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"truncated.zip", zipped[:len(zipped)/2]},
+		{"corrupt.zip", append([]byte("PK\x03\x04"), bytes.Repeat([]byte{0xff}, 100)...)},
+		{"truncated.tar", tarred[:700]},
+		{"garbage.tar", bytes.Repeat([]byte("not a tar "), 100)},
+		{"truncated.tar.gz", gzipped(tarred)[:40]},
+		{"corrupt.tar.gz", []byte{0x1f, 0x8b, 0, 0, 0, 0}},
+	} {
+		if _, err := openArchive(dir, test.name, test.data); err == nil {
+			t.Errorf("%s opened", test.name)
+		}
+	}
+	if _, err := NewArchiveStorage(filepath.Join(dir, "missing.zip")); err == nil {
+		t.Error("missing archive opened")
+	}
+}
+
+func TestArchiveManifestErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"none.zip", zipBundle(testBundle[1])},
+		{"bad.zip", zipBundle(struct{ name, data string }{"manifest.json", "{"})},
+		{"empty.tar", nil},
+	} {
+		archive, err := openArchive(dir, test.name, test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if _, err := archive.Manifest(); err == nil {
+			t.Errorf("%s: manifest read", test.name)
+		}
+	}
+}
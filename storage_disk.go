@@ -1,9 +1,11 @@
 package gemu
 
 import (
+	"context"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type DiskStorage struct {
@@ -50,7 +52,7 @@ func (DS *DiskStorage) Read(Item string, offset int, data []byte) {
 }
 
 func (DS *DiskStorage) Write(Item string, offset int, data []byte) {
-	file, err := os.OpenFile(filepath.Join(DS.basepath, Item), os.O_CREATE | os.O_WRONLY, 0777)
+	file, err := os.OpenFile(filepath.Join(DS.basepath, Item), os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		return
 	}
@@ -58,3 +60,121 @@ func (DS *DiskStorage) Write(Item string, offset int, data []byte) {
 	file.Seek(int64(offset), os.SEEK_SET)
 	file.Write(data)
 }
+
+// ReadOnly goes by the permission bits, so items only others can write are
+// not read only, and writing them fails instead.
+func (DS *DiskStorage) ReadOnly(Item string) bool {
+	info, err := os.Stat(filepath.Join(DS.basepath, Item))
+	if os.IsNotExist(err) {
+		// New items can be written if their directory is there.
+		_, err = os.Stat(filepath.Dir(filepath.Join(DS.basepath, Item)))
+		return err != nil
+	}
+	if err != nil {
+		return os.IsPermission(err)
+	}
+	return info.IsDir() || info.Mode().Perm()&0222 == 0
+}
+
+func (DS *DiskStorage) Size(ctx context.Context, Item string) (int64, error) {
+	s, err := os.Stat(filepath.Join(DS.basepath, Item))
+	if err != nil {
+		return 0, err
+	}
+	return s.Size(), nil
+}
+
+func (DS *DiskStorage) ReadAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	file, err := os.Open(filepath.Join(DS.basepath, Item))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.ReadAt(data, offset)
+}
+
+func (DS *DiskStorage) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(filepath.Join(DS.basepath, Item), os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return 0, err
+	}
+	n, err := file.WriteAt(data, offset)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func (DS *DiskStorage) List(prefix string) ([]ItemInfo, error) {
+	return listFiles(DS.basepath, prefix, true)
+}
+
+// listFiles lists the files under root whose slash separated names start
+// with prefix.  Symlinks are followed if links is set, and skipped if not.
+func listFiles(root, prefix string, links bool) ([]ItemInfo, error) {
+	items := []ItemInfo{}
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if file == root {
+				return err
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil || rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if info.IsDir() {
+			if !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !links {
+				return nil
+			}
+			if info, err = os.Stat(file); err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+		}
+		if info.Mode().IsRegular() {
+			items = append(items, ItemInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	return items, err
+}
+
+func (DS *DiskStorage) Stat(Item string) (ItemInfo, error) {
+	s, err := os.Stat(filepath.Join(DS.basepath, Item))
+	if err != nil {
+		return ItemInfo{}, err
+	}
+	if s.IsDir() {
+		return ItemInfo{}, &os.PathError{Op: "stat", Path: Item, Err: os.ErrNotExist}
+	}
+	return ItemInfo{Name: Item, Size: s.Size(), ModTime: s.ModTime()}, nil
+}
+
+func (DS *DiskStorage) Delete(Item string) error {
+	return os.Remove(filepath.Join(DS.basepath, Item))
+}
+
+func (DS *DiskStorage) Rename(from, to string) error {
+	return os.Rename(filepath.Join(DS.basepath, from), filepath.Join(DS.basepath, to))
+}
+
+func (DS *DiskStorage) Truncate(Item string, size int64) error {
+	return os.Truncate(filepath.Join(DS.basepath, Item), size)
+}
@@ -0,0 +1,39 @@
+package gemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStorageReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "rw.img"), []byte{1}, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "ro.img"), []byte{1}, 0444)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+
+	storage := NewDiskStorage(dir)
+	for _, test := range []struct {
+		item     string
+		readOnly bool
+	}{
+		{"rw.img", false},
+		{"ro.img", true},
+		{"new.img", false},
+		{"sub/new.img", false},
+		{"missing/new.img", true},
+		{"sub", true},
+	} {
+		if got := IsReadOnly(storage, test.item); got != test.readOnly {
+			t.Errorf("ReadOnly(%q) = %v, want %v", test.item, got, test.readOnly)
+		}
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "rw.img")); info.Size() != 1 {
+		t.Error("ReadOnly changed the item")
+	}
+}
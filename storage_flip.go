@@ -1,5 +1,11 @@
 package gemu
 
+import (
+	"context"
+)
+
+// FlipStorage byte swaps every word read or written, for storages known to
+// hold big endian images.  ImageStorage works the order out for itself.
 type FlipStorage struct {
 	Storage
 }
@@ -10,14 +16,51 @@ func NewFlipStorage(base Storage) Storage {
 
 func (FS *FlipStorage) Read(Item string, offset int, data []byte) {
 	FS.Storage.Read(Item, offset, data)
-	for l1 := 0; l1 < len(data)/2; l1++ {
-		data[l1*2], data[l1*2+1] = data[l1*2+1], data[l1*2]
-	}
+	swapBytes(data)
 }
 
 func (FS *FlipStorage) Write(Item string, offset int, data []byte) {
-	for l1 := 0; l1 < len(data)/2; l1++ {
-		data[l1*2], data[l1*2+1] = data[l1*2+1], data[l1*2]
-	}
-	FS.Storage.Write(Item, offset, data)
+	flipped := append([]byte{}, data...)
+	swapBytes(flipped)
+	FS.Storage.Write(Item, offset, flipped)
+}
+
+func (FS *FlipStorage) ReadOnly(Item string) bool {
+	return IsReadOnly(FS.Storage, Item)
+}
+
+func (FS *FlipStorage) Size(ctx context.Context, Item string) (int64, error) {
+	return AsStorageV2(FS.Storage).Size(ctx, Item)
+}
+
+func (FS *FlipStorage) ReadAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	n, err := AsStorageV2(FS.Storage).ReadAt(ctx, Item, data, offset)
+	swapBytes(data)
+	return n, err
+}
+
+func (FS *FlipStorage) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	flipped := append([]byte{}, data...)
+	swapBytes(flipped)
+	return AsStorageV2(FS.Storage).WriteAt(ctx, Item, flipped, offset)
+}
+
+func (FS *FlipStorage) List(prefix string) ([]ItemInfo, error) {
+	return ListItems(FS.Storage, prefix)
+}
+
+func (FS *FlipStorage) Stat(Item string) (ItemInfo, error) {
+	return StatItem(FS.Storage, Item)
+}
+
+func (FS *FlipStorage) Delete(Item string) error {
+	return DeleteItem(FS.Storage, Item)
+}
+
+func (FS *FlipStorage) Rename(from, to string) error {
+	return RenameItem(FS.Storage, from, to)
+}
+
+func (FS *FlipStorage) Truncate(Item string, size int64) error {
+	return TruncateItem(FS.Storage, Item, size)
 }
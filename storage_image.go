@@ -0,0 +1,217 @@
+package gemu
+
+import (
+	"context"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ImageStorage presents images as little endian words, the order devices
+// use them in, whatever order they are stored in.  Image headers are hidden,
+// and images that fail their checksum cannot be read or written.  New
+// images are created raw, and big endian unless RawOrder says otherwise.
+//
+// The byte order guessed for a raw image is kept in Item + ImageOrderSuffix
+// the first time the image is written, so that later runs do not guess
+// again from contents that may since have changed, and get it wrong.
+type ImageStorage struct {
+	Storage
+	// RawOrder forces the byte order of images without a header, rather
+	// than guessing it.
+	RawOrder ImageOrder
+
+	mu     sync.Mutex
+	images map[string]*imageLayout
+}
+
+type imageLayout struct {
+	header    *ImageHeader
+	offset    int64
+	bigEndian bool
+	err       error
+	// guessed is set for raw images whose order has not been kept yet.
+	guessed bool
+}
+
+// ImageOrderSuffix names the item the byte order of a raw image is kept in.
+const ImageOrderSuffix = ".order"
+
+func NewImageStorage(base Storage) *ImageStorage {
+	return &ImageStorage{Storage: base, images: map[string]*imageLayout{}}
+}
+
+// layout works out how Item is stored the first time it is used.
+func (IS *ImageStorage) layout(Item string) *imageLayout {
+	IS.mu.Lock()
+	defer IS.mu.Unlock()
+	if layout, ok := IS.images[Item]; ok {
+		return layout
+	}
+	if !IS.Storage.Exists(Item) {
+		return &imageLayout{bigEndian: IS.RawOrder != ImageOrderLittle, guessed: IS.RawOrder == ImageOrderAuto}
+	}
+	size := IS.Storage.Length(Item)
+	head := make([]byte, size)
+	if size > imageGuessBytes {
+		head = head[:imageGuessBytes]
+	}
+	IS.Storage.Read(Item, 0, head)
+	var layout *imageLayout
+	if header, err := ParseImageHeader(head); err != nil {
+		layout = IS.rawLayout(Item, head)
+	} else {
+		layout = &imageLayout{header: header, offset: ImageHeaderSize, bigEndian: !header.LittleEndian}
+		if header.Checksummed {
+			data := make([]byte, size-ImageHeaderSize)
+			IS.Storage.Read(Item, ImageHeaderSize, data)
+			if crc32.ChecksumIEEE(data) != header.Checksum {
+				layout.err = ErrImageChecksum
+			}
+		}
+	}
+	IS.images[Item] = layout
+	return layout
+}
+
+// rawLayout works out the byte order of a raw image, from RawOrder, the
+// order kept for it or its start.
+func (IS *ImageStorage) rawLayout(Item string, head []byte) *imageLayout {
+	switch IS.RawOrder {
+	case ImageOrderBig:
+		return &imageLayout{bigEndian: true}
+	case ImageOrderLittle:
+		return &imageLayout{bigEndian: false}
+	}
+	if kept := Item + ImageOrderSuffix; IS.Storage.Exists(kept) {
+		name := make([]byte, IS.Storage.Length(kept))
+		IS.Storage.Read(kept, 0, name)
+		if order, err := ParseImageOrder(strings.TrimSpace(string(name))); err == nil && order != ImageOrderAuto {
+			return &imageLayout{bigEndian: order == ImageOrderBig}
+		}
+	}
+	return &imageLayout{bigEndian: GuessBigEndian(head), guessed: true}
+}
+
+// keepOrder stores the order guessed for a raw image, before it is first
+// written.
+func (IS *ImageStorage) keepOrder(ctx context.Context, Item string, layout *imageLayout) error {
+	IS.mu.Lock()
+	defer IS.mu.Unlock()
+	if !layout.guessed {
+		return nil
+	}
+	order := ImageOrderLittle
+	if layout.bigEndian {
+		order = ImageOrderBig
+	}
+	if _, err := AsStorageV2(IS.Storage).WriteAt(ctx, Item+ImageOrderSuffix, []byte(order.String()+"\n"), 0); err != nil {
+		return err
+	}
+	layout.guessed = false
+	return nil
+}
+
+// Forget drops what is known about Item, for when it may have been replaced.
+func (IS *ImageStorage) Forget(Item string) {
+	IS.mu.Lock()
+	defer IS.mu.Unlock()
+	delete(IS.images, Item)
+}
+
+// Header returns the header of Item, or nil if it is raw.
+func (IS *ImageStorage) Header(Item string) *ImageHeader {
+	return IS.layout(Item).header
+}
+
+// BigEndian reports whether Item is stored big endian.
+func (IS *ImageStorage) BigEndian(Item string) bool {
+	return IS.layout(Item).bigEndian
+}
+
+// Load reads all of Item into data.
+func (IS *ImageStorage) Load(Item string, data []byte) error {
+	_, err := IS.ReadAt(context.Background(), Item, data, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func (IS *ImageStorage) Size(ctx context.Context, Item string) (int64, error) {
+	size, err := AsStorageV2(IS.Storage).Size(ctx, Item)
+	if err != nil {
+		return 0, err
+	}
+	return size - IS.layout(Item).offset, nil
+}
+
+func (IS *ImageStorage) ReadAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	layout := IS.layout(Item)
+	if layout.err != nil {
+		return 0, &os.PathError{Op: "read", Path: Item, Err: layout.err}
+	}
+	n, err := AsStorageV2(IS.Storage).ReadAt(ctx, Item, data, offset+layout.offset)
+	if layout.bigEndian {
+		swapBytes(data[:n])
+	}
+	return n, err
+}
+
+func (IS *ImageStorage) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	layout := IS.layout(Item)
+	if layout.err != nil {
+		return 0, &os.PathError{Op: "write", Path: Item, Err: layout.err}
+	}
+	if err := IS.keepOrder(ctx, Item, layout); err != nil {
+		return 0, err
+	}
+	if layout.bigEndian {
+		data = append([]byte{}, data...)
+		swapBytes(data)
+	}
+	storage := AsStorageV2(IS.Storage)
+	if header := layout.header; header != nil && header.Checksummed {
+		header.Checksummed = false
+		if _, err := storage.WriteAt(ctx, Item, header.Bytes(), 0); err != nil {
+			return 0, err
+		}
+	}
+	n, err := storage.WriteAt(ctx, Item, data, offset+layout.offset)
+	IS.mu.Lock()
+	if _, ok := IS.images[Item]; !ok {
+		// Remember the order new images were created in, rather than guess
+		// it from what has been written so far.
+		IS.images[Item] = layout
+	}
+	IS.mu.Unlock()
+	return n, err
+}
+
+func (IS *ImageStorage) Length(Item string) int {
+	size, _ := IS.Size(context.Background(), Item)
+	return int(size)
+}
+
+func (IS *ImageStorage) Read(Item string, offset int, data []byte) {
+	if _, err := IS.ReadAt(context.Background(), Item, data, int64(offset)); err != nil && err != io.EOF && !os.IsNotExist(err) {
+		log.Println("Storage read failed:", err)
+	}
+}
+
+func (IS *ImageStorage) Write(Item string, offset int, data []byte) {
+	if _, err := IS.WriteAt(context.Background(), Item, data, int64(offset)); err != nil {
+		log.Println("Storage write failed:", err)
+	}
+}
+
+// ReadOnly also reports images whose header write protects them.
+func (IS *ImageStorage) ReadOnly(Item string) bool {
+	if header := IS.Header(Item); header != nil && header.WriteProtected {
+		return true
+	}
+	return IsReadOnly(IS.Storage, Item)
+}
@@ -0,0 +1,84 @@
+package gemu
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+func TestImageStorageChecksum(t *testing.T) {
+	storage := NewMemStorage()
+	data := programBytes(binary.LittleEndian)
+	WriteImage(storage, "good", ImageHeader{Media: ImageMediaFloppy}, false, data)
+	WriteImage(storage, "bad", ImageHeader{Media: ImageMediaFloppy}, false, data)
+	bad := storage.Export()["bad"]
+	bad[ImageHeaderSize] ^= 0xFF
+	storage.Load("bad", bad)
+
+	images := NewImageStorage(storage)
+	read := make([]byte, len(data))
+	if _, err := images.ReadAt(context.Background(), "good", read, 0); err != nil || !bytes.Equal(read, data) {
+		t.Errorf("read % x, %v, want % x", read, err, data)
+	}
+	if _, err := images.ReadAt(context.Background(), "bad", read, 0); err == nil {
+		t.Error("read an image that fails its checksum")
+	}
+	if _, err := images.WriteAt(context.Background(), "bad", []byte{1, 2}, 0); err == nil {
+		t.Error("wrote an image that fails its checksum")
+	}
+
+	// Writing drops the checksum rather than leave a stale one.
+	if _, err := images.WriteAt(context.Background(), "good", []byte{1, 2}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if header, _ := ReadImageHeader(storage, "good"); header.Checksummed {
+		t.Error("checksum kept after a write")
+	}
+	images = NewImageStorage(storage)
+	if _, err := images.ReadAt(context.Background(), "good", read, 0); err != nil || read[0] != 1 {
+		t.Errorf("reopened image read % x, %v", read, err)
+	}
+}
+
+func TestImageStorageKeepsOrder(t *testing.T) {
+	storage := NewMemStorageFrom(map[string][]byte{"disk": programBytes(binary.LittleEndian)})
+	images := NewImageStorage(storage)
+	read := make([]byte, 2)
+	images.Read("disk", 0, read)
+	if storage.Exists("disk" + ImageOrderSuffix) {
+		t.Error("order kept before the image was written")
+	}
+
+	// Fill the image with what looks like big endian text, which would
+	// be guessed wrong next time if the order were not kept.
+	text := bytes.Repeat([]byte{'A', 0}, len(testProgram))
+	if _, err := images.WriteAt(context.Background(), "disk", text, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(storage.Export()["disk"+ImageOrderSuffix]); got != "little\n" {
+		t.Errorf("kept order %q", got)
+	}
+	images = NewImageStorage(storage)
+	if images.BigEndian("disk") {
+		t.Error("order guessed again")
+	}
+	images.Read("disk", 0, read)
+	if read[0] != 'A' {
+		t.Errorf("read back % x", read)
+	}
+
+	// New images keep the order they are created in.
+	images.WriteAt(context.Background(), "new", text, 0)
+	if images = NewImageStorage(storage); !images.BigEndian("new") {
+		t.Error("new image not kept big endian")
+	}
+
+	// A forced order needs nothing kept.
+	images = NewImageStorage(storage)
+	images.RawOrder = ImageOrderBig
+	images.WriteAt(context.Background(), "forced", text, 0)
+	if storage.Exists("forced" + ImageOrderSuffix) {
+		t.Error("kept a forced order")
+	}
+}
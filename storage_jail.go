@@ -0,0 +1,375 @@
+package gemu
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrBadItemName   = errors.New("bad item name")
+	ErrOutsideJail   = errors.New("item is outside the storage")
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+type JailOptions struct {
+	// FileMode and DirMode are the permissions new files and directories are
+	// created with, 0644 and 0755 by default.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	// Quota limits how many bytes each namespace may hold, 0 for no limit.
+	// Quotas overrides it for single namespaces.
+	Quota  int64
+	Quotas map[string]int64
+}
+
+// JailStorage is a DiskStorage for untrusted item names.  Names are slash
+// separated and relative to the root, and anything that could reach outside
+// it, like absolute paths, ".." or symlinks leading elsewhere, is refused.
+//
+// The first element of a name is its namespace, so "alice/boot.img" is in
+// "alice", and items without a directory are in "".  Writes that would take
+// a namespace over its quota fail with ErrQuotaExceeded.
+type JailStorage struct {
+	root string
+	opts JailOptions
+
+	mu    sync.Mutex
+	usage map[string]int64
+}
+
+// NewJailStorage creates a JailStorage in root, creating the directory if
+// needed.
+func NewJailStorage(root string, opts JailOptions) (*JailStorage, error) {
+	if opts.FileMode == 0 {
+		opts.FileMode = 0644
+	}
+	if opts.DirMode == 0 {
+		opts.DirMode = 0755
+	}
+	if err := os.MkdirAll(root, opts.DirMode); err != nil {
+		return nil, err
+	}
+	root, err := filepath.Abs(root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &JailStorage{root: root, opts: opts, usage: map[string]int64{}}, nil
+}
+
+// CleanItemName normalizes a slash separated item name, refusing ones that
+// are empty, absolute or use "..".
+func CleanItemName(Item string) (string, error) {
+	if Item == "" || strings.ContainsAny(Item, "\\\x00") || path.IsAbs(Item) {
+		return "", ErrBadItemName
+	}
+	for _, part := range strings.Split(Item, "/") {
+		if part == ".." {
+			return "", ErrBadItemName
+		}
+	}
+	clean := path.Clean(Item)
+	if clean == "." {
+		return "", ErrBadItemName
+	}
+	return clean, nil
+}
+
+func itemNamespace(name string) string {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+func (JS *JailStorage) inside(full string) bool {
+	rel, err := filepath.Rel(JS.root, full)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// path returns the clean name of Item and where it is on disk.  The deepest
+// part of the path that exists has to resolve to somewhere inside the root.
+func (JS *JailStorage) path(op, Item string) (string, string, error) {
+	name, err := CleanItemName(Item)
+	if err != nil {
+		return "", "", &os.PathError{Op: op, Path: Item, Err: err}
+	}
+	full := filepath.Join(JS.root, filepath.FromSlash(name))
+	for check := full; check != JS.root; check = filepath.Dir(check) {
+		if _, err := os.Lstat(check); os.IsNotExist(err) {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(check)
+		if err != nil || !JS.inside(resolved) {
+			// Dangling links are refused too, as creating the item would
+			// follow them.
+			return "", "", &os.PathError{Op: op, Path: Item, Err: ErrOutsideJail}
+		}
+		break
+	}
+	return name, full, nil
+}
+
+func (JS *JailStorage) quota(namespace string) int64 {
+	if quota, ok := JS.opts.Quotas[namespace]; ok {
+		return quota
+	}
+	return JS.opts.Quota
+}
+
+// used returns the bytes held in namespace, adding them up the first time.
+func (JS *JailStorage) used(namespace string) int64 {
+	if used, ok := JS.usage[namespace]; ok {
+		return used
+	}
+	var used int64
+	if namespace == "" {
+		files, _ := ioutil.ReadDir(JS.root)
+		for _, file := range files {
+			if file.Mode().IsRegular() {
+				used += file.Size()
+			}
+		}
+	} else {
+		filepath.Walk(filepath.Join(JS.root, namespace), func(_ string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				used += info.Size()
+			}
+			return nil
+		})
+	}
+	JS.usage[namespace] = used
+	return used
+}
+
+// Used returns how many bytes namespace holds.
+func (JS *JailStorage) Used(namespace string) int64 {
+	JS.mu.Lock()
+	defer JS.mu.Unlock()
+	return JS.used(namespace)
+}
+
+func (JS *JailStorage) Size(ctx context.Context, Item string) (int64, error) {
+	_, full, err := JS.path("stat", Item)
+	if err != nil {
+		return 0, err
+	}
+	s, err := os.Stat(full)
+	if err != nil {
+		return 0, err
+	}
+	return s.Size(), nil
+}
+
+func (JS *JailStorage) ReadAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	_, full, err := JS.path("read", Item)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Open(full)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.ReadAt(data, offset)
+}
+
+func (JS *JailStorage) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	name, full, err := JS.path("write", Item)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "write", Path: Item, Err: os.ErrInvalid}
+	}
+	JS.mu.Lock()
+	defer JS.mu.Unlock()
+	var size int64
+	if s, err := os.Stat(full); err == nil {
+		size = s.Size()
+	}
+	grow := offset + int64(len(data)) - size
+	if grow < 0 {
+		grow = 0
+	}
+	namespace := itemNamespace(name)
+	if quota := JS.quota(namespace); quota > 0 && grow > 0 && JS.used(namespace)+grow > quota {
+		return 0, &os.PathError{Op: "write", Path: Item, Err: ErrQuotaExceeded}
+	}
+	if err := os.MkdirAll(filepath.Dir(full), JS.opts.DirMode); err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(full, os.O_CREATE|os.O_WRONLY, JS.opts.FileMode)
+	if err != nil {
+		return 0, err
+	}
+	n, err := file.WriteAt(data, offset)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Count the namespace again rather than guess what was written.
+		delete(JS.usage, namespace)
+	} else {
+		JS.resized(namespace, grow)
+	}
+	return n, err
+}
+
+func (JS *JailStorage) Exists(Item string) bool {
+	_, err := JS.Size(context.Background(), Item)
+	return err == nil
+}
+
+func (JS *JailStorage) Length(Item string) int {
+	size, _ := JS.Size(context.Background(), Item)
+	return int(size)
+}
+
+func (JS *JailStorage) Read(Item string, offset int, data []byte) {
+	if _, err := JS.ReadAt(context.Background(), Item, data, int64(offset)); err != nil && err != io.EOF && !os.IsNotExist(err) {
+		log.Println("Storage read failed:", err)
+	}
+}
+
+func (JS *JailStorage) Write(Item string, offset int, data []byte) {
+	if _, err := JS.WriteAt(context.Background(), Item, data, int64(offset)); err != nil {
+		log.Println("Storage write failed:", err)
+	}
+}
+
+// ReadOnly reports items that cannot be written at all.  Writes can still
+// fail once the namespace is full.
+func (JS *JailStorage) ReadOnly(Item string) bool {
+	_, full, err := JS.path("open", Item)
+	if err != nil {
+		return true
+	}
+	file, err := os.OpenFile(full, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		return os.IsPermission(err)
+	}
+	file.Close()
+	return false
+}
+
+// List skips symlinks, which could lead anywhere.
+func (JS *JailStorage) List(prefix string) ([]ItemInfo, error) {
+	return listFiles(JS.root, prefix, false)
+}
+
+func (JS *JailStorage) Stat(Item string) (ItemInfo, error) {
+	name, full, err := JS.path("stat", Item)
+	if err != nil {
+		return ItemInfo{}, err
+	}
+	s, err := os.Stat(full)
+	if err != nil {
+		return ItemInfo{}, err
+	}
+	if !s.Mode().IsRegular() {
+		return ItemInfo{}, &os.PathError{Op: "stat", Path: Item, Err: os.ErrNotExist}
+	}
+	return ItemInfo{Name: name, Size: s.Size(), ModTime: s.ModTime()}, nil
+}
+
+// resized accounts for an item in namespace changing size by delta, if the
+// namespace has been counted.
+func (JS *JailStorage) resized(namespace string, delta int64) {
+	if _, ok := JS.usage[namespace]; ok {
+		JS.usage[namespace] += delta
+	}
+}
+
+func (JS *JailStorage) Delete(Item string) error {
+	name, full, err := JS.path("delete", Item)
+	if err != nil {
+		return err
+	}
+	JS.mu.Lock()
+	defer JS.mu.Unlock()
+	s, err := os.Stat(full)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(full); err != nil {
+		return err
+	}
+	JS.resized(itemNamespace(name), -s.Size())
+	return nil
+}
+
+func (JS *JailStorage) Rename(from, to string) error {
+	fromName, fromFull, err := JS.path("rename", from)
+	if err != nil {
+		return err
+	}
+	toName, toFull, err := JS.path("rename", to)
+	if err != nil {
+		return err
+	}
+	JS.mu.Lock()
+	defer JS.mu.Unlock()
+	s, err := os.Stat(fromFull)
+	if err != nil {
+		return err
+	}
+	fromSpace, toSpace := itemNamespace(fromName), itemNamespace(toName)
+	if fromSpace != toSpace {
+		if quota := JS.quota(toSpace); quota > 0 && JS.used(toSpace)+s.Size() > quota {
+			return &os.PathError{Op: "rename", Path: to, Err: ErrQuotaExceeded}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(toFull), JS.opts.DirMode); err != nil {
+		return err
+	}
+	if err := os.Rename(fromFull, toFull); err != nil {
+		return err
+	}
+	// Whatever was at to has been replaced, so count it again.
+	JS.resized(fromSpace, -s.Size())
+	delete(JS.usage, toSpace)
+	return nil
+}
+
+func (JS *JailStorage) Truncate(Item string, size int64) error {
+	name, full, err := JS.path("truncate", Item)
+	if err != nil {
+		return err
+	}
+	JS.mu.Lock()
+	defer JS.mu.Unlock()
+	s, err := os.Stat(full)
+	if err != nil {
+		return err
+	}
+	namespace := itemNamespace(name)
+	grow := size - s.Size()
+	if quota := JS.quota(namespace); quota > 0 && grow > 0 && JS.used(namespace)+grow > quota {
+		return &os.PathError{Op: "truncate", Path: Item, Err: ErrQuotaExceeded}
+	}
+	if err := os.Truncate(full, size); err != nil {
+		return err
+	}
+	JS.resized(namespace, grow)
+	return nil
+}
@@ -0,0 +1,121 @@
+package gemu
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// newTestJail makes a jail in a new directory under dir.
+func newTestJail(t *testing.T, dir string, opts JailOptions) (*JailStorage, string) {
+	root := filepath.Join(dir, "jail")
+	jail, err := NewJailStorage(root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jail, root
+}
+
+func TestCleanItemName(t *testing.T) {
+	for name, want := range map[string]string{
+		"disk.img":       "disk.img",
+		"a/./b":          "a/b",
+		"a//b":           "a/b",
+		"a/b/../c":       "",
+		"../x":           "",
+		"/etc/passwd":    "",
+		"a/../../x":      "",
+		"a\\b":           "",
+		"":               "",
+		".":              "",
+		"a/..":           "",
+		"a/b/../../../x": "",
+	} {
+		got, err := CleanItemName(name)
+		if want == "" && !errors.Is(err, ErrBadItemName) {
+			t.Errorf("CleanItemName(%q) = %q, %v, want ErrBadItemName", name, got, err)
+		}
+		if want != "" && (got != want || err != nil) {
+			t.Errorf("CleanItemName(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestJailRefusesTraversal(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	jail, root := newTestJail(t, dir, JailOptions{})
+	for _, name := range []string{"../escaped", "/tmp/escaped", "a/../../escaped"} {
+		if _, err := jail.WriteAt(context.Background(), name, []byte{1}, 0); !errors.Is(err, ErrBadItemName) {
+			t.Errorf("writing %q: %v, want ErrBadItemName", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "escaped")); err == nil {
+		t.Error("write escaped the jail")
+	}
+}
+
+func TestJailRefusesSymlinks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	jail, root := newTestJail(t, dir, JailOptions{})
+	outside := tempDir(t)
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling"))
+	for _, name := range []string{"link/x", "dangling"} {
+		if _, err := jail.WriteAt(context.Background(), name, []byte{1}, 0); !errors.Is(err, ErrOutsideJail) {
+			t.Errorf("writing %q: %v, want ErrOutsideJail", name, err)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+		t.Error("write followed a symlink out of the jail")
+	}
+}
+
+func TestJailQuota(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	jail, root := newTestJail(t, dir, JailOptions{Quota: 100, Quotas: map[string]int64{"big": 1000}})
+	if _, err := jail.WriteAt(ctx, "alice/disk", make([]byte, 60), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jail.WriteAt(ctx, "alice/disk2", make([]byte, 50), 0); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("writing over quota: %v, want ErrQuotaExceeded", err)
+	}
+	// Overwriting does not use any more space.
+	if _, err := jail.WriteAt(ctx, "alice/disk", make([]byte, 50), 10); err != nil {
+		t.Error(err)
+	}
+	if _, err := jail.WriteAt(ctx, "bob/disk", make([]byte, 60), 0); err != nil {
+		t.Errorf("quota is shared between directories: %v", err)
+	}
+	if _, err := jail.WriteAt(ctx, "big/disk", make([]byte, 500), 0); err != nil {
+		t.Errorf("per directory quota ignored: %v", err)
+	}
+	if used := jail.Used("alice"); used != 60 {
+		t.Errorf("alice used %d bytes, want 60", used)
+	}
+
+	reopened, err := NewJailStorage(root, JailOptions{Quota: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := reopened.Used("alice"); used != 60 {
+		t.Errorf("usage recounted as %d bytes, want 60", used)
+	}
+}
@@ -0,0 +1,181 @@
+package gemu
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemStorage keeps items in memory, for tests and machines that should not
+// leave anything behind.  It is safe to use from several goroutines.
+type MemStorage struct {
+	mu    sync.RWMutex
+	items map[string][]byte
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{items: map[string][]byte{}}
+}
+
+// NewMemStorageFrom creates a MemStorage holding copies of items.
+func NewMemStorageFrom(items map[string][]byte) *MemStorage {
+	MS := NewMemStorage()
+	for item, data := range items {
+		MS.items[item] = append([]byte{}, data...)
+	}
+	return MS
+}
+
+// Load replaces Item with a copy of data.
+func (MS *MemStorage) Load(Item string, data []byte) {
+	MS.mu.Lock()
+	defer MS.mu.Unlock()
+	MS.items[Item] = append([]byte{}, data...)
+}
+
+// Clone returns a copy of the storage that shares nothing with it, so a
+// forked machine can change its disks without touching the original's.
+func (MS *MemStorage) Clone() *MemStorage {
+	return NewMemStorageFrom(MS.Export())
+}
+
+// Export returns a copy of every item.
+func (MS *MemStorage) Export() map[string][]byte {
+	MS.mu.RLock()
+	defer MS.mu.RUnlock()
+	items := make(map[string][]byte, len(MS.items))
+	for item, data := range MS.items {
+		items[item] = append([]byte{}, data...)
+	}
+	return items
+}
+
+func (MS *MemStorage) Exists(Item string) bool {
+	MS.mu.RLock()
+	defer MS.mu.RUnlock()
+	_, ok := MS.items[Item]
+	return ok
+}
+
+func (MS *MemStorage) Length(Item string) int {
+	MS.mu.RLock()
+	defer MS.mu.RUnlock()
+	return len(MS.items[Item])
+}
+
+func (MS *MemStorage) Read(Item string, offset int, data []byte) {
+	MS.ReadAt(context.Background(), Item, data, int64(offset))
+}
+
+func (MS *MemStorage) Write(Item string, offset int, data []byte) {
+	MS.WriteAt(context.Background(), Item, data, int64(offset))
+}
+
+func (MS *MemStorage) Size(ctx context.Context, Item string) (int64, error) {
+	MS.mu.RLock()
+	defer MS.mu.RUnlock()
+	data, ok := MS.items[Item]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(len(data)), nil
+}
+
+func (MS *MemStorage) ReadAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	MS.mu.RLock()
+	defer MS.mu.RUnlock()
+	stored, ok := MS.items[Item]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset >= int64(len(stored)) {
+		return 0, io.EOF
+	}
+	n := copy(data, stored[offset:])
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (MS *MemStorage) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	MS.mu.Lock()
+	defer MS.mu.Unlock()
+	stored := MS.items[Item]
+	if end := int(offset) + len(data); end > len(stored) {
+		grown := make([]byte, end)
+		copy(grown, stored)
+		stored = grown
+	}
+	copy(stored[offset:], data)
+	MS.items[Item] = stored
+	return len(data), nil
+}
+
+func (MS *MemStorage) List(prefix string) ([]ItemInfo, error) {
+	MS.mu.RLock()
+	defer MS.mu.RUnlock()
+	items := []ItemInfo{}
+	for item, data := range MS.items {
+		if strings.HasPrefix(item, prefix) {
+			items = append(items, ItemInfo{Name: item, Size: int64(len(data))})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+func (MS *MemStorage) Stat(Item string) (ItemInfo, error) {
+	size, err := MS.Size(context.Background(), Item)
+	if err != nil {
+		return ItemInfo{}, &os.PathError{Op: "stat", Path: Item, Err: err}
+	}
+	return ItemInfo{Name: Item, Size: size}, nil
+}
+
+func (MS *MemStorage) Delete(Item string) error {
+	MS.mu.Lock()
+	defer MS.mu.Unlock()
+	if _, ok := MS.items[Item]; !ok {
+		return &os.PathError{Op: "delete", Path: Item, Err: os.ErrNotExist}
+	}
+	delete(MS.items, Item)
+	return nil
+}
+
+func (MS *MemStorage) Rename(from, to string) error {
+	MS.mu.Lock()
+	defer MS.mu.Unlock()
+	data, ok := MS.items[from]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: from, Err: os.ErrNotExist}
+	}
+	delete(MS.items, from)
+	MS.items[to] = data
+	return nil
+}
+
+func (MS *MemStorage) Truncate(Item string, size int64) error {
+	MS.mu.Lock()
+	defer MS.mu.Unlock()
+	data, ok := MS.items[Item]
+	if !ok {
+		return &os.PathError{Op: "truncate", Path: Item, Err: os.ErrNotExist}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: Item, Err: os.ErrInvalid}
+	}
+	resized := make([]byte, size)
+	copy(resized, data)
+	MS.items[Item] = resized
+	return nil
+}
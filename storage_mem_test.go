@@ -0,0 +1,111 @@
+package gemu
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestMemStorageCopies(t *testing.T) {
+	src := []byte{1, 2, 3, 4}
+	storage := NewMemStorageFrom(map[string][]byte{"a": src})
+	src[0] = 9
+	clone := storage.Clone()
+	storage.Write("a", 6, []byte{7})
+	exported := storage.Export()
+	exported["a"][1] = 9
+
+	got := make([]byte, 7)
+	storage.Read("a", 0, got)
+	if !bytes.Equal(got, []byte{1, 2, 3, 4, 0, 0, 7}) {
+		t.Errorf("storage holds %v", got)
+	}
+	if clone.Length("a") != 4 {
+		t.Errorf("clone is %d bytes, want the original 4", clone.Length("a"))
+	}
+}
+
+func TestMemStorageErrors(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemStorageFrom(map[string][]byte{"a": {1, 2, 3}})
+	data := make([]byte, 2)
+	for _, test := range []struct {
+		name   string
+		offset int64
+		n      int
+		err    error
+	}{
+		{"whole", 0, 2, nil},
+		{"short", 2, 1, io.EOF},
+		{"past the end", 3, 0, io.EOF},
+		{"negative", -1, 0, os.ErrInvalid},
+	} {
+		if n, err := storage.ReadAt(ctx, "a", data, test.offset); n != test.n || err != test.err {
+			t.Errorf("%s: read %d, %v, want %d, %v", test.name, n, err, test.n, test.err)
+		}
+	}
+	if _, err := storage.ReadAt(ctx, "b", data, 0); !os.IsNotExist(err) {
+		t.Errorf("reading a missing item: %v", err)
+	}
+	if _, err := storage.WriteAt(ctx, "a", data, -1); err != os.ErrInvalid {
+		t.Errorf("writing at -1: %v", err)
+	}
+	for name, err := range map[string]error{
+		"delete":   storage.Delete("b"),
+		"rename":   storage.Rename("b", "c"),
+		"truncate": storage.Truncate("b", 0),
+	} {
+		if !os.IsNotExist(err) {
+			t.Errorf("%s of a missing item: %v", name, err)
+		}
+	}
+	if err := storage.Truncate("a", -1); err == nil {
+		t.Error("truncated to -1 bytes")
+	}
+}
+
+// TestMemStorageConcurrent is meant for go test -race.
+func TestMemStorageConcurrent(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemStorage()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			item := fmt.Sprintf("item%d", i)
+			for j := 0; j < 100; j++ {
+				storage.WriteAt(ctx, "shared", []byte{byte(i)}, int64(i))
+				storage.WriteAt(ctx, item, []byte{byte(j)}, int64(j))
+				storage.ReadAt(ctx, "shared", make([]byte, 8), 0)
+				storage.Size(ctx, item)
+				storage.List("item")
+				storage.Stat("shared")
+				storage.Clone()
+				storage.Rename(item, item+".tmp")
+				storage.Rename(item+".tmp", item)
+			}
+			storage.Truncate(item, 50)
+		}(i)
+	}
+	wg.Wait()
+
+	shared := make([]byte, 8)
+	storage.Read("shared", 0, shared)
+	if !bytes.Equal(shared, []byte{0, 1, 2, 3, 4, 5, 6, 7}) {
+		t.Errorf("shared item holds %v", shared)
+	}
+	items, _ := storage.List("item")
+	if len(items) != 8 {
+		t.Fatalf("listed %d items, want 8", len(items))
+	}
+	for _, item := range items {
+		if item.Size != 50 {
+			t.Errorf("%s is %d bytes, want 50", item.Name, item.Size)
+		}
+	}
+}
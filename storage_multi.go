@@ -1,5 +1,13 @@
 package gemu
 
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
 type MultiStorage struct {
 	storage []Storage
 }
@@ -18,29 +26,201 @@ func (MS *MultiStorage) Exists(Item string) bool {
 }
 
 func (MS *MultiStorage) Length(Item string) int {
-	for _, S := range MS.storage {
-		if S.Exists(Item) {
-			return S.Length(Item)
-		}
+	if i := MS.find(Item); i >= 0 {
+		return MS.storage[i].Length(Item)
 	}
 	return 0
 }
 
 func (MS *MultiStorage) Read(Item string, offset int, data []byte) {
+	if i := MS.find(Item); i >= 0 {
+		MS.storage[i].Read(Item, offset, data)
+	}
+}
+
+func (MS *MultiStorage) Write(Item string, offset int, data []byte) {
+	S, err := MS.writable(context.Background(), Item)
+	if err != nil {
+		log.Println("Storage write failed:", err)
+		return
+	}
+	S.Write(Item, offset, data)
+}
+
+func (MS *MultiStorage) ReadOnly(Item string) bool {
+	_, to := MS.target(Item)
+	return IsReadOnly(MS.storage[to], Item)
+}
+
+// find returns the index of the storage holding Item, or -1.  A writable copy
+// of an item hides read only ones, wherever it is in the list.
+func (MS *MultiStorage) find(Item string) int {
+	found := -1
+	for i, S := range MS.storage {
+		if !S.Exists(Item) {
+			continue
+		}
+		if !IsReadOnly(S, Item) {
+			return i
+		}
+		if found < 0 {
+			found = i
+		}
+	}
+	return found
+}
+
+// target returns the index of the storage holding Item, -1 if there is none,
+// and of the one writes to it should go to: the storage holding it if that
+// is writable, or else the first writable one.  If none are, writes go where
+// Item is, or to the first storage, and fail there.
+func (MS *MultiStorage) target(Item string) (int, int) {
+	from := MS.find(Item)
+	if from >= 0 && !IsReadOnly(MS.storage[from], Item) {
+		return from, from
+	}
+	for i, S := range MS.storage {
+		if i != from && !IsReadOnly(S, Item) {
+			return from, i
+		}
+	}
+	if from < 0 {
+		return from, 0
+	}
+	return from, from
+}
+
+// writable returns the storage writes to Item go to.  Items that are only in
+// read only storages are copied whole into the first storage that can take
+// them, so partial writes do not leave a sparse copy behind.
+func (MS *MultiStorage) writable(ctx context.Context, Item string) (Storage, error) {
+	from, to := MS.target(Item)
+	if from >= 0 && from != to {
+		src, dst := AsStorageV2(MS.storage[from]), AsStorageV2(MS.storage[to])
+		size, err := src.Size(ctx, Item)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		if n, err := src.ReadAt(ctx, Item, data, 0); err != nil && !(err == io.EOF && n == len(data)) {
+			return nil, err
+		}
+		if _, err := dst.WriteAt(ctx, Item, data, 0); err != nil {
+			return nil, err
+		}
+	}
+	return MS.storage[to], nil
+}
+
+func (MS *MultiStorage) Size(ctx context.Context, Item string) (int64, error) {
+	i := MS.find(Item)
+	if i < 0 {
+		return 0, os.ErrNotExist
+	}
+	return AsStorageV2(MS.storage[i]).Size(ctx, Item)
+}
+
+func (MS *MultiStorage) ReadAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	i := MS.find(Item)
+	if i < 0 {
+		return 0, os.ErrNotExist
+	}
+	return AsStorageV2(MS.storage[i]).ReadAt(ctx, Item, data, offset)
+}
+
+func (MS *MultiStorage) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	S, err := MS.writable(ctx, Item)
+	if err != nil {
+		return 0, err
+	}
+	return AsStorageV2(S).WriteAt(ctx, Item, data, offset)
+}
+
+// List merges the lists of every storage that can list, describing each item
+// as it is seen through the MultiStorage.
+func (MS *MultiStorage) List(prefix string) ([]ItemInfo, error) {
+	names := map[string]bool{}
+	listed := false
 	for _, S := range MS.storage {
-		if S.Exists(Item) {
-			S.Read(Item, offset, data)
-			return
+		items, err := ListItems(S, prefix)
+		if err == ErrNotSupported {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		listed = true
+		for _, item := range items {
+			names[item.Name] = true
+		}
+	}
+	if !listed {
+		return nil, ErrNotSupported
+	}
+	items := make([]ItemInfo, 0, len(names))
+	for name := range names {
+		if item, err := MS.Stat(name); err == nil {
+			items = append(items, item)
 		}
 	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
 }
 
-func (MS *MultiStorage) Write(Item string, offset int, data []byte) {
+func (MS *MultiStorage) Stat(Item string) (ItemInfo, error) {
+	i := MS.find(Item)
+	if i < 0 {
+		return ItemInfo{}, &os.PathError{Op: "stat", Path: Item, Err: os.ErrNotExist}
+	}
+	return StatItem(MS.storage[i], Item)
+}
+
+// Delete removes Item from every storage that has a writable copy.  Copies in
+// read only storages cannot be deleted, and are reported as a permission
+// error.
+func (MS *MultiStorage) Delete(Item string) error {
+	found := false
 	for _, S := range MS.storage {
-		if S.Exists(Item) {
-			S.Write(Item, offset, data)
-			return
+		if !S.Exists(Item) {
+			continue
+		}
+		found = true
+		if IsReadOnly(S, Item) {
+			continue
 		}
+		if err := DeleteItem(S, Item); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return &os.PathError{Op: "delete", Path: Item, Err: os.ErrNotExist}
+	}
+	if MS.Exists(Item) {
+		return &os.PathError{Op: "delete", Path: Item, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+// Rename renames the copy of from that is visible, which has to be in a
+// writable storage.
+func (MS *MultiStorage) Rename(from, to string) error {
+	i := MS.find(from)
+	if i < 0 {
+		return &os.PathError{Op: "rename", Path: from, Err: os.ErrNotExist}
+	}
+	if IsReadOnly(MS.storage[i], from) {
+		return &os.PathError{Op: "rename", Path: from, Err: os.ErrPermission}
+	}
+	return RenameItem(MS.storage[i], from, to)
+}
+
+func (MS *MultiStorage) Truncate(Item string, size int64) error {
+	if MS.find(Item) < 0 {
+		return &os.PathError{Op: "truncate", Path: Item, Err: os.ErrNotExist}
+	}
+	S, err := MS.writable(context.Background(), Item)
+	if err != nil {
+		return err
 	}
-	MS.storage[0].Write(Item, offset, data)
+	return TruncateItem(S, Item, size)
 }
@@ -0,0 +1,432 @@
+package gemu
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OverlayBlockSize is the default granularity of copy on write, one floppy
+// sector.
+const OverlayBlockSize = 1024
+
+// OverlayStorage layers a writable Upper storage over a read only Base.
+// Items are only ever written to Upper: the first write to a block of an
+// item from Base copies the block up, and reads take each block from
+// whichever layer has it.  Upper keeps which blocks it has in Item + ".cow",
+// so many overlays can share a Base, each holding only its own changes.
+//
+// Items that are not in Base, or that Upper has without a ".cow", belong to
+// Upper entirely.
+type OverlayStorage struct {
+	Base      Storage
+	Upper     Storage
+	BlockSize int
+
+	mu    sync.Mutex
+	metas map[string]*overlayMeta
+}
+
+// overlayMeta is stored as the big endian block size (uint32) and item
+// length (uint64), followed by a bitmap of the blocks in Upper.  The block
+// size has to be a whole number of words; maps with any other take
+// OverlayStorage.BlockSize instead.  Maps whose bitmap is longer than the
+// item are refused.
+type overlayMeta struct {
+	blockSize int
+	length    int
+	blocks    []byte
+}
+
+const overlayMetaHeader = 12
+
+// ErrOverlayMeta is returned for items whose block map is corrupt.
+var ErrOverlayMeta = errors.New("overlay block map is corrupt")
+
+func NewOverlayStorage(base Storage, upper Storage) Storage {
+	return &OverlayStorage{Base: base, Upper: upper, BlockSize: OverlayBlockSize, metas: map[string]*overlayMeta{}}
+}
+
+func (M *overlayMeta) has(block int) bool {
+	return block/8 < len(M.blocks) && M.blocks[block/8]&(1<<uint(block%8)) != 0
+}
+
+func (M *overlayMeta) set(block int) {
+	for block/8 >= len(M.blocks) {
+		M.blocks = append(M.blocks, 0)
+	}
+	M.blocks[block/8] |= 1 << uint(block%8)
+}
+
+// parseOverlayMeta decodes a block map, taking blockSize as the block size if
+// the stored one is not a whole number of words.
+func parseOverlayMeta(data []byte, blockSize int) (*overlayMeta, error) {
+	if len(data) < overlayMetaHeader {
+		return nil, ErrOverlayMeta
+	}
+	meta := &overlayMeta{
+		blockSize: int(binary.BigEndian.Uint32(data)),
+		blocks:    data[overlayMetaHeader:],
+	}
+	if meta.blockSize <= 0 || meta.blockSize%2 != 0 {
+		meta.blockSize = blockSize
+	}
+	length := binary.BigEndian.Uint64(data[4:])
+	if length > math.MaxInt32 {
+		return nil, ErrOverlayMeta
+	}
+	meta.length = int(length)
+	blocks := (meta.length + meta.blockSize - 1) / meta.blockSize
+	if len(meta.blocks) > (blocks+7)/8 {
+		return nil, ErrOverlayMeta
+	}
+	return meta, nil
+}
+
+// meta returns the block map of Item, or nil if Item is not split between
+// the layers.
+func (OS *OverlayStorage) meta(ctx context.Context, Item string) (*overlayMeta, error) {
+	if meta, ok := OS.metas[Item]; ok {
+		return meta, nil
+	}
+	item := Item + ".cow"
+	if !OS.Upper.Exists(item) {
+		return nil, nil
+	}
+	data := make([]byte, OS.Upper.Length(item))
+	if _, err := AsStorageV2(OS.Upper).ReadAt(ctx, item, data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	meta, err := parseOverlayMeta(data, OS.BlockSize)
+	if err != nil {
+		return nil, &os.PathError{Op: "read", Path: item, Err: err}
+	}
+	OS.metas[Item] = meta
+	return meta, nil
+}
+
+func (OS *OverlayStorage) saveMeta(ctx context.Context, Item string, meta *overlayMeta) error {
+	data := make([]byte, overlayMetaHeader+len(meta.blocks))
+	binary.BigEndian.PutUint32(data, uint32(meta.blockSize))
+	binary.BigEndian.PutUint64(data[4:], uint64(meta.length))
+	copy(data[overlayMetaHeader:], meta.blocks)
+	_, err := AsStorageV2(OS.Upper).WriteAt(ctx, Item+".cow", data, 0)
+	return err
+}
+
+// readLayer reads from a layer, zero filling what is past its end.
+func readLayer(ctx context.Context, S Storage, Item string, offset int, data []byte) error {
+	n, err := AsStorageV2(S).ReadAt(ctx, Item, data, int64(offset))
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err != nil && os.IsNotExist(err)) {
+		err = nil
+	}
+	for i := n; i < len(data); i++ {
+		data[i] = 0
+	}
+	return err
+}
+
+// each calls fn for each block the range touches, with the part of the
+// range inside it, stopping at the first error.
+func (M *overlayMeta) each(offset, length int, fn func(block, start, end int) error) error {
+	for pos := offset; pos < offset+length; {
+		block := pos / M.blockSize
+		end := (block + 1) * M.blockSize
+		if end > offset+length {
+			end = offset + length
+		}
+		if err := fn(block, pos, end); err != nil {
+			return err
+		}
+		pos = end
+	}
+	return nil
+}
+
+// copyUp copies block n of Item up from Base, so it never has to be merged
+// with Base again.
+func (OS *OverlayStorage) copyUp(ctx context.Context, Item string, meta *overlayMeta, n int) error {
+	length := meta.length - n*meta.blockSize
+	if length > meta.blockSize {
+		length = meta.blockSize
+	}
+	if length > 0 {
+		block := make([]byte, length)
+		if err := readLayer(ctx, OS.Base, Item, n*meta.blockSize, block); err != nil {
+			return err
+		}
+		if _, err := AsStorageV2(OS.Upper).WriteAt(ctx, Item, block, int64(n*meta.blockSize)); err != nil {
+			return err
+		}
+	}
+	meta.set(n)
+	return nil
+}
+
+// split returns the block map of Item, starting one if it is in Base alone.
+// It returns nil for items that belong to Upper.
+func (OS *OverlayStorage) split(ctx context.Context, Item string) (*overlayMeta, error) {
+	meta, err := OS.meta(ctx, Item)
+	if meta != nil || err != nil {
+		return meta, err
+	}
+	if OS.Upper.Exists(Item) || !OS.Base.Exists(Item) {
+		return nil, nil
+	}
+	size, err := AsStorageV2(OS.Base).Size(ctx, Item)
+	if err != nil {
+		return nil, err
+	}
+	meta = &overlayMeta{blockSize: OS.BlockSize, length: int(size)}
+	OS.metas[Item] = meta
+	return meta, nil
+}
+
+func (OS *OverlayStorage) Exists(Item string) bool {
+	return OS.Upper.Exists(Item) || OS.Base.Exists(Item)
+}
+
+func (OS *OverlayStorage) Size(ctx context.Context, Item string) (int64, error) {
+	OS.mu.Lock()
+	defer OS.mu.Unlock()
+	meta, err := OS.meta(ctx, Item)
+	if err != nil {
+		return 0, err
+	}
+	if meta != nil {
+		return int64(meta.length), nil
+	}
+	if OS.Upper.Exists(Item) {
+		return AsStorageV2(OS.Upper).Size(ctx, Item)
+	}
+	return AsStorageV2(OS.Base).Size(ctx, Item)
+}
+
+func (OS *OverlayStorage) ReadAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	OS.mu.Lock()
+	defer OS.mu.Unlock()
+	meta, err := OS.meta(ctx, Item)
+	if err != nil {
+		return 0, err
+	}
+	if meta == nil {
+		if OS.Upper.Exists(Item) {
+			return AsStorageV2(OS.Upper).ReadAt(ctx, Item, data, offset)
+		}
+		return AsStorageV2(OS.Base).ReadAt(ctx, Item, data, offset)
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset >= int64(meta.length) {
+		return 0, io.EOF
+	}
+	n := len(data)
+	if rest := meta.length - int(offset); n > rest {
+		n = rest
+	}
+	err = meta.each(int(offset), n, func(block, start, end int) error {
+		chunk := data[start-int(offset) : end-int(offset)]
+		if meta.has(block) {
+			return readLayer(ctx, OS.Upper, Item, start, chunk)
+		}
+		return readLayer(ctx, OS.Base, Item, start, chunk)
+	})
+	if err == nil && n < len(data) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (OS *OverlayStorage) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	OS.mu.Lock()
+	defer OS.mu.Unlock()
+	meta, err := OS.split(ctx, Item)
+	if err != nil {
+		return 0, err
+	}
+	if meta == nil {
+		return AsStorageV2(OS.Upper).WriteAt(ctx, Item, data, offset)
+	}
+	err = meta.each(int(offset), len(data), func(n, start, end int) error {
+		if meta.has(n) {
+			return nil
+		}
+		if start > n*meta.blockSize || end < (n+1)*meta.blockSize {
+			return OS.copyUp(ctx, Item, meta, n)
+		}
+		meta.set(n)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	written, err := AsStorageV2(OS.Upper).WriteAt(ctx, Item, data, offset)
+	if end := int(offset) + written; end > meta.length {
+		meta.length = end
+	}
+	if saveErr := OS.saveMeta(ctx, Item, meta); err == nil {
+		err = saveErr
+	}
+	return written, err
+}
+
+func (OS *OverlayStorage) Length(Item string) int {
+	size, _ := OS.Size(context.Background(), Item)
+	return int(size)
+}
+
+func (OS *OverlayStorage) Read(Item string, offset int, data []byte) {
+	if _, err := OS.ReadAt(context.Background(), Item, data, int64(offset)); err != nil && err != io.EOF && !os.IsNotExist(err) {
+		log.Println("Storage read failed:", err)
+	}
+}
+
+func (OS *OverlayStorage) Write(Item string, offset int, data []byte) {
+	if _, err := OS.WriteAt(context.Background(), Item, data, int64(offset)); err != nil {
+		log.Println("Storage write failed:", err)
+	}
+}
+
+func (OS *OverlayStorage) ReadOnly(Item string) bool {
+	return IsReadOnly(OS.Upper, Item)
+}
+
+// Delete removes an item that is only in Upper.  Items in Base cannot be
+// deleted, as there is no way to hide them.
+func (OS *OverlayStorage) Delete(Item string) error {
+	OS.mu.Lock()
+	defer OS.mu.Unlock()
+	if OS.sidecar(Item) || !OS.Exists(Item) {
+		return &os.PathError{Op: "delete", Path: Item, Err: os.ErrNotExist}
+	}
+	if OS.Base.Exists(Item) {
+		return &os.PathError{Op: "delete", Path: Item, Err: os.ErrPermission}
+	}
+	return DeleteItem(OS.Upper, Item)
+}
+
+// Rename renames an item that is only in Upper, to a name Base does not have.
+func (OS *OverlayStorage) Rename(from, to string) error {
+	OS.mu.Lock()
+	defer OS.mu.Unlock()
+	if OS.sidecar(from) || !OS.Exists(from) {
+		return &os.PathError{Op: "rename", Path: from, Err: os.ErrNotExist}
+	}
+	if OS.Base.Exists(from) || OS.Base.Exists(to) || OS.sidecar(to) {
+		return &os.PathError{Op: "rename", Path: from, Err: os.ErrPermission}
+	}
+	return RenameItem(OS.Upper, from, to)
+}
+
+// Truncate changes the length of Item.  Cutting an item from Base shorter
+// than Base has it copies the rest of it up, so Upper holds all of it and
+// what Base has past the cut cannot show through again.
+func (OS *OverlayStorage) Truncate(Item string, size int64) error {
+	ctx := context.Background()
+	OS.mu.Lock()
+	defer OS.mu.Unlock()
+	if OS.sidecar(Item) || !OS.Exists(Item) {
+		return &os.PathError{Op: "truncate", Path: Item, Err: os.ErrNotExist}
+	}
+	if size < 0 || size > math.MaxInt32 {
+		return &os.PathError{Op: "truncate", Path: Item, Err: os.ErrInvalid}
+	}
+	meta, err := OS.split(ctx, Item)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return TruncateItem(OS.Upper, Item, size)
+	}
+	if size < int64(OS.Base.Length(Item)) {
+		for n := 0; n*meta.blockSize < int(size); n++ {
+			if !meta.has(n) {
+				if err := OS.copyUp(ctx, Item, meta, n); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := AsStorageV2(OS.Upper).WriteAt(ctx, Item, nil, 0); err != nil {
+			return err
+		}
+		if err := TruncateItem(OS.Upper, Item, size); err != nil {
+			return err
+		}
+		delete(OS.metas, Item)
+		return DeleteItem(OS.Upper, Item+".cow")
+	}
+	if OS.Upper.Exists(Item) && int64(OS.Upper.Length(Item)) > size {
+		if err := TruncateItem(OS.Upper, Item, size); err != nil {
+			return err
+		}
+	}
+	meta.length = int(size)
+	blocks := (meta.length + meta.blockSize - 1) / meta.blockSize
+	if len(meta.blocks) > (blocks+7)/8 {
+		meta.blocks = meta.blocks[:(blocks+7)/8]
+	}
+	return OS.saveMeta(ctx, Item, meta)
+}
+
+// sidecar reports whether Item is the block map of another item.
+func (OS *OverlayStorage) sidecar(Item string) bool {
+	return strings.HasSuffix(Item, ".cow") && OS.Upper.Exists(Item)
+}
+
+// List merges the lists of both layers, leaving out the block maps.
+func (OS *OverlayStorage) List(prefix string) ([]ItemInfo, error) {
+	names := map[string]bool{}
+	listed := false
+	for _, S := range []Storage{OS.Base, OS.Upper} {
+		items, err := ListItems(S, prefix)
+		if err == ErrNotSupported {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		listed = true
+		for _, item := range items {
+			names[item.Name] = true
+		}
+	}
+	if !listed {
+		return nil, ErrNotSupported
+	}
+	items := make([]ItemInfo, 0, len(names))
+	for name := range names {
+		if item, err := OS.Stat(name); err == nil {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+// Stat describes Item as read through the overlay, with the modification
+// time of the layer last written to.
+func (OS *OverlayStorage) Stat(Item string) (ItemInfo, error) {
+	if OS.sidecar(Item) || !OS.Exists(Item) {
+		return ItemInfo{}, &os.PathError{Op: "stat", Path: Item, Err: os.ErrNotExist}
+	}
+	info := ItemInfo{Name: Item, Size: int64(OS.Length(Item))}
+	layer := OS.Base
+	if OS.Upper.Exists(Item) {
+		layer = OS.Upper
+	}
+	if stat, err := StatItem(layer, Item); err == nil {
+		info.ModTime = stat.ModTime
+	}
+	return info, nil
+}
@@ -0,0 +1,226 @@
+package gemu
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func newTestOverlay(size int) (*MemStorage, *MemStorage, Storage) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	base := NewMemStorageFrom(map[string][]byte{"disk": data})
+	upper := NewMemStorage()
+	return base, upper, NewOverlayStorage(base, upper)
+}
+
+func TestOverlayMergesBlocks(t *testing.T) {
+	base, upper, overlay := newTestOverlay(3000)
+	overlay.Write("disk", 1500, []byte{0xAA, 0xBB})
+	overlay.Write("disk", 3100, []byte{0xCC})
+	if length := overlay.Length("disk"); length != 3101 {
+		t.Fatalf("length is %d, want 3101", length)
+	}
+	want := make([]byte, 3101)
+	for i := 0; i < 3000; i++ {
+		want[i] = byte(i)
+	}
+	want[1500], want[1501], want[3100] = 0xAA, 0xBB, 0xCC
+	got := make([]byte, len(want))
+	overlay.Read("disk", 0, got)
+	if !bytes.Equal(got, want) {
+		t.Fatal("overlay does not read back what was written over the base")
+	}
+
+	original := make([]byte, 2)
+	base.Read("disk", 1500, original)
+	if original[0] != 1500%256 || base.Length("disk") != 3000 {
+		t.Error("base was written to")
+	}
+	if !upper.Exists("disk.cow") {
+		t.Error("no block map in the upper layer")
+	}
+	// Only the second block and those after the end of the base were
+	// copied up, so the first block still comes from the base.
+	inUpper := make([]byte, OverlayBlockSize)
+	upper.Read("disk", 0, inUpper)
+	if !bytes.Equal(inUpper, make([]byte, OverlayBlockSize)) {
+		t.Error("untouched block was copied up")
+	}
+
+	reopened := NewOverlayStorage(base, upper)
+	reopened.Read("disk", 0, got)
+	if !bytes.Equal(got, want) {
+		t.Error("reopened overlay lost the block map")
+	}
+}
+
+func TestOverlayNewItems(t *testing.T) {
+	_, upper, overlay := newTestOverlay(10)
+	overlay.Write("new", 0, []byte{1, 2})
+	if !upper.Exists("new") || upper.Exists("new.cow") {
+		t.Fatal("new items should be written to the upper layer whole")
+	}
+	got := make([]byte, 2)
+	overlay.Read("new", 0, got)
+	if got[0] != 1 || got[1] != 2 {
+		t.Fatalf("read %v", got)
+	}
+}
+
+func TestOverlayListHidesBlockMaps(t *testing.T) {
+	_, _, overlay := newTestOverlay(3000)
+	overlay.Write("disk", 2999, []byte{1, 2})
+	overlay.Write("new", 0, []byte{1})
+	items, err := ListItems(overlay, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Name != "disk" || items[1].Name != "new" {
+		t.Fatalf("listed %v, want disk and new", items)
+	}
+	if items[0].Size != 3001 {
+		t.Errorf("disk is %d bytes, want the overlay's 3001", items[0].Size)
+	}
+	if _, err := StatItem(overlay, "disk.cow"); err == nil {
+		t.Error("block map can be stat'ed")
+	}
+}
+
+func TestOverlayBlockMapValidation(t *testing.T) {
+	ctx := context.Background()
+	meta := func(blockSize uint32, length uint64, bitmap ...byte) []byte {
+		data := make([]byte, overlayMetaHeader)
+		binary.BigEndian.PutUint32(data, blockSize)
+		binary.BigEndian.PutUint64(data[4:], length)
+		return append(data, bitmap...)
+	}
+	for _, test := range []struct {
+		name string
+		cow  []byte
+		ok   bool
+	}{
+		{"valid", meta(1024, 3000, 0x02), true},
+		{"zero block size", meta(0, 3000, 0x02), true},
+		{"odd block size", meta(1023, 3000, 0x02), true},
+		{"bitmap past the end", meta(1024, 3000, 0x02, 0x01), false},
+		{"huge length", meta(1024, 1<<40, 0x02), false},
+		{"short", []byte{0, 0, 4}, false},
+	} {
+		base, upper, overlay := newTestOverlay(3000)
+		upper.Load("disk", make([]byte, 2048))
+		upper.Load("disk.cow", test.cow)
+		got := make([]byte, 2)
+		_, err := AsStorageV2(overlay).ReadAt(ctx, "disk", got, 1024)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: read returned %v", test.name, err)
+			continue
+		}
+		if !test.ok {
+			if _, err := AsStorageV2(overlay).WriteAt(ctx, "disk", got, 0); err == nil {
+				t.Errorf("%s: wrote through a corrupt block map", test.name)
+			}
+			continue
+		}
+		// The second block is in the upper layer and zeroed there.
+		if got[0] != 0 || got[1] != 0 {
+			t.Errorf("%s: read % x from the base", test.name, got)
+		}
+		if base.Length("disk") != 3000 {
+			t.Errorf("%s: base changed", test.name)
+		}
+	}
+}
+
+func TestOverlayErrors(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemStorageFrom(map[string][]byte{"disk": make([]byte, 3000)})
+	overlay := NewOverlayStorage(base, failingMem{NewMemStorage(), errors.New("upper full")})
+	if _, err := AsStorageV2(overlay).WriteAt(ctx, "disk", []byte{1}, 10); err == nil {
+		t.Error("write to a failing upper layer succeeded")
+	}
+	if _, err := AsStorageV2(overlay).WriteAt(ctx, "disk", []byte{1}, -1); err == nil {
+		t.Error("wrote at -1")
+	}
+	data := make([]byte, 10)
+	if n, err := AsStorageV2(overlay).ReadAt(ctx, "disk", data, 2995); n != 5 || err != io.EOF {
+		t.Errorf("read past the end: %d, %v", n, err)
+	}
+	if _, err := AsStorageV2(overlay).ReadAt(ctx, "missing", data, 0); !os.IsNotExist(err) {
+		t.Errorf("read of a missing item: %v", err)
+	}
+}
+
+func TestOverlayDeleteAndRename(t *testing.T) {
+	_, upper, overlay := newTestOverlay(3000)
+	overlay.Write("disk", 0, []byte{1})
+	overlay.Write("new", 0, []byte{1})
+	if err := DeleteItem(overlay, "disk"); !os.IsPermission(err) {
+		t.Errorf("deleting an item in the base: %v", err)
+	}
+	if err := RenameItem(overlay, "disk", "other"); !os.IsPermission(err) {
+		t.Errorf("renaming an item in the base: %v", err)
+	}
+	if err := RenameItem(overlay, "new", "disk"); !os.IsPermission(err) {
+		t.Errorf("renaming over an item in the base: %v", err)
+	}
+	if err := DeleteItem(overlay, "disk.cow"); !os.IsNotExist(err) {
+		t.Errorf("deleting a block map: %v", err)
+	}
+	if err := RenameItem(overlay, "new", "renamed"); err != nil || !upper.Exists("renamed") {
+		t.Fatalf("renaming an upper item: %v", err)
+	}
+	if err := DeleteItem(overlay, "renamed"); err != nil || overlay.Exists("renamed") {
+		t.Errorf("deleting an upper item: %v", err)
+	}
+}
+
+func TestOverlayTruncate(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		size   int64
+		copied bool
+	}{
+		{"grow", 5000, false},
+		{"past the base", 3000, false},
+		{"into the base", 1500, true},
+		{"to nothing", 0, true},
+	} {
+		base, upper, overlay := newTestOverlay(3000)
+		overlay.Write("disk", 3100, []byte{0xCC})
+		if err := TruncateItem(overlay, "disk", test.size); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if length := overlay.Length("disk"); int64(length) != test.size {
+			t.Errorf("%s: length %d, want %d", test.name, length, test.size)
+		}
+		if copied := !upper.Exists("disk.cow"); copied != test.copied {
+			t.Errorf("%s: copied up whole %v, want %v", test.name, copied, test.copied)
+		}
+		// Growing again reads zeroes where the base had data.
+		overlay.Write("disk", 5999, []byte{1})
+		got := make([]byte, 6000)
+		overlay.Read("disk", 0, got)
+		for i := range got[:5999] {
+			want := byte(0)
+			if int64(i) < test.size && i < 3000 {
+				want = byte(i)
+			} else if int64(i) < test.size && i == 3100 {
+				want = 0xCC
+			}
+			if got[i] != want {
+				t.Errorf("%s: byte %d is %d, want %d", test.name, i, got[i], want)
+				break
+			}
+		}
+		if base.Length("disk") != 3000 {
+			t.Errorf("%s: base changed", test.name)
+		}
+	}
+}
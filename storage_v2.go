@@ -0,0 +1,103 @@
+package gemu
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+)
+
+// StorageV2 is the error reporting successor of Storage.  Missing items are
+// reported with an error satisfying os.IsNotExist, and reads past the end of
+// an item return io.EOF along with the bytes that could be read.
+type StorageV2 interface {
+	Size(ctx context.Context, Item string) (int64, error)
+	ReadAt(ctx context.Context, Item string, data []byte, offset int64) (int, error)
+	WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error)
+}
+
+// AsStorageV2 returns storage as a StorageV2.  Storages that only implement
+// Storage cannot report failed writes, but missing items and short reads
+// are still detected.
+func AsStorageV2(storage Storage) StorageV2 {
+	if v2, ok := storage.(StorageV2); ok {
+		return v2
+	}
+	return legacyStorage{storage}
+}
+
+type legacyStorage struct {
+	Storage
+}
+
+func (LS legacyStorage) Size(ctx context.Context, Item string) (int64, error) {
+	if !LS.Exists(Item) {
+		return 0, os.ErrNotExist
+	}
+	return int64(LS.Length(Item)), nil
+}
+
+func (LS legacyStorage) ReadAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	size, err := LS.Size(ctx, Item)
+	if err != nil {
+		return 0, err
+	}
+	if offset >= size {
+		return 0, io.EOF
+	}
+	n := len(data)
+	if int64(n) > size-offset {
+		n = int(size - offset)
+	}
+	LS.Read(Item, int(offset), data[:n])
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt refuses items the storage reports as read only, as their writes
+// would be dropped.
+func (LS legacyStorage) WriteAt(ctx context.Context, Item string, data []byte, offset int64) (int, error) {
+	if IsReadOnly(LS.Storage, Item) {
+		return 0, &os.PathError{Op: "write", Path: Item, Err: os.ErrPermission}
+	}
+	LS.Write(Item, int(offset), data)
+	return len(data), nil
+}
+
+// AsStorage returns storage as a Storage for code that has not moved to
+// StorageV2.  Errors are logged and otherwise dropped.
+func AsStorage(storage StorageV2) Storage {
+	if v1, ok := storage.(Storage); ok {
+		return v1
+	}
+	return v2Storage{storage}
+}
+
+type v2Storage struct {
+	StorageV2
+}
+
+func (VS v2Storage) Exists(Item string) bool {
+	_, err := VS.Size(context.Background(), Item)
+	return err == nil
+}
+
+func (VS v2Storage) Length(Item string) int {
+	size, _ := VS.Size(context.Background(), Item)
+	return int(size)
+}
+
+func (VS v2Storage) Read(Item string, offset int, data []byte) {
+	_, err := VS.ReadAt(context.Background(), Item, data, int64(offset))
+	if err != nil && err != io.EOF {
+		log.Println("Storage read failed:", err)
+	}
+}
+
+func (VS v2Storage) Write(Item string, offset int, data []byte) {
+	if _, err := VS.WriteAt(context.Background(), Item, data, int64(offset)); err != nil {
+		log.Println("Storage write failed:", err)
+	}
+}
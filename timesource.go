@@ -0,0 +1,73 @@
+package gemu
+
+import (
+	"sync"
+	"time"
+)
+
+// TimeSource tells a Clock what the host time is.
+type TimeSource interface {
+	Now() time.Time
+}
+
+// RealTime is the host's wall clock.
+type RealTime struct{}
+
+func (RealTime) Now() time.Time {
+	return time.Now()
+}
+
+// CycleTime derives the time from the number of ticks run, at
+// TicksPerSecond, so it only moves while the machine runs and is the same on
+// every run.  The Clock it is given to ticks it, so give each clock its own.
+type CycleTime struct {
+	Start time.Time
+
+	mu    sync.Mutex
+	ticks uint64
+}
+
+func NewCycleTime(start time.Time) *CycleTime {
+	return &CycleTime{Start: start}
+}
+
+func (C *CycleTime) Tick(ticks int) {
+	C.mu.Lock()
+	C.ticks += uint64(ticks)
+	C.mu.Unlock()
+}
+
+func (C *CycleTime) Now() time.Time {
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	return C.Start.Add(time.Duration(C.ticks) * (time.Second / TicksPerSecond))
+}
+
+// ManualTime only changes when it is told to, for tests.  Left alone it is a
+// fixed time.
+type ManualTime struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func NewManualTime(t time.Time) *ManualTime {
+	return &ManualTime{t: t}
+}
+
+func (M *ManualTime) Now() time.Time {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+	return M.t
+}
+
+func (M *ManualTime) Set(t time.Time) {
+	M.mu.Lock()
+	M.t = t
+	M.mu.Unlock()
+}
+
+func (M *ManualTime) Advance(d time.Duration) {
+	M.mu.Lock()
+	M.t = M.t.Add(d)
+	M.mu.Unlock()
+}
@@ -0,0 +1,50 @@
+package gemu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCycleTime(t *testing.T) {
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		ticks uint64
+		want  time.Duration
+	}{
+		{0, 0},
+		{1, 10 * time.Microsecond},
+		{TicksPerSecond, time.Second},
+		{24 * 3600 * TicksPerSecond, 24 * time.Hour},
+		// Far enough that ticks times a whole second overflows.
+		{1.2e10, 120000 * time.Second},
+	} {
+		source := NewCycleTime(start)
+		for left := test.ticks; left > 0; {
+			step := uint64(1 << 30)
+			if left < step {
+				step = left
+			}
+			source.Tick(int(step))
+			left -= step
+		}
+		if got := source.Now().Sub(start); got != test.want {
+			t.Errorf("after %d ticks: %v, want %v", test.ticks, got, test.want)
+		}
+	}
+}
+
+func TestManualTime(t *testing.T) {
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	source := NewManualTime(start)
+	if !source.Now().Equal(start) {
+		t.Fatal("ManualTime moved by itself")
+	}
+	source.Advance(time.Minute)
+	if got := source.Now().Sub(start); got != time.Minute {
+		t.Errorf("advanced by %v, want a minute", got)
+	}
+	source.Set(start)
+	if !source.Now().Equal(start) {
+		t.Error("Set ignored")
+	}
+}
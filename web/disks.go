@@ -0,0 +1,115 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// serveDisks is the control API for the floppy drives.  GET /disks lists
+// the drives and GET /disks/images?prefix= the images that can be inserted.
+// Changes are POSTs with form values:
+//
+//	/disks/eject    drive
+//	/disks/insert   drive, image
+//	/disks/swap     a, b
+//	/disks/new      image, and drive to insert it
+//	/disks/protect  drive, on (1 or 0)
+//	/disks/delete   image, only with AllowDelete
+//
+// Images are named relative to the emulator's storage.  Changes from pages
+// on other sites, or with no Origin at all, are refused.
+func (S *Server) serveDisks(w http.ResponseWriter, r *http.Request) {
+	if S.Disks == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == "/disks" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(S.Disks.Status())
+		return
+	}
+	if r.URL.Path == "/disks/images" {
+		images, err := S.Disks.Images(r.FormValue("prefix"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(images)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if S.ReadOnly {
+		http.Error(w, "read only", http.StatusForbidden)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, "/disks/") {
+	case "eject":
+		err = S.Disks.Eject(formInt(r, "drive"))
+	case "insert":
+		var image string
+		if image, err = formImage(r); err == nil {
+			err = S.Disks.Insert(formInt(r, "drive"), image)
+		}
+	case "swap":
+		err = S.Disks.Swap(formInt(r, "a"), formInt(r, "b"))
+	case "new":
+		var image string
+		if image, err = formImage(r); err == nil {
+			err = S.Disks.CreateBlank(image)
+		}
+		if err == nil && r.FormValue("drive") != "" {
+			err = S.Disks.Insert(formInt(r, "drive"), image)
+		}
+	case "protect":
+		err = S.Disks.SetWriteProtect(formInt(r, "drive"), r.FormValue("on") == "1")
+	case "delete":
+		if !S.AllowDelete {
+			http.Error(w, "deleting images is not allowed", http.StatusForbidden)
+			return
+		}
+		var image string
+		if image, err = formImage(r); err == nil {
+			err = S.Disks.Delete(image)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func formInt(r *http.Request, name string) int {
+	value, err := strconv.Atoi(r.FormValue(name))
+	if err != nil {
+		return -1
+	}
+	return value
+}
+
+// formImage returns the image named in the request, refusing names that
+// reach outside the storage.
+func formImage(r *http.Request) (string, error) {
+	image := r.FormValue("image")
+	clean := path.Clean("/" + image)[1:]
+	if image == "" || clean != image || strings.Contains(image, "\\") {
+		return "", errors.New("bad image name")
+	}
+	return image, nil
+}
@@ -0,0 +1,63 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/techcompliant/GEMU"
+)
+
+func TestSameOrigin(t *testing.T) {
+	for _, test := range []struct {
+		name, origin, site string
+		ok                 bool
+	}{
+		{"page", "http://emu:8080", "same-origin", true},
+		{"origin only", "http://EMU:8080", "", true},
+		{"typed address", "", "none", true},
+		{"other site", "http://evil", "cross-site", false},
+		{"other origin", "http://evil", "", false},
+		{"same site", "", "same-site", false},
+		{"neither", "", "", false},
+	} {
+		r := httptest.NewRequest("POST", "http://emu:8080/disks/eject", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.site != "" {
+			r.Header.Set("Sec-Fetch-Site", test.site)
+		}
+		if got := sameOrigin(r); got != test.ok {
+			t.Errorf("%s: %v, want %v", test.name, got, test.ok)
+		}
+	}
+}
+
+func TestDisksDelete(t *testing.T) {
+	storage := gemu.NewMemStorageFrom(map[string][]byte{"a.img": {}})
+	machine := gemu.NewMachine(gemu.NewDCPU(0))
+	changer := gemu.NewDiskChanger(machine)
+	changer.Storage = storage
+	server := NewServer(nil)
+	server.Disks = changer
+
+	post := func() int {
+		form := url.Values{"image": {"a.img"}}
+		r := httptest.NewRequest("POST", "http://emu/disks/delete", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "http://emu")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := post(); code != http.StatusForbidden || !storage.Exists("a.img") {
+		t.Errorf("delete without AllowDelete: %d", code)
+	}
+	server.AllowDelete = true
+	if code := post(); code != http.StatusNoContent || storage.Exists("a.img") {
+		t.Errorf("delete with AllowDelete: %d", code)
+	}
+}
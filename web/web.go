@@ -0,0 +1,310 @@
+/*
+Package web serves the displays of a running GEMU machine to web browsers.
+
+Each connected viewer receives PNG frames of the displays over a WebSocket
+whenever they change, and sends key events and pasted text back to the
+keyboard.  Viewers
+that connect with ?spectate=1, or any viewer when the server is read-only,
+only watch.  The page has no external dependencies, so it works offline.
+The floppy drives can be controlled through a small HTTP API under /disks.
+*/
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/techcompliant/GEMU"
+)
+
+type Server struct {
+	// Keys receives key events from viewers' own goroutines, usually the
+	// machine's KeyInput.  Pastes go to it if it is also a Paster.
+	Keys     gemu.KeyInput
+	Layout   *gemu.KeyLayout
+	Displays []gemu.Display
+	ReadOnly bool
+	Interval time.Duration
+	// Disks, if set, is controlled through the /disks API.  Images can
+	// only be deleted through it with AllowDelete.
+	Disks       *gemu.DiskChanger
+	AllowDelete bool
+
+	mu      sync.Mutex
+	clients map[*client]bool
+	frames  [][]byte
+}
+
+type client struct {
+	ws       *wsConn
+	keys     *gemu.HostKeyboard
+	send     chan []byte
+	spectate bool
+}
+
+type frameMessage struct {
+	Type    string `json:"type"`
+	Display int    `json:"display"`
+	Border  string `json:"border"`
+	PNG     string `json:"png"`
+}
+
+type inputMessage struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	Down bool   `json:"down"`
+	Text string `json:"text"`
+}
+
+func NewServer(keys gemu.KeyInput, displays ...gemu.Display) *Server {
+	return &Server{
+		Keys:     keys,
+		Displays: displays,
+		Interval: 50 * time.Millisecond,
+		clients:  make(map[*client]bool),
+		frames:   make([][]byte, len(displays)),
+	}
+}
+
+func (S *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, pageHTML, len(S.Displays))
+	case "/ws":
+		S.serveWebsocket(w, r)
+	default:
+		if strings.HasPrefix(r.URL.Path, "/disks") {
+			S.serveDisks(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+// sameOrigin reports whether r comes from a page this server served.
+// Browsers send an Origin with WebSocket handshakes and POSTs, and a
+// Sec-Fetch-Site with most requests, so this keeps other web sites from
+// driving the emulator through the viewer's browser.  Requests with neither
+// are refused too, as there is no telling where they came from; other
+// clients have to send an Origin naming this server.
+func sameOrigin(r *http.Request) bool {
+	site := r.Header.Get("Sec-Fetch-Site")
+	if site != "" && site != "same-origin" && site != "none" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return site != ""
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func (S *Server) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	ws, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+	c := &client{
+		ws:       ws,
+		send:     make(chan []byte, len(S.Displays)*2),
+		spectate: S.ReadOnly || r.URL.Query().Get("spectate") != "",
+	}
+	if S.Keys != nil {
+		c.keys = gemu.NewHostKeyboard(S.Keys, S.Layout)
+	}
+	S.mu.Lock()
+	S.clients[c] = true
+	for _, frame := range S.frames {
+		if frame != nil {
+			c.send <- frame
+		}
+	}
+	S.mu.Unlock()
+
+	go func() {
+		for msg := range c.send {
+			if err := ws.WriteText(msg); err != nil {
+				ws.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		if c.spectate || c.keys == nil {
+			continue
+		}
+		input := inputMessage{}
+		if err := json.Unmarshal(msg, &input); err != nil {
+			continue
+		}
+		switch input.Type {
+		case "key":
+			c.keyEvent(input)
+		case "paste":
+			if paster, ok := S.Keys.(gemu.Paster); ok {
+				paster.Paste(input.Text)
+			}
+		}
+	}
+
+	S.mu.Lock()
+	delete(S.clients, c)
+	close(c.send)
+	S.mu.Unlock()
+	ws.Close()
+}
+
+var browserKeys = map[string]string{
+	"Backspace":  "BackSpace",
+	"Enter":      "Return",
+	"ArrowUp":    "Up",
+	"ArrowDown":  "Down",
+	"ArrowLeft":  "Left",
+	"ArrowRight": "Right",
+	"Shift":      "Shift_L",
+	"Control":    "Control_L",
+}
+
+func (c *client) keyEvent(key inputMessage) {
+	name := key.Key
+	if x11, ok := browserKeys[name]; ok {
+		name = x11
+	}
+	c.keys.Key(name, key.Down)
+	if key.Down && !c.keys.Control() {
+		c.keys.Char(name)
+	}
+}
+
+func (S *Server) broadcast(msg []byte) {
+	S.mu.Lock()
+	defer S.mu.Unlock()
+	for c := range S.clients {
+		select {
+		case c.send <- msg:
+		default:
+		}
+	}
+}
+
+// Run renders the displays every Interval and sends changed frames to all
+// viewers.  It never returns.
+func (S *Server) Run() {
+	last := make([]*image.RGBA, len(S.Displays))
+	lastBorder := make([]string, len(S.Displays))
+	for {
+		time.Sleep(S.Interval)
+		for i, display := range S.Displays {
+			img := display.Render()
+			bc := display.BorderColor()
+			border := fmt.Sprintf("#%02x%02x%02x", bc.R, bc.G, bc.B)
+			if last[i] != nil && bytes.Equal(last[i].Pix, img.Pix) && lastBorder[i] == border {
+				continue
+			}
+			last[i], lastBorder[i] = img, border
+			buf := &bytes.Buffer{}
+			if err := png.Encode(buf, img); err != nil {
+				log.Println("web: encoding frame:", err)
+				continue
+			}
+			msg, _ := json.Marshal(frameMessage{
+				Type:    "frame",
+				Display: i,
+				Border:  border,
+				PNG:     base64.StdEncoding.EncodeToString(buf.Bytes()),
+			})
+			S.mu.Lock()
+			S.frames[i] = msg
+			S.mu.Unlock()
+			S.broadcast(msg)
+		}
+	}
+}
+
+// ListenAndServe starts the render loop and serves viewers on addr.
+func (S *Server) ListenAndServe(addr string) error {
+	go S.Run()
+	return http.ListenAndServe(addr, S)
+}
+
+const pageHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GEMU</title>
+<style>
+body { background: #222; margin: 0; padding: 16px; }
+canvas { width: 560px; height: 432px; image-rendering: pixelated; image-rendering: crisp-edges; display: block; margin-bottom: 16px; }
+</style>
+</head>
+<body>
+<script>
+var count = %d;
+var canvases = [];
+for (var i = 0; i < count; i++) {
+	var canvas = document.createElement("canvas");
+	canvas.width = 140;
+	canvas.height = 108;
+	document.body.appendChild(canvas);
+	canvases.push(canvas);
+}
+var spectate = /[?&]spectate=/.test(location.search);
+var proto = location.protocol == "https:" ? "wss:" : "ws:";
+var ws = new WebSocket(proto + "//" + location.host + "/ws" + location.search);
+ws.onmessage = function(ev) {
+	var msg = JSON.parse(ev.data);
+	if (msg.type != "frame") {
+		return;
+	}
+	var img = new Image();
+	img.onload = function() {
+		var ctx = canvases[msg.display].getContext("2d");
+		ctx.fillStyle = msg.border;
+		ctx.fillRect(0, 0, 140, 108);
+		ctx.drawImage(img, 6, 6);
+	};
+	img.src = "data:image/png;base64," + msg.png;
+};
+function send(ev, down) {
+	if (spectate || ev.altKey || ev.metaKey || (ev.ctrlKey && ev.key == "v")) {
+		return;
+	}
+	if (ev.key.length != 1 && !/^(Backspace|Enter|Insert|Delete|Arrow.*|Shift|Control)$/.test(ev.key)) {
+		return;
+	}
+	ev.preventDefault();
+	ws.send(JSON.stringify({type: "key", key: ev.key, down: down}));
+}
+document.addEventListener("keydown", function(ev) { send(ev, true); });
+document.addEventListener("keyup", function(ev) { send(ev, false); });
+document.addEventListener("paste", function(ev) {
+	if (!spectate) {
+		ev.preventDefault();
+		ws.send(JSON.stringify({type: "paste", text: ev.clipboardData.getData("text")}));
+	}
+});
+</script>
+</body>
+</html>
+`